@@ -151,6 +151,16 @@ const AuthService = {
   }
 };
 
+// Send the CSRF token with state-changing requests so cookie-authenticated calls are accepted
+axios.interceptors.request.use((config) => {
+  const method = (config.method || 'get').toLowerCase();
+  const csrfToken = getCookie('csrf_token');
+  if (csrfToken && config.headers && !['get', 'head', 'options'].includes(method)) {
+    config.headers['X-CSRF-Token'] = csrfToken;
+  }
+  return config;
+});
+
 // Set auth header if token exists on app initialization
 const token = AuthService.getToken();
 if (token) {
@@ -75,7 +75,7 @@ psql -d gotext -f server/internal/db/schema.sql
 
 # Start server in background
 echo -e "${GREEN}Starting Go server...${NC}"
-cd server && go run cmd/server/main.go &
+cd server && APP_ENV=development go run cmd/server/main.go &
 SERVER_PID=$!
 cd ..
 
@@ -10,8 +10,17 @@ import (
 	"time"
 
 	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/config"
 	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/mailer"
+	"github.com/gotext/server/internal/messages"
 	"github.com/gotext/server/internal/middleware"
+	"github.com/gotext/server/internal/presence"
+	"github.com/gotext/server/internal/ratelimit"
+	"github.com/gotext/server/internal/rbac"
+	"github.com/gotext/server/internal/realtime"
+	"github.com/gotext/server/internal/spaces"
 )
 
 const (
@@ -34,37 +43,186 @@ func main() {
 		logger.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
-	
+
+	// Initialize mailer and authentication settings
+	if err := mailer.Init(mailer.DefaultConfig()); err != nil {
+		logger.Fatalf("Failed to initialize mailer: %v", err)
+	}
+	authConfig, err := auth.DefaultConfig()
+	if err != nil {
+		logger.Fatalf("Invalid authentication configuration: %v", err)
+	}
+	if err := auth.Init(authConfig); err != nil {
+		logger.Fatalf("Failed to initialize authentication: %v", err)
+	}
+	messagesConfig, err := messages.DefaultConfig()
+	if err != nil {
+		logger.Fatalf("Invalid messaging configuration: %v", err)
+	}
+	if err := messages.Init(messagesConfig); err != nil {
+		logger.Fatalf("Failed to initialize messaging: %v", err)
+	}
+	presenceConfig, err := presence.DefaultConfig()
+	if err != nil {
+		logger.Fatalf("Invalid presence configuration: %v", err)
+	}
+	if err := presence.Init(presenceConfig); err != nil {
+		logger.Fatalf("Failed to initialize presence: %v", err)
+	}
+	rateLimitConfig, err := ratelimit.DefaultConfig()
+	if err != nil {
+		logger.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	if err := ratelimit.Init(rateLimitConfig); err != nil {
+		logger.Fatalf("Failed to initialize rate limiting: %v", err)
+	}
+
+	// Share events with the other server instances and deliver them to real-time connections
+	eventsConfig, err := events.DefaultConfig()
+	if err != nil {
+		logger.Fatalf("Invalid event bus configuration: %v", err)
+	}
+	if err := events.Init(eventsConfig); err != nil {
+		logger.Fatalf("Failed to initialize event bus: %v", err)
+	}
+	defer events.Close()
+	realtime.Init()
+
+	// Make sure the configured owner account can administer the server
+	if err := rbac.BootstrapOwner(config.GetEnv("OWNER_EMAIL", "")); err != nil {
+		logger.Fatalf("Failed to set up server owner: %v", err)
+	}
+
+	// Background jobs run until shutdown
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go auth.StartKeyRotation(background)
+	go events.StartLogPruning(background)
+	go presence.Start(background)
+
+	// Authenticated requests keep the user online
+	middleware.OnAuthenticated(func(_ *http.Request, principal *auth.Principal) {
+		presence.Touch(principal.UserID)
+	})
+
 	// Create router and register routes
 	router := http.NewServeMux()
-	
+
 	// Basic health check endpoint
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	// Authentication routes
-	router.HandleFunc("/api/auth/register", auth.RegisterHandler)
-	router.HandleFunc("/api/auth/login", auth.LoginHandler)
+	// Public keys for verifying tokens issued by this server
+	router.HandleFunc("/.well-known/jwks.json", auth.JWKSHandler)
+
+	// Authentication routes. Endpoints that check credentials or send email get
+	// the strict auth rate limit.
+	router.Handle("/api/auth/register", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.RegisterHandler))
+	router.Handle("/api/auth/login", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.LoginHandler))
 	router.HandleFunc("/api/auth/logout", auth.LogoutHandler)
+	router.Handle("/api/auth/refresh", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.RefreshHandler))
+	router.Handle("/api/auth/login/mfa", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.MFALoginHandler))
+	router.Handle("/api/auth/passkeys/login/begin", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.PasskeyLoginBeginHandler))
+	router.Handle("/api/auth/passkeys/login/finish", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.PasskeyLoginFinishHandler))
+	router.HandleFunc("/api/auth/oidc/providers", auth.OIDCProvidersHandler)
+	router.HandleFunc("/api/auth/oidc/{provider}/login", auth.OIDCLoginHandler)
+	router.HandleFunc("/api/auth/oidc/{provider}/callback", auth.OIDCCallbackHandler)
+	router.HandleFunc("/api/auth/verify-email", auth.VerifyEmailHandler)
+	router.Handle("/api/auth/resend-verification", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.ResendVerificationHandler))
+	router.Handle("/api/auth/forgot-password", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.ForgotPasswordHandler))
+	router.Handle("/api/auth/reset-password", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.ResetPasswordHandler))
+	router.Handle("/api/auth/unlock", ratelimit.LimitFunc(rateLimitConfig.Auth, ratelimit.ByIP, auth.UnlockAccountHandler))
 	router.Handle("/api/auth/validate", middleware.RequireAuth(http.HandlerFunc(auth.ValidateAuthHandler)))
-	
+	router.Handle("/api/auth/sessions", middleware.RequireAuth(http.HandlerFunc(auth.SessionsHandler)))
+	router.Handle("/api/auth/sessions/{id}", middleware.RequireAuth(http.HandlerFunc(auth.SessionHandler)))
+	// Users who still have to set up a required second factor can reach the CSRF
+	// token and TOTP enrollment routes, and nothing else that needs authentication
+	router.Handle("/api/auth/csrf", middleware.AllowMFASetup(http.HandlerFunc(auth.CSRFTokenHandler)))
+	router.Handle("/api/auth/mfa/totp/enroll", middleware.AllowMFASetup(http.HandlerFunc(auth.TOTPEnrollHandler)))
+	router.Handle("/api/auth/mfa/totp/confirm", middleware.AllowMFASetup(http.HandlerFunc(auth.TOTPConfirmHandler)))
+	router.Handle("/api/auth/mfa/totp/disable", middleware.RequireAuth(http.HandlerFunc(auth.TOTPDisableHandler)))
+	router.Handle("/api/auth/mfa/recovery-codes", middleware.RequireAuth(http.HandlerFunc(auth.RecoveryCodesHandler)))
+	router.Handle("/api/auth/passkeys", middleware.RequireAuth(http.HandlerFunc(auth.PasskeysHandler)))
+	router.Handle("/api/auth/passkeys/{id}", middleware.RequireAuth(http.HandlerFunc(auth.PasskeyHandler)))
+	router.Handle("/api/auth/passkeys/register/begin", middleware.RequireAuth(http.HandlerFunc(auth.PasskeyRegisterBeginHandler)))
+	router.Handle("/api/auth/passkeys/register/finish", middleware.RequireAuth(http.HandlerFunc(auth.PasskeyRegisterFinishHandler)))
+	router.Handle("/api/auth/tokens", middleware.RequireAuth(http.HandlerFunc(auth.PersonalAccessTokensHandler)))
+	router.Handle("/api/auth/tokens/{id}", middleware.RequireAuth(http.HandlerFunc(auth.PersonalAccessTokenHandler)))
+
+	// Administration routes
+	router.Handle("/api/admin/users/{userID}/role", middleware.AuthMiddleware(middleware.RequirePermission(rbac.PermManageUserRoles, http.HandlerFunc(rbac.ServerRoleHandler))))
+	router.Handle("/api/admin/users/{userID}/unlock", middleware.AuthMiddleware(middleware.RequirePermission(rbac.PermUnlockUsers, http.HandlerFunc(rbac.UnlockUserHandler))))
+
+	// Space routes. Personal access tokens need spaces:read, and the handlers also
+	// require spaces:write or spaces:admin for changes.
+	spaceRoute := func(handler http.HandlerFunc) http.Handler {
+		return middleware.RequireScope(auth.ScopeSpacesRead, middleware.RequireVerifiedEmail(handler))
+	}
+	router.Handle("/api/spaces", spaceRoute(spaces.SpacesHandler))
+	router.Handle("/api/spaces/public", spaceRoute(spaces.PublicSpacesHandler))
+	router.Handle("/api/spaces/{spaceID}", spaceRoute(spaces.SpaceHandler))
+	router.Handle("/api/spaces/{spaceID}/join", spaceRoute(spaces.JoinSpaceHandler))
+	router.Handle("/api/spaces/{spaceID}/leave", spaceRoute(spaces.LeaveSpaceHandler))
+	router.Handle("/api/spaces/{spaceID}/members", spaceRoute(spaces.SpaceMembersHandler))
+	router.Handle("/api/spaces/{spaceID}/members/{userID}", spaceRoute(spaces.SpaceMemberHandler))
+	router.Handle("/api/spaces/{spaceID}/invites", spaceRoute(spaces.SpaceInvitesHandler))
+	router.Handle("/api/spaces/{spaceID}/invites/{inviteID}", spaceRoute(spaces.SpaceInviteHandler))
+	router.Handle("/api/spaces/{spaceID}/invite-links", spaceRoute(spaces.SpaceInviteLinksHandler))
+	router.Handle("/api/spaces/{spaceID}/invite-links/{linkID}", spaceRoute(spaces.SpaceInviteLinkHandler))
+	router.Handle("/api/spaces/{spaceID}/join-requests", spaceRoute(spaces.SpaceJoinRequestsHandler))
+	router.Handle("/api/spaces/{spaceID}/join-requests/{requestID}/approve", spaceRoute(spaces.ApproveJoinRequestHandler))
+	router.Handle("/api/spaces/{spaceID}/join-requests/{requestID}/reject", spaceRoute(spaces.RejectJoinRequestHandler))
+	router.Handle("/api/invites", spaceRoute(spaces.MyInvitesHandler))
+	router.Handle("/api/invites/{inviteID}/accept", spaceRoute(spaces.AcceptInviteHandler))
+	router.Handle("/api/invites/{inviteID}/decline", spaceRoute(spaces.DeclineInviteHandler))
+	router.Handle("/api/invite-links/redeem", spaceRoute(spaces.RedeemInviteLinkHandler))
+	// Changing space roles always needs spaces:admin
+	router.Handle("/api/spaces/{spaceID}/members/{userID}/role", middleware.RequireScope(auth.ScopeSpacesAdmin,
+		middleware.RequireVerifiedEmail(middleware.RequirePermission(rbac.PermManageMemberRoles, http.HandlerFunc(rbac.SpaceMemberRoleHandler)))))
+
+	// Message routes. Personal access tokens need messages:read to read and
+	// messages:write to send, edit and delete. Sending is rate limited per user.
+	messageRoute := func(scope string, handler http.Handler) http.Handler {
+		return middleware.RequireScope(scope, middleware.RequireVerifiedEmail(handler))
+	}
+	router.Handle("/api/messages", messageRoute(auth.ScopeMessagesWrite, ratelimit.LimitFunc(rateLimitConfig.Messages, ratelimit.ByUser, messages.SendMessageHandler)))
+	router.Handle("/api/messages/{messageID}", messageRoute(auth.ScopeMessagesWrite, http.HandlerFunc(messages.MessageHandler)))
+	router.Handle("/api/spaces/{spaceID}/messages", messageRoute(auth.ScopeMessagesRead, http.HandlerFunc(messages.SpaceMessagesHandler)))
+	router.Handle("/api/direct-messages", messageRoute(auth.ScopeMessagesRead, http.HandlerFunc(messages.DirectConversationsHandler)))
+	router.Handle("/api/direct-messages/{userID}", messageRoute(auth.ScopeMessagesRead, http.HandlerFunc(messages.DirectMessagesHandler)))
+	router.Handle("/api/spaces/{spaceID}/read", messageRoute(auth.ScopeMessagesRead, http.HandlerFunc(messages.SpaceReadStateHandler)))
+	router.Handle("/api/direct-messages/{userID}/read", messageRoute(auth.ScopeMessagesRead, http.HandlerFunc(messages.DirectReadStateHandler)))
+
+	// Real-time events over WebSocket, with Server-Sent Events and long polling
+	// for clients behind proxies that block WebSockets
+	realtimeRoute := func(handler http.HandlerFunc) http.Handler {
+		return middleware.RequireScope(auth.ScopeMessagesRead, middleware.RequireVerifiedEmail(handler))
+	}
+	router.Handle("/api/ws", realtimeRoute(realtime.WebSocketHandler))
+	router.Handle("/api/events/stream", realtimeRoute(realtime.EventStreamHandler))
+	router.Handle("/api/events/poll", realtimeRoute(realtime.LongPollHandler))
+
+	// Presence
+	router.Handle("/api/presence", realtimeRoute(presence.PresenceHandler))
+	router.Handle("/api/presence/status", realtimeRoute(presence.StatusHandler))
+
 	// Protected routes example
-	router.Handle("/api/user/profile", middleware.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/api/user/profile", middleware.RequireScope(auth.ScopeProfileRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// This is a protected endpoint - only accessible with a valid JWT
 		userID, err := middleware.GetUserIDFromContext(r.Context())
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		
+
 		// Just a simple response to demonstrate the protected route
 		response := map[string]interface{}{
 			"message": "Protected endpoint accessed successfully",
 			"user_id": userID,
 		}
-		
+
 		w.Header().Set("Content-Type", "application/json")
 		auth.RespondWithJSON(w, http.StatusOK, response)
 	})))
@@ -72,7 +230,7 @@ func main() {
 	// Create server
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      router,
+		Handler:      ratelimit.Limit(rateLimitConfig.Default, ratelimit.ByIP, router),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -91,14 +249,21 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	logger.Println("Shutting down server...")
+	stopBackground()
 
 	// Create a deadline for server shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// Server.Shutdown doesn't wait for hijacked connections, so close the
+	// real-time connections first
+	if err := realtime.Shutdown(ctx); err != nil {
+		logger.Printf("Real-time connections did not close in time: %v", err)
+	}
+
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Fatalf("Server forced to shutdown: %v", err)
 	}
 
 	logger.Println("Server gracefully stopped")
-} 
\ No newline at end of file
+}
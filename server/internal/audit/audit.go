@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+)
+
+// Event types
+const (
+	EventAccountLocked   = "account.locked"
+	EventAccountUnlocked = "account.unlocked"
+	EventIPBlocked       = "ip.blocked"
+	EventRoleGranted     = "role.granted"
+	EventRoleRevoked     = "role.revoked"
+)
+
+// Event is a security-relevant action recorded in the audit log
+type Event struct {
+	Type string
+	// UserID is the account the event is about, if any
+	UserID *uuid.UUID
+	// ActorID is the user who performed the action, if it wasn't the system
+	ActorID   *uuid.UUID
+	IPAddress string
+	Details   map[string]interface{}
+}
+
+// Record writes an event to the audit log. Failures are logged rather than returned
+// so that auditing never blocks the action being audited.
+func Record(event Event) {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		details = []byte("{}")
+	}
+
+	log.Printf("Audit: %s user=%s actor=%s ip=%s details=%s",
+		event.Type, idString(event.UserID), idString(event.ActorID), event.IPAddress, details)
+
+	if db.DB == nil {
+		return
+	}
+
+	_, err = db.DB.Exec(`INSERT INTO audit_events (id, event_type, user_id, actor_id, ip_address, details, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		uuid.New(), event.Type, event.UserID, event.ActorID, nullString(event.IPAddress), string(details), db.CurrentTime())
+	if err != nil {
+		log.Printf("Failed to record audit event %s: %v", event.Type, err)
+	}
+}
+
+// idString formats an optional ID for the log
+func idString(id *uuid.UUID) string {
+	if id == nil {
+		return "-"
+	}
+	return id.String()
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
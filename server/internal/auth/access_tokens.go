@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token, which tells them apart
+// from JWTs in the Authorization header and makes leaked tokens easy to scan for
+const PersonalAccessTokenPrefix = "gtp_"
+
+// tokenPrefixLength is how much of a token is stored in clear for display
+const tokenPrefixLength = 12
+
+// ErrInsufficientScope is returned when a token lacks the scope a route requires
+var ErrInsufficientScope = errors.New("token does not have the required scope")
+
+// IsPersonalAccessToken reports whether a bearer token is a personal access token
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// AuthenticatePersonalAccessToken checks a personal access token and returns
+// the principal for the user it belongs to, limited to the token's scopes
+func AuthenticatePersonalAccessToken(token string) (*Principal, error) {
+	var id, userID uuid.UUID
+	var scopes string
+	var expiresAt, lastUsedAt *time.Time
+	err := db.DB.QueryRow(`SELECT id, user_id, scopes, expires_at, last_used_at
+		FROM personal_access_tokens WHERE token_hash = $1`, HashToken(token)).
+		Scan(&id, &userID, &scopes, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := db.CurrentTime()
+	if expiresAt != nil && now.After(*expiresAt) {
+		return nil, ErrExpiredToken
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastUsedAt == nil || now.Sub(*lastUsedAt) > sessionTouchInterval {
+		db.DB.Exec(`UPDATE personal_access_tokens SET last_used_at = $1 WHERE id = $2`, now, id)
+	}
+
+	return &Principal{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Roles:   []string{user.Role},
+		TokenID: id,
+		Method:  AuthMethodPersonalAccessToken,
+		Source:  CredentialSourceHeader,
+		Scopes:  strings.Split(scopes, ","),
+		User:    user,
+	}, nil
+}
+
+// listPersonalAccessTokens returns the user's tokens, newest first
+func listPersonalAccessTokens(userID uuid.UUID) ([]models.PersonalAccessToken, error) {
+	rows, err := db.DB.Query(`SELECT id, user_id, name, token_prefix, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		var t models.PersonalAccessToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.TokenPrefix, &scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// PersonalAccessTokensHandler lists the current user's personal access tokens (GET)
+// or creates a new one (POST). The token itself is only returned by the create call.
+func PersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := listPersonalAccessTokens(user.ID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to list tokens")
+			return
+		}
+
+		response := make([]models.PersonalAccessTokenResponse, 0, len(tokens))
+		for _, t := range tokens {
+			response = append(response, t.ToResponse())
+		}
+
+		RespondWithJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    response,
+		})
+
+	case http.MethodPost:
+		var req models.CreatePersonalAccessTokenRequest
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(db.CurrentTime()) {
+			RespondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+			return
+		}
+
+		secret, err := GenerateSecureToken(32)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		token := PersonalAccessTokenPrefix + secret
+
+		pat := models.PersonalAccessToken{
+			ID:          uuid.New(),
+			UserID:      user.ID,
+			Name:        req.Name,
+			TokenHash:   HashToken(token),
+			TokenPrefix: token[:tokenPrefixLength],
+			Scopes:      req.Scopes,
+			ExpiresAt:   req.ExpiresAt,
+			CreatedAt:   db.CurrentTime(),
+		}
+
+		_, err = db.DB.Exec(`INSERT INTO personal_access_tokens
+			(id, user_id, name, token_hash, token_prefix, scopes, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			pat.ID, pat.UserID, pat.Name, pat.TokenHash, pat.TokenPrefix, strings.Join(pat.Scopes, ","), pat.ExpiresAt, pat.CreatedAt)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create token")
+			return
+		}
+
+		response := pat.ToResponse()
+		response.Token = token
+
+		RespondWithJSON(w, http.StatusCreated, Response{
+			Success: true,
+			Message: "Copy this token now, it won't be shown again",
+			Data:    response,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PersonalAccessTokenHandler revokes one of the current user's personal access tokens.
+// The token ID comes from the {id} path wildcard.
+func PersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	tokenID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	result, err := db.DB.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`, tokenID, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		RespondWithError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Token revoked",
+	})
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gotext/server/internal/config"
+)
+
+// VerificationPolicy controls what unverified users are allowed to do
+type VerificationPolicy string
+
+const (
+	// VerificationPolicyNone lets unverified users do everything
+	VerificationPolicyNone VerificationPolicy = "none"
+	// VerificationPolicyRestrict lets unverified users log in but blocks routes that require a verified email
+	VerificationPolicyRestrict VerificationPolicy = "restrict"
+	// VerificationPolicyBlock prevents unverified users from logging in at all
+	VerificationPolicyBlock VerificationPolicy = "block"
+)
+
+// Config holds authentication configuration
+type Config struct {
+	// Environment is "development" or "production". Development mode allows
+	// insecure fallbacks such as a built-in JWT secret.
+	Environment string
+
+	// AppBaseURL is the public URL of the web client, used to build links in emails
+	AppBaseURL string
+	// APIBaseURL is the public URL of this server, used to build OAuth redirect URLs
+	APIBaseURL string
+	// TrustProxyHeaders makes ClientIP honor X-Forwarded-For (enable only behind a trusted proxy)
+	TrustProxyHeaders bool
+	// CSRFTrustedOrigins are origins besides AppBaseURL and APIBaseURL allowed to make
+	// cookie-authenticated requests
+	CSRFTrustedOrigins []string
+	// CSRFExemptPaths skip CSRF checks; entries ending in "/" match every path below them
+	CSRFExemptPaths []string
+
+	// MaxRequestBodySize is the largest JSON request body DecodeJSON accepts, in bytes
+	MaxRequestBodySize int64
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// JWT signing. HS256 uses JWTSecret; RS256 and EdDSA use the PEM private keys
+	// in JWTKeyDir, where each file name is the key's kid.
+	JWTAlgorithm string
+	JWTSecret    string
+	JWTKeyDir    string
+	// JWTKeyRotationInterval generates a new key in JWTKeyDir this often (0 disables rotation)
+	JWTKeyRotationInterval time.Duration
+	// JWTKeyActivationDelay is how long a new key is published before it signs tokens
+	JWTKeyActivationDelay time.Duration
+	// JWTKeyReloadInterval is how often JWTKeyDir is re-read for keys added elsewhere
+	JWTKeyReloadInterval time.Duration
+
+	// Brute-force protection. Failed logins are counted per account and per IP address
+	// within LoginFailureWindow; past the backoff threshold each attempt must wait
+	// LoginBackoffBase, doubling per failure up to LoginBackoffMax, and reaching the
+	// lockout threshold blocks all attempts for the lockout duration.
+	LoginAttemptStore       string
+	LoginFailureWindow      time.Duration
+	LoginBackoffBase        time.Duration
+	LoginBackoffMax         time.Duration
+	AccountBackoffAfter     int
+	AccountLockoutThreshold int
+	AccountLockoutDuration  time.Duration
+	IPBackoffAfter          int
+	IPLockoutThreshold      int
+	IPLockoutDuration       time.Duration
+
+	EmailVerificationPolicy         VerificationPolicy
+	EmailVerificationTTL            time.Duration
+	EmailVerificationResendInterval time.Duration
+
+	PasswordResetTTL time.Duration
+
+	// MFARequired forces every user to set up two-factor authentication
+	MFARequired     bool
+	MFAIssuer       string
+	MFAChallengeTTL time.Duration
+
+	// WebAuthn relying party settings. The RP ID is the domain passkeys are bound to
+	// and the origins are the web client URLs allowed to use them.
+	WebAuthnRPID      string
+	WebAuthnRPName    string
+	WebAuthnRPOrigins []string
+	WebAuthnTimeout   time.Duration
+
+	// OIDCProviders are the single sign-on providers users can log in with
+	OIDCProviders []OIDCProviderConfig
+	OIDCLoginTTL  time.Duration
+}
+
+// OIDCProviderConfig configures one OpenID Connect identity provider
+type OIDCProviderConfig struct {
+	Name         string // Used in URLs, e.g. /api/auth/oidc/{name}/login
+	DisplayName  string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// AllowSignup creates a local account on first login (just-in-time provisioning)
+	AllowSignup bool
+	// LinkByEmail links the identity to an existing account with the same email,
+	// if the provider reports the email as verified
+	LinkByEmail bool
+}
+
+// cfg is the active authentication configuration. Until Init is called it
+// holds the defaults.
+var cfg, _ = DefaultConfig()
+
+// DefaultConfig returns the authentication configuration from the environment.
+// It returns an error naming any variable that is set but malformed.
+func DefaultConfig() (Config, error) {
+	env := &config.Env{}
+	c := Config{
+		Environment:                     config.GetEnv("APP_ENV", "production"),
+		AppBaseURL:                      config.GetEnv("APP_BASE_URL", "http://localhost:3000"),
+		APIBaseURL:                      config.GetEnv("API_BASE_URL", "http://localhost:8080"),
+		TrustProxyHeaders:               env.Bool("TRUST_PROXY_HEADERS", false),
+		CSRFTrustedOrigins:              splitList(config.GetEnv("CSRF_TRUSTED_ORIGINS", "")),
+		CSRFExemptPaths:                 splitList(config.GetEnv("CSRF_EXEMPT_PATHS", "")),
+		MaxRequestBodySize:              int64(env.Int("MAX_REQUEST_BODY_SIZE", 1<<20)),
+		AccessTokenTTL:                  env.Duration("ACCESS_TOKEN_TTL", DefaultAccessTokenTTL),
+		RefreshTokenTTL:                 env.Duration("REFRESH_TOKEN_TTL", DefaultRefreshTokenTTL),
+		JWTAlgorithm:                    config.GetEnv("JWT_ALGORITHM", AlgorithmHS256),
+		JWTSecret:                       config.GetEnv("JWT_SECRET_KEY", ""),
+		JWTKeyDir:                       config.GetEnv("JWT_KEY_DIR", ""),
+		JWTKeyRotationInterval:          env.Duration("JWT_KEY_ROTATION_INTERVAL", 0),
+		JWTKeyActivationDelay:           env.Duration("JWT_KEY_ACTIVATION_DELAY", 2*time.Minute),
+		JWTKeyReloadInterval:            env.Duration("JWT_KEY_RELOAD_INTERVAL", time.Minute),
+		LoginAttemptStore:               config.GetEnv("LOGIN_ATTEMPT_STORE", AttemptStorePostgres),
+		LoginFailureWindow:              env.Duration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginBackoffBase:                env.Duration("LOGIN_BACKOFF_BASE", time.Second),
+		LoginBackoffMax:                 env.Duration("LOGIN_BACKOFF_MAX", time.Minute),
+		AccountBackoffAfter:             env.Int("LOGIN_ACCOUNT_BACKOFF_AFTER", 3),
+		AccountLockoutThreshold:         env.Int("LOGIN_ACCOUNT_LOCKOUT_THRESHOLD", 10),
+		AccountLockoutDuration:          env.Duration("LOGIN_ACCOUNT_LOCKOUT_DURATION", 30*time.Minute),
+		IPBackoffAfter:                  env.Int("LOGIN_IP_BACKOFF_AFTER", 20),
+		IPLockoutThreshold:              env.Int("LOGIN_IP_LOCKOUT_THRESHOLD", 100),
+		IPLockoutDuration:               env.Duration("LOGIN_IP_LOCKOUT_DURATION", 15*time.Minute),
+		EmailVerificationPolicy:         VerificationPolicy(config.GetEnv("EMAIL_VERIFICATION_POLICY", string(VerificationPolicyRestrict))),
+		EmailVerificationTTL:            env.Duration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		EmailVerificationResendInterval: env.Duration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+		PasswordResetTTL:                env.Duration("PASSWORD_RESET_TTL", time.Hour),
+		MFARequired:                     env.Bool("MFA_REQUIRED", false),
+		MFAIssuer:                       config.GetEnv("MFA_ISSUER", "GoText"),
+		MFAChallengeTTL:                 env.Duration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		WebAuthnRPID:                    config.GetEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:                  config.GetEnv("WEBAUTHN_RP_NAME", "GoText"),
+		WebAuthnRPOrigins:               strings.Split(config.GetEnv("WEBAUTHN_RP_ORIGINS", config.GetEnv("APP_BASE_URL", "http://localhost:3000")), ","),
+		WebAuthnTimeout:                 env.Duration("WEBAUTHN_TIMEOUT", 5*time.Minute),
+		OIDCProviders:                   oidcProvidersFromEnv(env, config.GetEnv("API_BASE_URL", "http://localhost:8080")),
+		OIDCLoginTTL:                    env.Duration("OIDC_LOGIN_TTL", 10*time.Minute),
+	}
+	return c, env.Err()
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// oidcProvidersFromEnv reads the providers named in OIDC_PROVIDERS (comma-separated).
+// Each provider NAME is configured with OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID,
+// OIDC_NAME_CLIENT_SECRET and optionally OIDC_NAME_DISPLAY_NAME, OIDC_NAME_SCOPES,
+// OIDC_NAME_REDIRECT_URL, OIDC_NAME_ALLOW_SIGNUP and OIDC_NAME_LINK_BY_EMAIL.
+func oidcProvidersFromEnv(env *config.Env, apiBaseURL string) []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range strings.Split(config.GetEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			DisplayName:  config.GetEnv(prefix+"DISPLAY_NAME", name),
+			IssuerURL:    config.GetEnv(prefix+"ISSUER", ""),
+			ClientID:     config.GetEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: config.GetEnv(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  config.GetEnv(prefix+"REDIRECT_URL", apiBaseURL+"/api/auth/oidc/"+name+"/callback"),
+			Scopes:       strings.Fields(config.GetEnv(prefix+"SCOPES", "openid email profile")),
+			AllowSignup:  env.Bool(prefix+"ALLOW_SIGNUP", true),
+			LinkByEmail:  env.Bool(prefix+"LINK_BY_EMAIL", true),
+		})
+	}
+	return providers
+}
+
+// Init validates and applies the authentication configuration
+func Init(config Config) error {
+	switch config.EmailVerificationPolicy {
+	case VerificationPolicyNone, VerificationPolicyRestrict, VerificationPolicyBlock:
+	default:
+		return fmt.Errorf("invalid email verification policy %q", config.EmailVerificationPolicy)
+	}
+
+	if config.AccessTokenTTL <= 0 || config.RefreshTokenTTL < config.AccessTokenTTL {
+		return fmt.Errorf("refresh token TTL (%s) must be at least the access token TTL (%s)", config.RefreshTokenTTL, config.AccessTokenTTL)
+	}
+
+	if config.MaxRequestBodySize <= 0 {
+		return fmt.Errorf("max request body size must be positive")
+	}
+
+	if config.JWTKeyReloadInterval <= 0 {
+		return fmt.Errorf("JWT key reload interval must be positive")
+	}
+	if err := initKeyring(config); err != nil {
+		return fmt.Errorf("invalid JWT key configuration: %w", err)
+	}
+
+	if config.LoginFailureWindow <= 0 || config.LoginBackoffBase <= 0 || config.LoginBackoffMax < config.LoginBackoffBase {
+		return fmt.Errorf("invalid login backoff settings")
+	}
+	store, err := newAttemptStore(config)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range config.OIDCProviders {
+		if p.IssuerURL == "" || p.ClientID == "" {
+			return fmt.Errorf("OIDC provider %q needs an issuer URL and client ID", p.Name)
+		}
+	}
+	initOIDC(config)
+
+	if err := initWebAuthn(config); err != nil {
+		return fmt.Errorf("invalid WebAuthn configuration: %w", err)
+	}
+
+	attempts = store
+	cfg = config
+	return nil
+}
+
+// IsDevelopment reports whether the server is running in development mode
+func (c Config) IsDevelopment() bool {
+	return c.Environment == "development"
+}
+
+// CurrentConfig returns the active authentication configuration
+func CurrentConfig() Config {
+	return cfg
+}
@@ -1,35 +1,46 @@
 package auth
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gotext/server/internal/db"
 	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/validation"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Cookie constants
 const (
-	AuthCookieName = "auth_token"
-	CookieMaxAge   = 86400 * 7 // 7 days in seconds
+	AuthCookieName    = "auth_token"
+	RefreshCookieName = "refresh_token"
+	// RefreshCookiePath limits the refresh cookie to the auth endpoints that need it
+	RefreshCookiePath = "/api/auth"
 )
 
 // Response represents a standard API response
 type Response struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success bool              `json:"success"`
+	Message string            `json:"message,omitempty"`
+	Data    interface{}       `json:"data,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Errors  validation.Errors `json:"errors,omitempty"` // Per-field validation errors
 }
 
 // LoginResponse is returned after successful login
 type LoginResponse struct {
-	Token string             `json:"token"`
-	User  models.UserResponse `json:"user"`
+	Token        string              `json:"token"`
+	RefreshToken string              `json:"refresh_token"`
+	CSRFToken    string              `json:"csrf_token"` // Send as X-CSRF-Token with cookie-authenticated requests
+	ExpiresIn    int                 `json:"expires_in"` // Access token lifetime in seconds
+	User         models.UserResponse `json:"user"`
+	// The session can only set up two-factor authentication until it's enabled
+	MFASetupRequired bool `json:"mfa_setup_required,omitempty"`
 }
 
 // RegisterHandler handles user registration
@@ -42,41 +53,55 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the request body
 	var req models.CreateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if !DecodeJSON(w, r, &req) {
 		return
 	}
 
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to process password")
+		RespondWithError(w, http.StatusInternalServerError, "Failed to process password")
 		return
 	}
 
+	// Generate the email verification token
+	verificationToken, err := GenerateSecureToken(32)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate verification token")
+		return
+	}
+	now := db.CurrentTime()
+	verificationExpiresAt := now.Add(cfg.EmailVerificationTTL)
+
 	// Create the user
 	user := models.User{
-		ID:                  uuid.New(),
-		Username:            req.Username,
-		Email:               req.Email,
-		PasswordHash:        string(hashedPassword),
-		IsEmailVerified:     false, // User needs to verify email
-		EmailVerificationToken: uuid.New().String(),
-		CreatedAt:           db.CurrentTime(),
-		UpdatedAt:           db.CurrentTime(),
+		ID:                         uuid.New(),
+		Username:                   req.Username,
+		Email:                      req.Email,
+		PasswordHash:               string(hashedPassword),
+		IsEmailVerified:            false, // User needs to verify email
+		EmailVerificationToken:     HashToken(verificationToken),
+		EmailVerificationExpiresAt: &verificationExpiresAt,
+		EmailVerificationSentAt:    &now,
+		CreatedAt:                  now,
+		UpdatedAt:                  now,
 	}
 
 	// Store the user in the database
 	if err := createUser(user); err != nil {
 		if err.Error() == "user already exists" {
-			respondWithError(w, http.StatusConflict, "User with this email or username already exists")
+			RespondWithError(w, http.StatusConflict, "User with this email or username already exists")
 			return
 		}
-		respondWithError(w, http.StatusInternalServerError, "Failed to create user")
+		RespondWithError(w, http.StatusInternalServerError, "Failed to create user")
 		return
 	}
 
-	// TODO: Send verification email
+	// Send verification email. Registration still succeeds if this fails,
+	// the user can ask for a new email through the resend endpoint.
+	if err := sendVerificationEmail(user, verificationToken); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", user.Email, err)
+	}
 
 	// Return user data (excluding sensitive info)
 	RespondWithJSON(w, http.StatusCreated, Response{
@@ -96,49 +121,68 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the request body
 	var req models.LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	// Slow down and lock out repeated failures before doing any work
+	attempt, wait := beginLoginAttempt(r, req.Email)
+	if wait > 0 {
+		respondWithLoginThrottled(w, wait)
 		return
 	}
 
 	// Fetch the user by email
 	user, err := getUserByEmail(req.Email)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		attempt.fail()
+		RespondWithError(w, http.StatusUnauthorized, "Invalid email or password")
 		return
 	}
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		attempt.fail()
+		RespondWithError(w, http.StatusUnauthorized, "Invalid email or password")
 		return
 	}
 
-	// Generate JWT token
-	token, err := GenerateToken(user)
+	// Enforce the email verification policy
+	if !user.IsEmailVerified && cfg.EmailVerificationPolicy == VerificationPolicyBlock {
+		attempt.abandon()
+		RespondWithError(w, http.StatusForbidden, "Please verify your email address before logging in")
+		return
+	}
+
+	// Users with two-factor authentication get a challenge instead of a session.
+	// Their failed attempts are only cleared once the second factor is verified.
+	if user.TOTPEnabled {
+		attempt.abandon()
+		respondWithMFAChallenge(w, user)
+		return
+	}
+
+	attempt.succeed()
+	issueSession(w, r, user)
+}
+
+// issueSession starts a session for an authenticated user, sets the auth cookies
+// and writes the login response
+func issueSession(w http.ResponseWriter, r *http.Request, user models.User) {
+	// Start a session and generate its tokens
+	tokens, err := createSession(r, user)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
 
-	// Set auth cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     AuthCookieName,
-		Value:    token,
-		Path:     "/",
-		MaxAge:   CookieMaxAge,
-		HttpOnly: true,
-		Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
-		SameSite: http.SameSiteStrictMode,
-	})
+	// Set auth cookies
+	setAuthCookies(w, r, tokens)
 
-	// Return token and user data
+	// Return tokens and user data
 	RespondWithJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data: LoginResponse{
-			Token: token,
-			User:  user.ToResponse(),
-		},
+		Data:    tokens.loginResponse(user),
 	})
 }
 
@@ -150,16 +194,32 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clear the auth cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     AuthCookieName,
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		Secure:   r.TLS != nil,
-		SameSite: http.SameSiteStrictMode,
-	})
+	// Cookie-based logouts must come from our own site
+	if usesAuthCookies(r) && CheckOrigin(r) != nil {
+		RespondWithError(w, http.StatusForbidden, "Request origin not allowed")
+		return
+	}
+
+	// Revoke the session behind the access token, if any, so it can't be reused.
+	// Fall back to the refresh token when the access token is missing, expired
+	// or otherwise invalid.
+	revoked := false
+	if token, err := extractToken(r); err == nil {
+		if claims, err := ValidateToken(token); err == nil {
+			if sessionID, err := uuid.Parse(claims.ID); err == nil {
+				revokeSession(claims.UserID, sessionID)
+				revoked = true
+			}
+		}
+	}
+	if !revoked {
+		if cookie, err := r.Cookie(RefreshCookieName); err == nil {
+			revokeSessionByRefreshToken(cookie.Value)
+		}
+	}
+
+	// Clear the auth cookies
+	clearAuthCookies(w, r)
 
 	RespondWithJSON(w, http.StatusOK, Response{
 		Success: true,
@@ -175,10 +235,10 @@ func ValidateAuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the user from the JWT token (which was verified by the middleware)
-	user, ok := r.Context().Value("user").(models.User)
+	// Get the user authenticated by the middleware
+	user, ok := UserFromContext(r.Context())
 	if !ok {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -189,44 +249,81 @@ func ValidateAuthHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getUserByEmail fetches a user from the database by email
-func getUserByEmail(email string) (models.User, error) {
+// userColumns is the column list read by scanUser
+const userColumns = `id, username, email, role, password_hash, is_email_verified, email_verification_token,
+	email_verification_expires_at, email_verification_sent_at, password_changed_at,
+	totp_secret, totp_enabled, totp_last_used_step, created_at, updated_at`
+
+// scanUser scans a row selected with userColumns into a User
+func scanUser(row *sql.Row) (models.User, error) {
 	var user models.User
+	var verificationToken, totpSecret sql.NullString
 
-	query := `SELECT id, username, email, password_hash, is_email_verified, email_verification_token, created_at, updated_at 
-			  FROM users WHERE email = $1`
-	
-	row := db.DB.QueryRow(query, email)
 	err := row.Scan(
-		&user.ID, 
-		&user.Username, 
-		&user.Email, 
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Role,
 		&user.PasswordHash,
 		&user.IsEmailVerified,
-		&user.EmailVerificationToken,
+		&verificationToken,
+		&user.EmailVerificationExpiresAt,
+		&user.EmailVerificationSentAt,
+		&user.PasswordChangedAt,
+		&totpSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastUsedStep,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
-
 	if err != nil {
 		return models.User{}, errors.New("user not found")
 	}
 
+	user.EmailVerificationToken = verificationToken.String
+	user.TOTPSecret = totpSecret.String
 	return user, nil
 }
 
+// getUserByEmail fetches a user from the database by email
+func getUserByEmail(email string) (models.User, error) {
+	return scanUser(db.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE email = $1", email))
+}
+
+// getUserByID fetches a user from the database by ID
+func getUserByID(id uuid.UUID) (models.User, error) {
+	return scanUser(db.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
 // GetUserByEmail is an exported version of getUserByEmail for use in middleware
 func GetUserByEmail(email string) (models.User, error) {
 	return getUserByEmail(email)
 }
 
+// UserFromClaims loads the user a validated token belongs to.
+// Tokens issued before the user's last password change are rejected.
+func UserFromClaims(claims *Claims) (models.User, error) {
+	user, err := getUserByEmail(claims.Email)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	// JWT timestamps have second precision
+	if user.PasswordChangedAt != nil && claims.IssuedAt != nil &&
+		claims.IssuedAt.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+		return models.User{}, ErrInvalidToken
+	}
+
+	return user, nil
+}
+
 // createUser stores a new user in the database
 func createUser(user models.User) error {
 	// Check if user already exists
 	var exists bool
-	err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 OR username = $2)", 
+	err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1 OR username = $2)",
 		user.Email, user.Username).Scan(&exists)
-	
+
 	if err != nil {
 		return err
 	}
@@ -236,17 +333,20 @@ func createUser(user models.User) error {
 	}
 
 	// Insert new user
-	query := `INSERT INTO users 
-			  (id, username, email, password_hash, is_email_verified, email_verification_token, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	
-	_, err = db.DB.Exec(query, 
-		user.ID, 
-		user.Username, 
-		user.Email, 
+	query := `INSERT INTO users
+			  (id, username, email, password_hash, is_email_verified, email_verification_token,
+			   email_verification_expires_at, email_verification_sent_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err = db.DB.Exec(query,
+		user.ID,
+		user.Username,
+		user.Email,
 		user.PasswordHash,
 		user.IsEmailVerified,
 		user.EmailVerificationToken,
+		user.EmailVerificationExpiresAt,
+		user.EmailVerificationSentAt,
 		user.CreatedAt,
 		user.UpdatedAt,
 	)
@@ -254,27 +354,60 @@ func createUser(user models.User) error {
 	return err
 }
 
-// ExtractUserFromCookie gets the user from the auth cookie
-func ExtractUserFromCookie(r *http.Request) (models.User, error) {
-	// Get the auth cookie
-	cookie, err := r.Cookie(AuthCookieName)
-	if err != nil {
-		return models.User{}, errors.New("no auth cookie found")
-	}
-
-	// Validate the token from cookie
-	claims, err := ValidateToken(cookie.Value)
-	if err != nil {
-		return models.User{}, err
-	}
-
-	// Get the user from database
-	user, err := getUserByEmail(claims.Email)
-	if err != nil {
-		return models.User{}, errors.New("user not found")
+// setAuthCookies stores the access and refresh tokens in their cookies.
+// Each cookie lives exactly as long as the token inside it.
+func setAuthCookies(w http.ResponseWriter, r *http.Request, tokens tokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthCookieName,
+		Value:    tokens.AccessToken,
+		Path:     "/",
+		MaxAge:   int(cfg.AccessTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    tokens.RefreshToken,
+		Path:     RefreshCookiePath,
+		MaxAge:   int(cfg.RefreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if tokens.CSRFToken != "" {
+		setCSRFCookie(w, r, tokens.CSRFToken)
 	}
+}
 
-	return user, nil
+// clearAuthCookies removes the access and refresh token cookies
+func clearAuthCookies(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    "",
+		Path:     RefreshCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
 }
 
 // IsTokenExpired checks if a token is expired
@@ -296,10 +429,19 @@ func RespondWithJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// respondWithError writes an error response
-func respondWithError(w http.ResponseWriter, status int, message string) {
+// RespondWithError writes an error response
+func RespondWithError(w http.ResponseWriter, status int, message string) {
 	RespondWithJSON(w, status, Response{
 		Success: false,
 		Error:   message,
 	})
-} 
\ No newline at end of file
+}
+
+// RespondWithValidationErrors sends the per-field errors of an invalid request
+func RespondWithValidationErrors(w http.ResponseWriter, errs validation.Errors) {
+	RespondWithJSON(w, http.StatusBadRequest, Response{
+		Success: false,
+		Error:   "Validation failed",
+		Errors:  errs,
+	})
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/testutil"
+)
+
+func TestLogoutRevokesSessionWithInvalidAccessToken(t *testing.T) {
+	testutil.SetupDB(t)
+	setupTestConfig(t, nil)
+
+	tests := []struct {
+		name   string
+		attach func(r *http.Request)
+	}{
+		{"no access token", func(r *http.Request) {}},
+		{"invalid bearer token", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer not-a-valid-token")
+		}},
+		{"invalid access cookie", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: "not-a-valid-token"})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := testutil.CreateUser(t)
+			tokens, err := createSession(httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), user)
+			if err != nil {
+				t.Fatalf("failed to create session: %v", err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
+			r.AddCookie(&http.Cookie{Name: RefreshCookieName, Value: tokens.RefreshToken})
+			tt.attach(r)
+			w := httptest.NewRecorder()
+			LogoutHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var sessions int
+			if err := db.DB.QueryRow(`SELECT COUNT(*) FROM session_tokens WHERE user_id = $1`, user.ID).Scan(&sessions); err != nil {
+				t.Fatalf("failed to count sessions: %v", err)
+			}
+			if sessions != 0 {
+				t.Errorf("expected the session to be revoked, %d left", sessions)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+)
+
+const (
+	// CSRFCookieName is the readable cookie holding the session's CSRF token
+	CSRFCookieName = "csrf_token"
+	// CSRFHeaderName is the header clients send the CSRF token in
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+var (
+	// ErrCSRFTokenInvalid is returned when a cookie-authenticated request has a missing or wrong CSRF token
+	ErrCSRFTokenInvalid = errors.New("missing or invalid CSRF token")
+	// ErrCSRFOriginInvalid is returned when a cookie-authenticated request comes from another site
+	ErrCSRFOriginInvalid = errors.New("request origin not allowed")
+)
+
+// VerifyCSRF protects cookie-authenticated requests against cross-site request forgery.
+// Requests that change state must come from an allowed origin and carry the session's
+// CSRF token in the X-CSRF-Token header. Requests authenticated with the Authorization
+// header, safe methods and exempt paths are not checked, since browsers never attach
+// those credentials on their own.
+func VerifyCSRF(r *http.Request, principal *Principal) error {
+	if principal.Source != CredentialSourceCookie || isSafeMethod(r.Method) || isCSRFExempt(r.URL.Path) {
+		return nil
+	}
+
+	if err := CheckOrigin(r); err != nil {
+		return err
+	}
+
+	sent := r.Header.Get(CSRFHeaderName)
+	if sent == "" {
+		return ErrCSRFTokenInvalid
+	}
+
+	var expected sql.NullString
+	err := db.DB.QueryRow(`SELECT csrf_token FROM session_tokens WHERE id = $1`, principal.TokenID).Scan(&expected)
+	if err != nil || !expected.Valid {
+		return ErrCSRFTokenInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(expected.String)) != 1 {
+		return ErrCSRFTokenInvalid
+	}
+	return nil
+}
+
+// CheckOrigin rejects requests whose Origin (or, without one, Referer) header names
+// a site other than this server, the web client or a trusted origin. Requests with
+// neither header are allowed, since some clients and privacy tools strip them.
+func CheckOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return ErrCSRFOriginInvalid
+	}
+	origin := u.Scheme + "://" + u.Host
+
+	// Same origin as the request itself
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+
+	for _, allowed := range trustedOrigins() {
+		if strings.EqualFold(origin, allowed) {
+			return nil
+		}
+	}
+	return ErrCSRFOriginInvalid
+}
+
+// trustedOrigins returns the origins allowed to make cookie-authenticated requests
+func trustedOrigins() []string {
+	origins := make([]string, 0, len(cfg.CSRFTrustedOrigins)+2)
+	for _, base := range append([]string{cfg.AppBaseURL, cfg.APIBaseURL}, cfg.CSRFTrustedOrigins...) {
+		if u, err := url.Parse(strings.TrimSpace(base)); err == nil && u.Host != "" {
+			origins = append(origins, u.Scheme+"://"+u.Host)
+		}
+	}
+	return origins
+}
+
+// isSafeMethod reports whether an HTTP method must not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isCSRFExempt reports whether a path is excluded from CSRF checks by configuration.
+// Entries ending in "/" match every path below them.
+func isCSRFExempt(path string) bool {
+	for _, exempt := range cfg.CSRFExemptPaths {
+		if exempt == path || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// usesAuthCookies reports whether the request carries the access or refresh token cookie
+func usesAuthCookies(r *http.Request) bool {
+	for _, name := range []string{AuthCookieName, RefreshCookieName} {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionCSRFToken returns the session's CSRF token, creating one for sessions
+// that don't have one yet
+func sessionCSRFToken(sessionID uuid.UUID) (string, error) {
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	var csrfToken string
+	err = db.DB.QueryRow(`UPDATE session_tokens SET csrf_token = COALESCE(csrf_token, $1)
+		WHERE id = $2 RETURNING csrf_token`, token, sessionID).Scan(&csrfToken)
+	if err != nil {
+		return "", err
+	}
+	return csrfToken, nil
+}
+
+// CSRFTokenHandler returns the CSRF token of the current session and refreshes its
+// cookie, for web clients that need to send it with state-changing requests
+func CSRFTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok || !principal.IsSession() {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	token, err := sessionCSRFToken(principal.TokenID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to get CSRF token")
+		return
+	}
+
+	setCSRFCookie(w, r, token)
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"csrf_token": token},
+	})
+}
+
+// setCSRFCookie stores the CSRF token in a cookie the web client can read.
+// It lives as long as the session can.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(cfg.RefreshTokenTTL.Seconds()),
+		HttpOnly: false, // The client reads it to send it back in the header
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
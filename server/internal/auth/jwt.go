@@ -2,9 +2,7 @@ package auth
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -14,8 +12,10 @@ import (
 )
 
 const (
-	// DefaultTokenExpiration is the default time until a token expires (24 hours)
-	DefaultTokenExpiration = 24 * time.Hour
+	// DefaultAccessTokenTTL is the default time until an access token expires (15 minutes)
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// DefaultRefreshTokenTTL is the default time a session can go unused before it expires (7 days)
+	DefaultRefreshTokenTTL = 7 * 24 * time.Hour
 )
 
 var (
@@ -27,54 +27,118 @@ var (
 	ErrInvalidSigningMethod = errors.New("invalid signing method")
 )
 
+// Token purposes. Access tokens have no purpose; any other purpose makes
+// the token unusable for authenticating API requests.
+const (
+	// PurposeMFAChallenge marks a token that only proves the password step of a login
+	PurposeMFAChallenge = "mfa_challenge"
+)
+
 // Claims represents the JWT claims
 type Claims struct {
-	UserID uuid.UUID `json:"user_id"`
-	Email  string    `json:"email"`
+	UserID  uuid.UUID `json:"user_id"`
+	Email   string    `json:"email"`
+	Purpose string    `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a new JWT token for a user
-func GenerateToken(user models.User) (string, error) {
-	// Get secret key from environment
-	secretKey := getSecretKey()
-
+// GenerateToken creates a new JWT token for a user.
+// The session ID becomes the token's jti so the token can be revoked server-side.
+func GenerateToken(user models.User, sessionID uuid.UUID) (string, error) {
 	// Create the claims
-	expirationTime := time.Now().Add(DefaultTokenExpiration)
+	expirationTime := time.Now().Add(cfg.AccessTokenTTL)
 	claims := &Claims{
 		UserID: user.ID,
 		Email:  user.Email,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID.String(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   user.ID.String(),
 		},
 	}
 
-	// Create the token with the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signToken(claims)
+}
 
-	// Sign the token with the secret key
-	tokenString, err := token.SignedString([]byte(secretKey))
+// ValidateToken validates a JWT access token
+func ValidateToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// Special-purpose tokens can't be used as access tokens
+	if claims.Purpose != "" {
+		return nil, ErrInvalidToken
 	}
 
-	return tokenString, nil
+	return claims, nil
 }
 
-// ValidateToken validates a JWT token
-func ValidateToken(tokenString string) (*Claims, error) {
-	// Get secret key from environment
-	secretKey := getSecretKey()
+// generatePurposeToken creates a short-lived token that can only be used for the given purpose
+func generatePurposeToken(user models.User, purpose string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Subject:   user.ID.String(),
+		},
+	}
+
+	return signToken(claims)
+}
 
+// signToken signs claims with the current signing key, recording its kid in the header
+func signToken(claims *Claims) (string, error) {
+	key := keys.current()
+	if key == nil {
+		return "", errors.New("no JWT signing key configured")
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey())
+}
+
+// validatePurposeToken validates a token created by generatePurposeToken for the given purpose
+func validatePurposeToken(tokenString, purpose string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Purpose != purpose {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// parseToken verifies a token's signature and expiry and returns its claims
+func parseToken(tokenString string) (*Claims, error) {
 	// Parse the token
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		// Find the key that signed the token. Tokens from before key IDs were
+		// added have no kid and can only have been signed with the HS256 secret.
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = hmacKeyID
+		}
+		key, ok := keys.lookup(kid)
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+
+		// Validate the signing method against the key, never the token header alone
+		if token.Method.Alg() != key.Algorithm {
 			return nil, ErrInvalidSigningMethod
 		}
-		return []byte(secretKey), nil
+		return key.verifyKey(), nil
 	})
 
 	if err != nil {
@@ -88,7 +152,7 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
 		return claims, nil
 	}
-	
+
 	return nil, ErrInvalidToken
 }
 
@@ -108,15 +172,3 @@ func ExtractTokenFromRequest(r *http.Request) (string, error) {
 
 	return parts[1], nil
 }
-
-// getSecretKey gets the JWT secret key from environment or returns a default (for development only)
-func getSecretKey() string {
-	secretKey := os.Getenv("JWT_SECRET_KEY")
-	if secretKey == "" {
-		// Warning: In production, always use an environment variable for the secret key
-		// This default is for development only
-		secretKey = "gotext_development_secret_key"
-		fmt.Println("Warning: Using default JWT secret key. Set JWT_SECRET_KEY environment variable for production.")
-	}
-	return secretKey
-} 
\ No newline at end of file
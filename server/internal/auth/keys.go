@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// developmentSecretKey is the HS256 secret used in development when none is configured
+const developmentSecretKey = "gotext_development_secret_key"
+
+// hmacKeyID is the kid of the HS256 secret
+const hmacKeyID = "hs256"
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 2048
+
+// ErrUnknownKey is returned when a token names a key that isn't in the keyring
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// signingKey is a key that signs or verifies tokens
+type signingKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer // nil for HMAC keys
+	Secret    []byte        // HMAC keys only
+	CreatedAt time.Time
+}
+
+// method returns the JWT signing method for the key
+func (k *signingKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// signKey returns the key passed to jwt when signing
+func (k *signingKey) signKey() interface{} {
+	if k.Secret != nil {
+		return k.Secret
+	}
+	return k.Private
+}
+
+// verifyKey returns the key passed to jwt when verifying
+func (k *signingKey) verifyKey() interface{} {
+	if k.Secret != nil {
+		return k.Secret
+	}
+	return k.Private.Public()
+}
+
+// keyring holds the key used to sign new tokens and every key still accepted for verification.
+// Keys are identified by the kid header of the tokens they sign.
+type keyring struct {
+	mu      sync.RWMutex
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+// keys is the keyring configured by Init
+var keys = &keyring{keys: map[string]*signingKey{}}
+
+// current returns the key that signs new tokens
+func (kr *keyring) current() *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.signing
+}
+
+// lookup returns the verification key with the given ID
+func (kr *keyring) lookup(kid string) (*signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	k, ok := kr.keys[kid]
+	return k, ok
+}
+
+// publicKeys returns the asymmetric verification keys, oldest first
+func (kr *keyring) publicKeys() []*signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	var list []*signingKey
+	for _, k := range kr.keys {
+		if k.Private != nil {
+			list = append(list, k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// replace swaps in a new set of keys. The signing key is the newest key that has
+// been published for at least the activation delay, so other instances have had
+// time to load it before tokens signed with it reach them.
+func (kr *keyring) replace(list []*signingKey, activationDelay time.Duration) {
+	if len(list) == 0 {
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	signing := list[0]
+	cutoff := time.Now().Add(-activationDelay)
+	for _, k := range list {
+		if !k.CreatedAt.After(cutoff) {
+			signing = k
+		}
+	}
+
+	byID := make(map[string]*signingKey, len(list))
+	for _, k := range list {
+		byID[k.ID] = k
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.signing = signing
+	kr.keys = byID
+}
+
+// initKeyring loads the signing keys for the configured algorithm. Outside
+// development mode a missing key is an error rather than a fallback to a built-in key.
+func initKeyring(config Config) error {
+	switch config.JWTAlgorithm {
+	case AlgorithmHS256:
+		secret := config.JWTSecret
+		if secret == "" {
+			if !config.IsDevelopment() {
+				return errors.New("JWT_SECRET_KEY must be set outside development mode")
+			}
+			log.Println("Warning: Using default JWT secret key. Set JWT_SECRET_KEY for production.")
+			secret = developmentSecretKey
+		}
+		keys.replace([]*signingKey{{ID: hmacKeyID, Algorithm: AlgorithmHS256, Secret: []byte(secret)}}, 0)
+		return nil
+
+	case AlgorithmRS256, AlgorithmEdDSA:
+		if config.JWTKeyDir == "" {
+			if !config.IsDevelopment() {
+				return fmt.Errorf("JWT_KEY_DIR must be set to use %s outside development mode", config.JWTAlgorithm)
+			}
+			log.Printf("Warning: Using a temporary %s key. Set JWT_KEY_DIR for production.", config.JWTAlgorithm)
+			k, err := generateSigningKey(config.JWTAlgorithm)
+			if err != nil {
+				return err
+			}
+			keys.replace([]*signingKey{k}, 0)
+			return nil
+		}
+
+		list, err := loadKeyDir(config.JWTKeyDir, config.JWTAlgorithm)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			if config.JWTKeyRotationInterval <= 0 {
+				return fmt.Errorf("no %s keys found in %s", config.JWTAlgorithm, config.JWTKeyDir)
+			}
+			// Rotation is enabled, so create the first key
+			k, err := generateSigningKey(config.JWTAlgorithm)
+			if err != nil {
+				return err
+			}
+			if err := writeKeyFile(config.JWTKeyDir, k); err != nil {
+				return err
+			}
+			list = append(list, k)
+		}
+		keys.replace(list, config.JWTKeyActivationDelay)
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", config.JWTAlgorithm)
+	}
+}
+
+// StartKeyRotation periodically reloads the key directory so keys added by other
+// instances are picked up and, if rotation is enabled, generates a new key once the
+// newest one is older than the rotation interval. Retired keys are deleted once no
+// token signed with them can still be valid. It returns when ctx is cancelled.
+func StartKeyRotation(ctx context.Context) {
+	if cfg.JWTAlgorithm == AlgorithmHS256 || cfg.JWTKeyDir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.JWTKeyReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rotateKeys(cfg); err != nil {
+				log.Printf("JWT key rotation failed: %v", err)
+			}
+		}
+	}
+}
+
+// rotateKeys runs one reload and rotation pass over the key directory
+func rotateKeys(config Config) error {
+	list, err := loadKeyDir(config.JWTKeyDir, config.JWTAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if config.JWTKeyRotationInterval > 0 {
+		newest := time.Time{}
+		for _, k := range list {
+			if k.CreatedAt.After(newest) {
+				newest = k.CreatedAt
+			}
+		}
+
+		if time.Since(newest) >= config.JWTKeyRotationInterval {
+			k, err := generateSigningKey(config.JWTAlgorithm)
+			if err != nil {
+				return err
+			}
+			if err := writeKeyFile(config.JWTKeyDir, k); err != nil {
+				return err
+			}
+			log.Printf("Generated new JWT signing key %s", k.ID)
+			list = append(list, k)
+		}
+
+		// A key can go once its successor has been signing for longer than any token lives
+		retention := config.JWTKeyRotationInterval + config.JWTKeyActivationDelay + maxTokenTTL(config) + config.JWTKeyReloadInterval
+		kept := list[:0]
+		for _, k := range list {
+			if time.Since(k.CreatedAt) > retention {
+				if err := os.Remove(filepath.Join(config.JWTKeyDir, k.ID+".pem")); err == nil {
+					log.Printf("Removed retired JWT signing key %s", k.ID)
+				}
+				continue
+			}
+			kept = append(kept, k)
+		}
+		list = kept
+	}
+
+	keys.replace(list, config.JWTKeyActivationDelay)
+	return nil
+}
+
+// maxTokenTTL is the longest lifetime of any JWT this server issues
+func maxTokenTTL(config Config) time.Duration {
+	ttl := config.AccessTokenTTL
+	if config.MFAChallengeTTL > ttl {
+		ttl = config.MFAChallengeTTL
+	}
+	return ttl
+}
+
+// generateSigningKey creates a new key for the algorithm. The key ID is derived
+// from its creation time so keys sort naturally in the key directory.
+func generateSigningKey(algorithm string) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("cannot generate keys for %s", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := GenerateSecureToken(4)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &signingKey{
+		ID:        now.Format("20060102T150405Z") + "-" + suffix,
+		Algorithm: algorithm,
+		Private:   private,
+		CreatedAt: now,
+	}, nil
+}
+
+// loadKeyDir reads every *.pem private key in dir that matches the algorithm.
+// The file name (without .pem) is the key ID and its modification time is the key's age.
+func loadKeyDir(dir, algorithm string) ([]*signingKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*signingKey
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		private, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", path, err)
+		}
+
+		keyAlgorithm := AlgorithmRS256
+		if _, ok := private.(ed25519.PrivateKey); ok {
+			keyAlgorithm = AlgorithmEdDSA
+		}
+		if keyAlgorithm != algorithm {
+			continue
+		}
+
+		list = append(list, &signingKey{
+			ID:        strings.TrimSuffix(filepath.Base(path), ".pem"),
+			Algorithm: keyAlgorithm,
+			Private:   private,
+			CreatedAt: info.ModTime(),
+		})
+	}
+
+	return list, nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#8 or PKCS#1 private key
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported private key format, expected PKCS#8 or PKCS#1")
+}
+
+// writeKeyFile saves a key to the key directory as PKCS#8 PEM
+func writeKeyFile(dir string, k *signingKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, k.ID+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// Write to a temporary file first so other instances never read a partial key
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding a public verification key
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// toJWK converts the public half of an asymmetric key to a JWK
+func (k *signingKey) toJWK() (jwk, bool) {
+	key := jwk{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+
+	switch public := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		key.KeyType = "OKP"
+		key.Curve = "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk{}, false
+	}
+
+	return key, true
+}
+
+// JWKSHandler publishes the public keys that verify tokens issued by this server,
+// so other services can validate them. HS256 secrets are never published.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+
+	for _, k := range keys.publicKeys() {
+		if key, ok := k.toJWK(); ok {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.JWTKeyReloadInterval.Seconds())))
+	RespondWithJSON(w, http.StatusOK, set)
+}
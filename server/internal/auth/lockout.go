@@ -0,0 +1,559 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/audit"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/mailer"
+	"github.com/gotext/server/internal/models"
+)
+
+// Login attempt stores
+const (
+	AttemptStoreMemory   = "memory"
+	AttemptStorePostgres = "postgres"
+)
+
+// AttemptState is the failed-attempt history of one account or IP address
+type AttemptState struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// AttemptStore tracks failed login attempts. Keys are opaque strings such as
+// "account:<email>" or "ip:<address>".
+type AttemptStore interface {
+	// Acquire decides whether an attempt for key may go ahead, as one operation so
+	// that concurrent attempts are decided one at a time. wait is given the current
+	// state, with the count started over if the last failure is older than window,
+	// and returns how long the attempt has to wait. If it doesn't have to wait the
+	// attempt is counted as a failure in advance and Acquire returns the new state
+	// and 0; otherwise nothing is counted and Acquire returns the wait.
+	Acquire(key string, window time.Duration, wait func(AttemptState) time.Duration) (AttemptState, time.Duration, error)
+	// Release takes back an attempt counted by Acquire that didn't fail
+	Release(key string) error
+	// Lock blocks all attempts for key until the given time
+	Lock(key string, until time.Time) error
+	// Reset forgets all failures and any lock for key
+	Reset(key string) error
+}
+
+// attemptSweepEvery is how many Acquire calls pass between sweeps for entries
+// that no longer affect anything
+const attemptSweepEvery = 1000
+
+// attempts is the store configured by Init
+var attempts AttemptStore = NewMemoryAttemptStore()
+
+// newAttemptStore creates the attempt store named in the configuration
+func newAttemptStore(config Config) (AttemptStore, error) {
+	switch config.LoginAttemptStore {
+	case AttemptStoreMemory:
+		return NewMemoryAttemptStore(), nil
+	case AttemptStorePostgres:
+		return NewPostgresAttemptStore(db.DB), nil
+	default:
+		return nil, fmt.Errorf("unknown login attempt store %q", config.LoginAttemptStore)
+	}
+}
+
+// MemoryAttemptStore keeps attempt counters in process memory.
+// It only protects a single server instance.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]AttemptState
+	calls   int
+}
+
+// NewMemoryAttemptStore creates an empty in-memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{entries: map[string]AttemptState{}}
+}
+
+// Acquire implements AttemptStore
+func (s *MemoryAttemptStore) Acquire(key string, window time.Duration, wait func(AttemptState) time.Duration) (AttemptState, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// Drop entries that no longer affect anything so the map doesn't grow forever
+	s.calls++
+	if s.calls%attemptSweepEvery == 0 {
+		for k, e := range s.entries {
+			if now.Sub(e.LastFailure) > window && now.After(e.LockedUntil) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	state := s.entries[key]
+	if now.Sub(state.LastFailure) > window {
+		state.Failures = 0
+	}
+	if d := wait(state); d > 0 {
+		return state, d, nil
+	}
+
+	state.Failures++
+	state.LastFailure = now
+	s.entries[key] = state
+	return state, 0, nil
+}
+
+// Release implements AttemptStore
+func (s *MemoryAttemptStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.entries[key]; ok && state.Failures > 0 {
+		state.Failures--
+		s.entries[key] = state
+	}
+	return nil
+}
+
+// Lock implements AttemptStore
+func (s *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.entries[key]
+	state.LockedUntil = until
+	s.entries[key] = state
+	return nil
+}
+
+// Reset implements AttemptStore
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// PostgresAttemptStore keeps attempt counters in the login_attempts table
+// so that every server instance sees the same counts.
+type PostgresAttemptStore struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	calls int
+}
+
+// NewPostgresAttemptStore creates an attempt store backed by the given database
+func NewPostgresAttemptStore(database *sql.DB) *PostgresAttemptStore {
+	return &PostgresAttemptStore{db: database}
+}
+
+// Acquire implements AttemptStore
+func (s *PostgresAttemptStore) Acquire(key string, window time.Duration, wait func(AttemptState) time.Duration) (AttemptState, time.Duration, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return AttemptState{}, 0, err
+	}
+	defer tx.Rollback()
+
+	now := db.CurrentTime()
+
+	// Lock the key's row, creating it if needed, so concurrent attempts are
+	// decided one at a time
+	var state AttemptState
+	var lockedUntil sql.NullTime
+	err = tx.QueryRow(`INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 0, $2)
+		ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+		RETURNING failures, last_failure_at, locked_until`, key, now).
+		Scan(&state.Failures, &state.LastFailure, &lockedUntil)
+	if err != nil {
+		return AttemptState{}, 0, err
+	}
+	state.LockedUntil = lockedUntil.Time
+
+	if now.Sub(state.LastFailure) > window {
+		state.Failures = 0
+	}
+	if d := wait(state); d > 0 {
+		return state, d, tx.Commit()
+	}
+
+	state.Failures++
+	state.LastFailure = now
+	if _, err := tx.Exec(`UPDATE login_attempts SET failures = $2, last_failure_at = $3 WHERE key = $1`,
+		key, state.Failures, state.LastFailure); err != nil {
+		return AttemptState{}, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AttemptState{}, 0, err
+	}
+
+	// Clean up entries that no longer affect anything
+	s.mu.Lock()
+	s.calls++
+	sweep := s.calls%attemptSweepEvery == 0
+	s.mu.Unlock()
+	if sweep {
+		s.db.Exec(`DELETE FROM login_attempts
+			WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)`, now.Add(-window), now)
+	}
+
+	return state, 0, nil
+}
+
+// Release implements AttemptStore
+func (s *PostgresAttemptStore) Release(key string) error {
+	_, err := s.db.Exec(`UPDATE login_attempts SET failures = GREATEST(failures - 1, 0) WHERE key = $1`, key)
+	return err
+}
+
+// Lock implements AttemptStore
+func (s *PostgresAttemptStore) Lock(key string, until time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO login_attempts (key, failures, last_failure_at, locked_until) VALUES ($1, 0, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET locked_until = $3`, key, db.CurrentTime(), until)
+	return err
+}
+
+// Reset implements AttemptStore
+func (s *PostgresAttemptStore) Reset(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
+
+// attemptPolicy describes when failed attempts slow down and then lock out a key
+type attemptPolicy struct {
+	// BackoffAfter is the number of failures after which each attempt must wait,
+	// doubling with every further failure
+	BackoffAfter int
+	// LockAfter is the number of failures that triggers a lockout
+	LockAfter int
+	// LockFor is how long a lockout lasts
+	LockFor time.Duration
+}
+
+// accountPolicy returns the policy for failures against one account
+func accountPolicy() attemptPolicy {
+	return attemptPolicy{BackoffAfter: cfg.AccountBackoffAfter, LockAfter: cfg.AccountLockoutThreshold, LockFor: cfg.AccountLockoutDuration}
+}
+
+// ipPolicy returns the policy for failures from one IP address
+func ipPolicy() attemptPolicy {
+	return attemptPolicy{BackoffAfter: cfg.IPBackoffAfter, LockAfter: cfg.IPLockoutThreshold, LockFor: cfg.IPLockoutDuration}
+}
+
+// retryAfter returns how long the holder of state has to wait before trying again (0 if it may try now)
+func (p attemptPolicy) retryAfter(state AttemptState, now time.Time) time.Duration {
+	if now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now)
+	}
+
+	if p.BackoffAfter <= 0 || state.Failures < p.BackoffAfter {
+		return 0
+	}
+
+	// Double the delay for every failure past the threshold, without overflowing
+	delay := cfg.LoginBackoffBase
+	for i := p.BackoffAfter; i < state.Failures && delay < cfg.LoginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.LoginBackoffMax {
+		delay = cfg.LoginBackoffMax
+	}
+
+	if wait := state.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// accountAttemptKey returns the attempt key for an email address. Attempts are tracked
+// by email rather than user ID so unknown emails behave exactly like real accounts.
+func accountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipAttemptKey returns the attempt key for an IP address
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginAttempt is one attempt to log in to an account. It is counted as a
+// failure against the account and the client's IP address before the
+// credentials are checked, so concurrent guesses can't all get past the limits,
+// and taken back if it turns out not to have failed.
+type loginAttempt struct {
+	email string
+	ip    string
+	// account and ipState are the states after counting the attempt; the
+	// counted flags are false when the store failed and nothing was counted
+	account, ipState          AttemptState
+	accountCounted, ipCounted bool
+}
+
+// beginLoginAttempt counts a login attempt to the account. If the account or
+// the client's IP address has to wait first it counts nothing and returns how
+// long. Store errors fail open so an outage of the attempt store doesn't lock
+// everyone out.
+func beginLoginAttempt(r *http.Request, email string) (*loginAttempt, time.Duration) {
+	a := &loginAttempt{email: email, ip: ClientIP(r)}
+
+	state, wait, err := acquireAttempt(accountAttemptKey(email), accountPolicy())
+	if wait > 0 {
+		return nil, wait
+	}
+	a.account, a.accountCounted = state, err == nil
+
+	state, wait, err = acquireAttempt(ipAttemptKey(a.ip), ipPolicy())
+	if wait > 0 {
+		a.release(true, false)
+		return nil, wait
+	}
+	a.ipState, a.ipCounted = state, err == nil
+
+	return a, 0
+}
+
+// acquireAttempt counts an attempt for key unless policy makes it wait
+func acquireAttempt(key string, policy attemptPolicy) (AttemptState, time.Duration, error) {
+	state, wait, err := attempts.Acquire(key, cfg.LoginFailureWindow, func(state AttemptState) time.Duration {
+		return policy.retryAfter(state, time.Now())
+	})
+	if err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+	return state, wait, err
+}
+
+// fail keeps the attempt counted, locking the account or the IP address out
+// once it reaches its threshold
+func (a *loginAttempt) fail() {
+	if policy := accountPolicy(); a.accountCounted && policy.LockAfter > 0 && a.account.Failures >= policy.LockAfter {
+		lockAccount(a.email, a.ip, a.account.Failures, policy.LockFor)
+	}
+
+	if policy := ipPolicy(); a.ipCounted && policy.LockAfter > 0 && a.ipState.Failures >= policy.LockAfter {
+		if err := attempts.Lock(ipAttemptKey(a.ip), time.Now().Add(policy.LockFor)); err != nil {
+			log.Printf("Failed to block IP address: %v", err)
+		}
+		audit.Record(audit.Event{
+			Type:      audit.EventIPBlocked,
+			IPAddress: a.ip,
+			Details:   map[string]interface{}{"failures": a.ipState.Failures, "duration": policy.LockFor.String()},
+		})
+	}
+}
+
+// succeed clears the account's failed attempts. The IP counter only gets this
+// attempt back so one valid account can't reset it for others.
+func (a *loginAttempt) succeed() {
+	if err := attempts.Reset(accountAttemptKey(a.email)); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+	a.release(false, true)
+}
+
+// abandon takes the attempt back when it neither failed nor succeeded, such as
+// a correct password that still needs a second factor
+func (a *loginAttempt) abandon() {
+	a.release(true, true)
+}
+
+// release takes back the counted attempt from the account, the IP address or both
+func (a *loginAttempt) release(account, ip bool) {
+	if account && a.accountCounted {
+		if err := attempts.Release(accountAttemptKey(a.email)); err != nil {
+			log.Printf("Failed to release login attempt: %v", err)
+		}
+		a.accountCounted = false
+	}
+	if ip && a.ipCounted {
+		if err := attempts.Release(ipAttemptKey(a.ip)); err != nil {
+			log.Printf("Failed to release login attempt: %v", err)
+		}
+		a.ipCounted = false
+	}
+}
+
+// lockAccount locks an account out, records the lockout and emails the owner
+// a link to unlock it early
+func lockAccount(email, ip string, failures int, duration time.Duration) {
+	if err := attempts.Lock(accountAttemptKey(email), time.Now().Add(duration)); err != nil {
+		log.Printf("Failed to lock account: %v", err)
+		return
+	}
+
+	event := audit.Event{
+		Type:      audit.EventAccountLocked,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"failures": failures, "duration": duration.String()},
+	}
+
+	// The lock applies to unknown emails too, but only real accounts get an email
+	user, err := getUserByEmail(email)
+	if err != nil {
+		event.Details["email"] = email
+		audit.Record(event)
+		return
+	}
+
+	event.UserID = &user.ID
+	audit.Record(event)
+
+	if err := sendUnlockEmail(user, duration); err != nil {
+		log.Printf("Failed to send unlock email: %v", err)
+	}
+}
+
+// respondWithLoginThrottled tells the client to wait before trying to log in again.
+// The same response is used for locked accounts, blocked IPs and unknown emails.
+func respondWithLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	RespondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts. Please try again later.")
+}
+
+// UnlockAccountHandler unlocks an account with the token from the unlock email.
+// GET only reports whether the token is valid, so that mail scanners prefetching
+// the link can't unlock an account; the unlock itself needs a POST with the token.
+func UnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case http.MethodGet:
+		token = r.URL.Query().Get("token")
+		if token == "" {
+			RespondWithError(w, http.StatusBadRequest, "Unlock token is required")
+			return
+		}
+		checkUnlockToken(w, token)
+		return
+	case http.MethodPost:
+		var req models.UnlockAccountRequest
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+		token = req.Token
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Deleting the token makes it single-use
+	var userID uuid.UUID
+	err := db.DB.QueryRow(`DELETE FROM account_unlock_tokens
+		WHERE token_hash = $1 AND expires_at > $2
+		RETURNING user_id`, HashToken(token), db.CurrentTime()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid or expired unlock token")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+
+	if err := UnlockAccount(userID, nil, ClientIP(r), "email"); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Your account has been unlocked. You can log in again.",
+	})
+}
+
+// checkUnlockToken responds with whether an unlock token is valid, without using it up
+func checkUnlockToken(w http.ResponseWriter, token string) {
+	var valid bool
+	err := db.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM account_unlock_tokens
+		WHERE token_hash = $1 AND expires_at > $2)`, HashToken(token), db.CurrentTime()).Scan(&valid)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to check unlock token")
+		return
+	}
+	if !valid {
+		RespondWithError(w, http.StatusBadRequest, "Invalid or expired unlock token")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Unlock token is valid. Confirm to unlock your account.",
+	})
+}
+
+// UnlockAccount clears the lockout and failed attempts of a user's account.
+// actorID is the administrator who unlocked it, or nil if the user did it themselves,
+// and reason says how the account was unlocked (e.g. "email", "password_reset", "admin").
+func UnlockAccount(userID uuid.UUID, actorID *uuid.UUID, ip, reason string) error {
+	user, err := getUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := attempts.Reset(accountAttemptKey(user.Email)); err != nil {
+		return err
+	}
+	if _, err := db.DB.Exec(`DELETE FROM account_unlock_tokens WHERE user_id = $1`, user.ID); err != nil {
+		return err
+	}
+
+	audit.Record(audit.Event{
+		Type:      audit.EventAccountUnlocked,
+		UserID:    &user.ID,
+		ActorID:   actorID,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"reason": reason},
+	})
+	return nil
+}
+
+// sendUnlockEmail tells a user their account was locked and emails a link to unlock it
+func sendUnlockEmail(user models.User, duration time.Duration) error {
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the most recent unlock link stays valid, and only as long as the lockout
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM account_unlock_tokens WHERE user_id = $1`, user.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO account_unlock_tokens (id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		uuid.New(), user.ID, HashToken(token), db.CurrentTime().Add(duration))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := cfg.AppBaseURL + "/unlock-account?token=" + url.QueryEscape(token)
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your GoText account has been locked",
+		Body: fmt.Sprintf("Hi %s,\n\nYour GoText account was locked for %s after too many failed login attempts. "+
+			"If this was you, open the link below to unlock it now:\n\n%s\n\n"+
+			"If it wasn't you, someone may be trying to guess your password. Consider resetting it.\n",
+			user.Username, formatDuration(duration), link),
+	})
+}
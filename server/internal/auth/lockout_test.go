@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentLoginAttemptsAreLimited(t *testing.T) {
+	setupTestConfig(t, nil)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	email := "concurrent@example.com"
+
+	// Every guess starts before any of them has failed
+	const guesses = 20
+	var wg sync.WaitGroup
+	allowed := make(chan *loginAttempt, guesses)
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if attempt, wait := beginLoginAttempt(r, email); wait == 0 {
+				allowed <- attempt
+			}
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+
+	count := 0
+	for attempt := range allowed {
+		attempt.fail()
+		count++
+	}
+	if count != cfg.AccountBackoffAfter {
+		t.Errorf("expected %d guesses before the backoff, got %d", cfg.AccountBackoffAfter, count)
+	}
+}
+
+func TestAbandonedLoginAttemptsDontCount(t *testing.T) {
+	setupTestConfig(t, nil)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	email := "abandoned@example.com"
+
+	for i := 0; i < 2*cfg.AccountBackoffAfter; i++ {
+		attempt, wait := beginLoginAttempt(r, email)
+		if wait > 0 {
+			t.Fatalf("attempt %d: expected no wait, got %s", i+1, wait)
+		}
+		attempt.abandon()
+	}
+
+	state, _, err := attempts.Acquire(accountAttemptKey(email), cfg.LoginFailureWindow, func(AttemptState) time.Duration { return time.Second })
+	if err != nil {
+		t.Fatalf("failed to read attempts: %v", err)
+	}
+	if state.Failures != 0 {
+		t.Errorf("expected no failures, got %d", state.Failures)
+	}
+}
+
+func TestMemoryAttemptStoreSweepsExpiredEntries(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	window := time.Minute
+	now := time.Now()
+
+	store.entries["expired"] = AttemptState{Failures: 3, LastFailure: now.Add(-2 * window)}
+	store.entries["locked"] = AttemptState{Failures: 3, LastFailure: now.Add(-2 * window), LockedUntil: now.Add(window)}
+
+	noWait := func(AttemptState) time.Duration { return 0 }
+	for i := 0; i < attemptSweepEvery; i++ {
+		if _, _, err := store.Acquire("current", window, noWait); err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+	}
+
+	if _, ok := store.entries["expired"]; ok {
+		t.Error("expected the expired entry to be swept")
+	}
+	if _, ok := store.entries["locked"]; !ok {
+		t.Error("expected the locked entry to be kept")
+	}
+	if state := store.entries["current"]; state.Failures != attemptSweepEvery {
+		t.Errorf("expected %d failures, got %d", attemptSweepEvery, state.Failures)
+	}
+}
@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// recoveryCodeCount is the number of recovery codes issued at a time
+const recoveryCodeCount = 10
+
+var (
+	// ErrInvalidMFACode is returned when a TOTP or recovery code is wrong or already used
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+	// ErrMFASetupRequired is returned when the server requires two-factor authentication
+	// and the user hasn't set it up yet
+	ErrMFASetupRequired = errors.New("two-factor authentication must be set up")
+)
+
+// respondWithMFAChallenge writes the response for a login that needs a second factor
+func respondWithMFAChallenge(w http.ResponseWriter, user models.User) {
+	token, err := generatePurposeToken(user, PurposeMFAChallenge, cfg.MFAChallengeTTL)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication code required",
+		Data: models.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    token,
+			ExpiresIn:   int(cfg.MFAChallengeTTL.Seconds()),
+		},
+	})
+}
+
+// MFALoginHandler completes a login with the challenge token returned by LoginHandler
+// and either a TOTP code or a recovery code
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the request body
+	var req models.MFALoginRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	claims, err := validatePurposeToken(req.MFAToken, PurposeMFAChallenge)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	user, err := UserFromClaims(claims)
+	if err != nil || !user.TOTPEnabled {
+		RespondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, req.Code, req.RecoveryCode) {
+		return
+	}
+
+	issueSession(w, r, user)
+}
+
+// TOTPEnrollHandler generates a new TOTP secret for the current user.
+// Two-factor authentication is not enabled until the secret is confirmed with a code.
+func TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if user.TOTPEnabled {
+		RespondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate secret")
+		return
+	}
+
+	uri := totpURI(cfg.MFAIssuer, user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate QR code")
+		return
+	}
+
+	// Replaces any earlier unconfirmed secret
+	_, err = db.DB.Exec(`UPDATE users SET totp_secret = $1, totp_last_used_step = 0 WHERE id = $2 AND totp_enabled = FALSE`,
+		secret, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to save secret")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Scan the QR code with your authenticator app, then confirm with a code",
+		Data: models.TOTPEnrollmentResponse{
+			Secret:     secret,
+			OTPAuthURI: uri,
+			QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		},
+	})
+}
+
+// TOTPConfirmHandler enables two-factor authentication once the user proves their
+// authenticator app works, and returns the initial recovery codes
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.MFACodeRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if user.TOTPEnabled {
+		RespondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		RespondWithError(w, http.StatusBadRequest, "Start enrollment before confirming")
+		return
+	}
+
+	step, ok := validateTOTP(user.TOTPSecret, req.Code, db.CurrentTime(), user.TOTPLastUsedStep)
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Invalid two-factor code")
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = TRUE, totp_last_used_step = $1 WHERE id = $2`, step, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication enabled. Store these recovery codes somewhere safe.",
+		Data:    models.RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// TOTPDisableHandler turns off two-factor authentication after checking a current code
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.MFACodeRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		RespondWithError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+	if cfg.MFARequired {
+		RespondWithError(w, http.StatusForbidden, "Two-factor authentication is required on this server")
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, req.Code, req.RecoveryCode) {
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_used_step = 0 WHERE id = $1`, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, user.ID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	})
+}
+
+// RecoveryCodesHandler replaces the current user's recovery codes after checking a current code
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.MFACodeRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		RespondWithError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, req.Code, req.RecoveryCode) {
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    models.RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// checkSecondFactor verifies a code with verifySecondFactor. Wrong codes count
+// towards the same lockout as wrong passwords, so neither a login challenge nor
+// a stolen access token can be used to guess codes. It responds and returns
+// false if the code isn't accepted.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user models.User, code, recoveryCode string) bool {
+	attempt, wait := beginLoginAttempt(r, user.Email)
+	if wait > 0 {
+		respondWithLoginThrottled(w, wait)
+		return false
+	}
+
+	if err := verifySecondFactor(user, code, recoveryCode); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			attempt.fail()
+		} else {
+			attempt.abandon()
+		}
+		respondWithMFAError(w, err)
+		return false
+	}
+
+	attempt.succeed()
+	return true
+}
+
+// verifySecondFactor checks a TOTP code or, if none is given, a recovery code.
+// Accepted codes are consumed so they can't be used again.
+func verifySecondFactor(user models.User, code, recoveryCode string) error {
+	if code != "" {
+		step, ok := validateTOTP(user.TOTPSecret, code, db.CurrentTime(), user.TOTPLastUsedStep)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+
+		// The condition makes concurrent use of the same code fail
+		result, err := db.DB.Exec(`UPDATE users SET totp_last_used_step = $1 WHERE id = $2 AND totp_last_used_step < $1`,
+			step, user.ID)
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	if recoveryCode != "" {
+		result, err := db.DB.Exec(`UPDATE mfa_recovery_codes SET used_at = $1
+			WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`,
+			db.CurrentTime(), user.ID, HashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	return ErrInvalidMFACode
+}
+
+// respondWithMFAError writes the response for a failed verifySecondFactor
+func respondWithMFAError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidMFACode) {
+		RespondWithError(w, http.StatusUnauthorized, "Invalid two-factor code")
+		return
+	}
+	RespondWithError(w, http.StatusInternalServerError, "Failed to verify two-factor code")
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and generates a new set
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`INSERT INTO mfa_recovery_codes (id, user_id, code_hash) VALUES ($1, $2, $3)`,
+			uuid.New(), userID, HashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random code formatted as two groups of five characters
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode makes recovery code comparison ignore case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
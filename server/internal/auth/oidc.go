@@ -0,0 +1,435 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateCookieName binds an OIDC login to the browser that started it
+const oidcStateCookieName = "oidc_state"
+
+var (
+	// ErrUnknownProvider is returned for a provider name that isn't configured
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrSignupDisabled is returned when an unknown identity logs in and the provider doesn't allow signup
+	ErrSignupDisabled = errors.New("signup is disabled for this identity provider")
+)
+
+// oidcProvider is a configured identity provider. The discovery document is
+// fetched on first use so the server starts even if the provider is down.
+type oidcProvider struct {
+	config OIDCProviderConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// oidcProviders holds the providers configured by Init, by name
+var oidcProviders = map[string]*oidcProvider{}
+
+// initOIDC sets up the configured OIDC providers
+func initOIDC(config Config) {
+	providers := make(map[string]*oidcProvider, len(config.OIDCProviders))
+	for _, p := range config.OIDCProviders {
+		providers[p.Name] = &oidcProvider{config: p}
+	}
+	oidcProviders = providers
+}
+
+// discover returns the provider's discovery document, fetching it if needed
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.config.IssuerURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover OIDC provider %s: %w", p.config.Name, err)
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+// oauth2Config returns the OAuth2 client configuration for the provider
+func (p *oidcProvider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.config.Scopes,
+	}
+}
+
+// oidcClaims are the ID token claims used to find or create the local user
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+// OIDCProvidersHandler lists the configured single sign-on providers
+func OIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	providers := make([]models.OIDCProviderResponse, 0, len(cfg.OIDCProviders))
+	for _, p := range cfg.OIDCProviders {
+		providers = append(providers, models.OIDCProviderResponse{
+			Name:        p.Name,
+			DisplayName: p.DisplayName,
+			LoginURL:    cfg.APIBaseURL + "/api/auth/oidc/" + p.Name + "/login",
+		})
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    providers,
+	})
+}
+
+// OIDCLoginHandler redirects the browser to the identity provider using the
+// authorization code flow with PKCE. The {provider} path wildcard names the provider
+// and the optional "redirect" query parameter is the client path to return to.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	provider, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		RespondWithError(w, http.StatusBadGateway, "Identity provider is unavailable")
+		return
+	}
+
+	state, err := GenerateSecureToken(32)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	nonce, err := GenerateSecureToken(32)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	now := db.CurrentTime()
+	_, err = db.DB.Exec(`INSERT INTO oidc_auth_requests (state_hash, provider, nonce, code_verifier, redirect_path, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		HashToken(state), p.config.Name, nonce, verifier, safeRedirectPath(r.URL.Query().Get("redirect")), now.Add(cfg.OIDCLoginTTL))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+
+	// Clean up abandoned logins
+	db.DB.Exec(`DELETE FROM oidc_auth_requests WHERE expires_at <= $1`, now)
+
+	// Lax so the cookie comes back on the provider's top-level redirect
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(cfg.OIDCLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := p.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes an OIDC login: it exchanges the code, verifies the
+// ID token against the provider's JWKS, finds or provisions the local user and
+// starts a session before redirecting back to the web client
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// The state must match the cookie set when this browser started the login
+	cookie, err := r.Cookie(oidcStateCookieName)
+	state := query.Get("state")
+	if err != nil || state == "" || cookie.Value != state {
+		redirectWithLoginError(w, r, "sso_invalid_state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/api/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if query.Get("error") != "" {
+		redirectWithLoginError(w, r, "sso_denied")
+		return
+	}
+
+	// Consume the pending login
+	var providerName, nonce, verifier, redirectPath string
+	err = db.DB.QueryRow(`DELETE FROM oidc_auth_requests
+		WHERE state_hash = $1 AND expires_at > $2
+		RETURNING provider, nonce, code_verifier, COALESCE(redirect_path, '/')`,
+		HashToken(state), db.CurrentTime()).Scan(&providerName, &nonce, &verifier, &redirectPath)
+	if err != nil || providerName != r.PathValue("provider") {
+		redirectWithLoginError(w, r, "sso_expired")
+		return
+	}
+
+	p, ok := oidcProviders[providerName]
+	if !ok {
+		redirectWithLoginError(w, r, "sso_failed")
+		return
+	}
+
+	claims, err := p.exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC callback failed for provider %s: %v", providerName, err)
+		redirectWithLoginError(w, r, "sso_failed")
+		return
+	}
+
+	user, err := resolveOIDCUser(p.config, claims)
+	if err != nil {
+		log.Printf("OIDC user resolution failed for provider %s: %v", providerName, err)
+		if errors.Is(err, ErrSignupDisabled) {
+			redirectWithLoginError(w, r, "sso_no_account")
+			return
+		}
+		redirectWithLoginError(w, r, "sso_failed")
+		return
+	}
+
+	// Enforce the email verification policy
+	if !user.IsEmailVerified && cfg.EmailVerificationPolicy == VerificationPolicyBlock {
+		redirectWithLoginError(w, r, "email_not_verified")
+		return
+	}
+
+	// Users with two-factor authentication finish logging in on the client
+	if user.TOTPEnabled {
+		token, err := generatePurposeToken(user, PurposeMFAChallenge, cfg.MFAChallengeTTL)
+		if err != nil {
+			redirectWithLoginError(w, r, "sso_failed")
+			return
+		}
+		http.Redirect(w, r, cfg.AppBaseURL+"/login/mfa?mfa_token="+url.QueryEscape(token), http.StatusFound)
+		return
+	}
+
+	tokens, err := createSession(r, user)
+	if err != nil {
+		redirectWithLoginError(w, r, "sso_failed")
+		return
+	}
+	setAuthCookies(w, r, tokens)
+
+	http.Redirect(w, r, cfg.AppBaseURL+redirectPath, http.StatusFound)
+}
+
+// exchange trades an authorization code for tokens and verifies the ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier, nonce string) (oidcClaims, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	token, err := p.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return oidcClaims{}, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return oidcClaims{}, errors.New("token response has no id_token")
+	}
+
+	// Checks the signature against the provider's JWKS, the issuer, audience and expiry
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return oidcClaims{}, fmt.Errorf("invalid id_token: %w", err)
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return oidcClaims{}, fmt.Errorf("invalid id_token claims: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return oidcClaims{}, errors.New("id_token nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// resolveOIDCUser finds the local user for an external identity. Unknown identities
+// are linked to an existing user with the same verified email, or get a new account.
+func resolveOIDCUser(provider OIDCProviderConfig, claims oidcClaims) (models.User, error) {
+	now := db.CurrentTime()
+
+	// Already linked
+	var userID uuid.UUID
+	err := db.DB.QueryRow(`UPDATE user_identities SET last_login_at = $1, email = $2
+		WHERE provider = $3 AND subject = $4
+		RETURNING user_id`, now, claims.Email, provider.Name, claims.Subject).Scan(&userID)
+	if err == nil {
+		return getUserByID(userID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, err
+	}
+
+	// Link to an existing account, trusting only emails the provider has verified
+	if provider.LinkByEmail && claims.Email != "" && claims.EmailVerified {
+		if user, err := getUserByEmail(claims.Email); err == nil {
+			if err := linkIdentity(user.ID, provider.Name, claims, now); err != nil {
+				return models.User{}, err
+			}
+			if !user.IsEmailVerified {
+				db.DB.Exec(`UPDATE users SET is_email_verified = TRUE, email_verification_token = NULL WHERE id = $1`, user.ID)
+				user.IsEmailVerified = true
+			}
+			return user, nil
+		}
+	}
+
+	if !provider.AllowSignup {
+		return models.User{}, ErrSignupDisabled
+	}
+	if claims.Email == "" {
+		return models.User{}, errors.New("identity provider did not return an email address")
+	}
+
+	// Just-in-time provisioning. The account gets an unusable random password;
+	// the user can set one through the password reset flow.
+	return provisionOIDCUser(provider.Name, claims, now)
+}
+
+// linkIdentity records an external identity for a user
+func linkIdentity(userID uuid.UUID, provider string, claims oidcClaims, now time.Time) error {
+	_, err := db.DB.Exec(`INSERT INTO user_identities (id, user_id, provider, subject, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		uuid.New(), userID, provider, claims.Subject, claims.Email, now)
+	return err
+}
+
+// provisionOIDCUser creates a local user for an external identity
+func provisionOIDCUser(provider string, claims oidcClaims, now time.Time) (models.User, error) {
+	randomPassword, err := GenerateSecureToken(32)
+	if err != nil {
+		return models.User{}, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+
+	user := models.User{
+		ID:              uuid.New(),
+		Email:           claims.Email,
+		PasswordHash:    string(hashedPassword),
+		IsEmailVerified: claims.EmailVerified,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	// Retry with a random suffix if the username is taken
+	for attempt := 0; attempt < 5; attempt++ {
+		user.Username = candidateUsername(base, attempt)
+		err = createUser(user)
+		if err == nil || err.Error() != "user already exists" {
+			break
+		}
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if err := linkIdentity(user.ID, provider, claims, now); err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+// usernameDisallowed matches characters not allowed in generated usernames
+var usernameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// candidateUsername derives a username from an identity provider's suggestion.
+// Attempts after the first get a random suffix.
+func candidateUsername(base string, attempt int) string {
+	name := usernameDisallowed.ReplaceAllString(base, "")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	for len(name) < 3 {
+		name += "_"
+	}
+	if attempt > 0 {
+		suffix := strings.ReplaceAll(uuid.New().String(), "-", "")[:6]
+		name += "_" + suffix
+	}
+	return name
+}
+
+// safeRedirectPath only allows relative paths on the web client, to avoid open redirects
+func safeRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return "/"
+	}
+	return path
+}
+
+// redirectWithLoginError sends the browser back to the client's login page with an error code
+func redirectWithLoginError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, cfg.AppBaseURL+"/login?error="+url.QueryEscape(code), http.StatusFound)
+}
@@ -0,0 +1,463 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/testutil"
+)
+
+// mockOIDCClientID is the client the mock provider issues ID tokens for
+const mockOIDCClientID = "gotext-test"
+
+// mockOIDCProvider is a minimal OpenID Connect provider. It serves discovery,
+// JWKS, authorization and token endpoints, and logs in whoever is set as its
+// identity without asking.
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+	// identity holds the claims put in the next ID token
+	identity map[string]interface{}
+	// nonceOverride replaces the nonce from the authorization request, if set
+	nonceOverride string
+	// codes are the issued authorization codes
+	codes map[string]mockAuthorization
+}
+
+// mockAuthorization is an authorization request the provider has approved
+type mockAuthorization struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	identity      map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	m := &mockOIDCProvider{key: key, codes: map[string]mockAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// setIdentity sets who logs in next
+func (m *mockOIDCProvider) setIdentity(subject, email string, emailVerified bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identity = map[string]interface{}{
+		"sub":                subject,
+		"email":              email,
+		"email_verified":     emailVerified,
+		"preferred_username": strings.Split(email, "@")[0],
+	}
+}
+
+func (m *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := m.server.URL
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *mockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.PublicKey.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize approves the request straight away and redirects back with a code
+func (m *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "authorization code flow with PKCE required", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code := uuid.New().String()
+	m.codes[code] = mockAuthorization{
+		clientID:      query.Get("client_id"),
+		redirectURI:   query.Get("redirect_uri"),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		identity:      m.identity,
+	}
+	m.mu.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	values := callback.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	callback.RawQuery = values.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// token exchanges a code for a signed ID token, checking the PKCE verifier
+func (m *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+
+	m.mu.Lock()
+	authorization, found := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	nonce := authorization.nonce
+	if m.nonceOverride != "" {
+		nonce = m.nonceOverride
+	}
+	m.mu.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !found || clientID != authorization.clientID || r.PostForm.Get("redirect_uri") != authorization.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.codeChallenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   m.server.URL,
+		"aud":   authorization.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for name, value := range authorization.identity {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// oidcTestRouter routes the OIDC handlers so they see their {provider} wildcard
+func oidcTestRouter() *http.ServeMux {
+	router := http.NewServeMux()
+	router.HandleFunc("/api/auth/oidc/{provider}/login", OIDCLoginHandler)
+	router.HandleFunc("/api/auth/oidc/{provider}/callback", OIDCCallbackHandler)
+	return router
+}
+
+// setupOIDC configures a provider named "mock" backed by a mock server
+func setupOIDC(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	mock := newMockOIDCProvider(t)
+	provider := OIDCProviderConfig{
+		Name:         "mock",
+		DisplayName:  "Mock",
+		IssuerURL:    mock.server.URL,
+		ClientID:     mockOIDCClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/api/auth/oidc/mock/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+		AllowSignup:  true,
+		LinkByEmail:  true,
+	}
+	setupTestConfig(t, func(c *Config) {
+		c.OIDCProviders = []OIDCProviderConfig{provider}
+	})
+	return mock
+}
+
+// startOIDCLogin calls the login handler and returns the state cookie and the
+// provider's redirect back to the callback
+func startOIDCLogin(t *testing.T, router http.Handler) (*http.Cookie, *url.URL) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/mock/login?redirect=/spaces", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d %s", w.Code, w.Body.String())
+	}
+
+	var stateCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookieName {
+			stateCookie = c
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("login did not set the state cookie")
+	}
+
+	// Follow the redirect to the provider, which sends the browser straight back
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("authorization request: got %d", response.StatusCode)
+	}
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid callback URL: %v", err)
+	}
+	return stateCookie, callback
+}
+
+// finishOIDCLogin calls the callback handler and returns the redirect it answered with
+func finishOIDCLogin(t *testing.T, router http.Handler, stateCookie *http.Cookie, callback *url.URL) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if stateCookie != nil {
+		r.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: got %d %s", w.Code, w.Body.String())
+	}
+	return w
+}
+
+// loginError returns the error code of a redirect to the client's login page, or "" if there is none
+func loginError(w *httptest.ResponseRecorder) string {
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		return ""
+	}
+	return location.Query().Get("error")
+}
+
+// deleteUserByEmail removes a user provisioned during a test
+func deleteUserByEmail(t *testing.T, email string) {
+	t.Cleanup(func() {
+		db.DB.Exec(`DELETE FROM users WHERE email = $1`, email)
+	})
+}
+
+// identityOwner returns the user an external identity is linked to, or uuid.Nil
+func identityOwner(t *testing.T, subject string) uuid.UUID {
+	t.Helper()
+
+	var userID uuid.UUID
+	err := db.DB.QueryRow(`SELECT user_id FROM user_identities WHERE provider = 'mock' AND subject = $1`, subject).Scan(&userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("failed to read identity: %v", err)
+	}
+	return userID
+}
+
+func TestOIDCLoginProvisionsNewUser(t *testing.T) {
+	testutil.SetupDB(t)
+	mock := setupOIDC(t)
+	router := oidcTestRouter()
+
+	subject := uuid.New().String()
+	email := "sso_" + subject[:8] + "@example.com"
+	deleteUserByEmail(t, email)
+	mock.setIdentity(subject, email, true)
+
+	stateCookie, callback := startOIDCLogin(t, router)
+	w := finishOIDCLogin(t, router, stateCookie, callback)
+
+	if location := w.Header().Get("Location"); location != cfg.AppBaseURL+"/spaces" {
+		t.Fatalf("callback redirected to %q, want the requested client path", location)
+	}
+	hasSession := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == AuthCookieName && c.Value != "" {
+			hasSession = true
+		}
+	}
+	if !hasSession {
+		t.Error("callback did not start a session")
+	}
+
+	user, err := getUserByEmail(email)
+	if err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if !user.IsEmailVerified {
+		t.Error("provisioned user's email should be verified")
+	}
+	if owner := identityOwner(t, subject); owner != user.ID {
+		t.Errorf("identity is linked to %s, want %s", owner, user.ID)
+	}
+
+	// The next login finds the linked user instead of provisioning another
+	stateCookie, callback = startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "" {
+		t.Fatalf("second login failed with %q", code)
+	}
+	var count int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE email = $1`, email).Scan(&count)
+	if count != 1 {
+		t.Errorf("found %d users for the identity, want 1", count)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	testutil.SetupDB(t)
+	mock := setupOIDC(t)
+	router := oidcTestRouter()
+
+	subject := uuid.New().String()
+	email := "sso_" + subject[:8] + "@example.com"
+	deleteUserByEmail(t, email)
+	mock.setIdentity(subject, email, true)
+
+	// Without the cookie from the browser that started the login
+	_, callback := startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, nil, callback)); code != "sso_invalid_state" {
+		t.Errorf("callback without the state cookie: got error %q, want sso_invalid_state", code)
+	}
+
+	// With the cookie of a different login
+	otherCookie, _ := startOIDCLogin(t, router)
+	_, callback = startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, otherCookie, callback)); code != "sso_invalid_state" {
+		t.Errorf("callback with another login's state cookie: got error %q, want sso_invalid_state", code)
+	}
+
+	// A state can only be used once
+	stateCookie, callback := startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "" {
+		t.Fatalf("login failed with %q", code)
+	}
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "sso_expired" {
+		t.Errorf("replayed callback: got error %q, want sso_expired", code)
+	}
+}
+
+func TestOIDCCallbackChecksNonceAndPKCE(t *testing.T) {
+	testutil.SetupDB(t)
+	mock := setupOIDC(t)
+	router := oidcTestRouter()
+
+	subject := uuid.New().String()
+	email := "sso_" + subject[:8] + "@example.com"
+	deleteUserByEmail(t, email)
+	mock.setIdentity(subject, email, true)
+
+	// An ID token issued for a different login
+	mock.mu.Lock()
+	mock.nonceOverride = "some-other-nonce"
+	mock.mu.Unlock()
+	stateCookie, callback := startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "sso_failed" {
+		t.Errorf("ID token with the wrong nonce: got error %q, want sso_failed", code)
+	}
+	mock.mu.Lock()
+	mock.nonceOverride = ""
+	mock.mu.Unlock()
+
+	// A code verifier that doesn't match the challenge sent to the provider
+	stateCookie, callback = startOIDCLogin(t, router)
+	_, err := db.DB.Exec(`UPDATE oidc_auth_requests SET code_verifier = $1 WHERE state_hash = $2`,
+		"a-verifier-that-does-not-match-the-challenge-sent-to-the-provider", HashToken(stateCookie.Value))
+	if err != nil {
+		t.Fatalf("failed to change the code verifier: %v", err)
+	}
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "sso_failed" {
+		t.Errorf("wrong code verifier: got error %q, want sso_failed", code)
+	}
+
+	if _, err := getUserByEmail(email); err == nil {
+		t.Error("a user was provisioned by a failed login")
+	}
+}
+
+func TestOIDCLinksExistingUserByVerifiedEmail(t *testing.T) {
+	testutil.SetupDB(t)
+	mock := setupOIDC(t)
+	router := oidcTestRouter()
+
+	user := testutil.CreateUser(t)
+	subject := uuid.New().String()
+	mock.setIdentity(subject, user.Email, true)
+
+	stateCookie, callback := startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "" {
+		t.Fatalf("login failed with %q", code)
+	}
+	if owner := identityOwner(t, subject); owner != user.ID {
+		t.Errorf("identity is linked to %s, want the existing user %s", owner, user.ID)
+	}
+}
+
+func TestOIDCDoesNotLinkUnverifiedEmail(t *testing.T) {
+	testutil.SetupDB(t)
+	mock := setupOIDC(t)
+	router := oidcTestRouter()
+
+	user := testutil.CreateUser(t)
+	subject := uuid.New().String()
+	mock.setIdentity(subject, user.Email, false)
+
+	// Signing up would need the same email, so the login fails instead of taking over the account
+	stateCookie, callback := startOIDCLogin(t, router)
+	if code := loginError(finishOIDCLogin(t, router, stateCookie, callback)); code != "sso_failed" {
+		t.Errorf("login with an unverified email of an existing user: got error %q, want sso_failed", code)
+	}
+	if owner := identityOwner(t, subject); owner != uuid.Nil {
+		t.Errorf("identity was linked to %s", owner)
+	}
+}
@@ -0,0 +1,534 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+// Ceremony kinds stored in webauthn_ceremonies
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// ErrCeremonyNotFound is returned when a WebAuthn ceremony is unknown, expired or already finished
+var ErrCeremonyNotFound = errors.New("passkey ceremony not found")
+
+// webAuthn is the relying party configured by Init
+var webAuthn *webauthn.WebAuthn
+
+// initWebAuthn configures the WebAuthn relying party
+func initWebAuthn(config Config) error {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          config.WebAuthnRPID,
+		RPDisplayName: config.WebAuthnRPName,
+		RPOrigins:     config.WebAuthnRPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: config.WebAuthnTimeout, TimeoutUVD: config.WebAuthnTimeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: config.WebAuthnTimeout, TimeoutUVD: config.WebAuthnTimeout},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	webAuthn = w
+	return nil
+}
+
+// webAuthnUser adapts a user and their passkeys to the webauthn.User interface
+type webAuthnUser struct {
+	user     models.User
+	passkeys []models.Passkey
+}
+
+// WebAuthnID returns the user handle, which is the user's UUID
+func (u webAuthnUser) WebAuthnID() []byte {
+	id := u.user.ID
+	return id[:]
+}
+
+// WebAuthnName returns the account name shown by the authenticator
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+// WebAuthnDisplayName returns the friendly name shown by the authenticator
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+// WebAuthnCredentials returns the user's registered credentials
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, p := range u.passkeys {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(p.Transports))
+		for _, t := range p.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              p.CredentialID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(p.Flags)),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       p.AAGUID,
+				SignCount:    p.SignCount,
+				CloneWarning: p.CloneWarning,
+			},
+		})
+	}
+	return credentials
+}
+
+// loadWebAuthnUser fetches a user together with their passkeys
+func loadWebAuthnUser(user models.User) (webAuthnUser, error) {
+	passkeys, err := listPasskeys(user.ID)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+	return webAuthnUser{user: user, passkeys: passkeys}, nil
+}
+
+// listPasskeys returns a user's passkeys, oldest first
+func listPasskeys(userID uuid.UUID) ([]models.Passkey, error) {
+	rows, err := db.DB.Query(`SELECT id, user_id, name, credential_id, public_key, COALESCE(attestation_type, ''),
+			aaguid, sign_count, COALESCE(transports, ''), flags, clone_warning, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []models.Passkey{}
+	for rows.Next() {
+		var p models.Passkey
+		var transports string
+		var signCount int64
+		err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.CredentialID, &p.PublicKey, &p.AttestationType,
+			&p.AAGUID, &signCount, &transports, &p.Flags, &p.CloneWarning, &p.CreatedAt, &p.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		p.SignCount = uint32(signCount)
+		p.Transports = []string{}
+		if transports != "" {
+			p.Transports = strings.Split(transports, ",")
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// saveCeremony stores the state of a started ceremony and returns its ID
+func saveCeremony(kind string, userID *uuid.UUID, session *webauthn.SessionData) (uuid.UUID, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	id := uuid.New()
+	now := db.CurrentTime()
+	_, err = db.DB.Exec(`INSERT INTO webauthn_ceremonies (id, user_id, kind, session_data, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, id, userID, kind, data, now.Add(cfg.WebAuthnTimeout))
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// Clean up abandoned ceremonies
+	db.DB.Exec(`DELETE FROM webauthn_ceremonies WHERE expires_at <= $1`, now)
+
+	return id, nil
+}
+
+// consumeCeremony deletes a ceremony and returns its state, so every ceremony can finish only once
+func consumeCeremony(id uuid.UUID, kind string) (webauthn.SessionData, *uuid.UUID, error) {
+	var data []byte
+	var userID *uuid.UUID
+	err := db.DB.QueryRow(`DELETE FROM webauthn_ceremonies
+		WHERE id = $1 AND kind = $2 AND expires_at > $3
+		RETURNING user_id, session_data`, id, kind, db.CurrentTime()).Scan(&userID, &data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return webauthn.SessionData{}, nil, ErrCeremonyNotFound
+		}
+		return webauthn.SessionData{}, nil, err
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(data, &session); err != nil {
+		return webauthn.SessionData{}, nil, err
+	}
+
+	return session, userID, nil
+}
+
+// PasskeyRegisterBeginHandler starts registering a new passkey for the current user
+func PasskeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to load passkeys")
+		return
+	}
+
+	// Excluding existing credentials stops the same authenticator being registered twice
+	creation, session, err := webAuthn.BeginRegistration(wu,
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start passkey registration")
+		return
+	}
+
+	ceremonyID, err := saveCeremony(ceremonyRegistration, &user.ID, session)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start passkey registration")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: models.PasskeyCeremonyResponse{
+			CeremonyID: ceremonyID,
+			Options:    creation,
+		},
+	})
+}
+
+// PasskeyRegisterFinishHandler verifies the authenticator's response and stores the new passkey
+func PasskeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.FinishPasskeyRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	session, ceremonyUserID, err := consumeCeremony(req.CeremonyID, ceremonyRegistration)
+	if err != nil || ceremonyUserID == nil || *ceremonyUserID != user.ID {
+		RespondWithError(w, http.StatusBadRequest, "Passkey registration expired, please try again")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to load passkeys")
+		return
+	}
+
+	credential, err := webAuthn.CreateCredential(wu, session, parsed)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Passkey verification failed")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	passkey := models.Passkey{
+		ID:              uuid.New(),
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      transports,
+		Flags:           uint8(credential.Flags.ProtocolValue()),
+		CreatedAt:       db.CurrentTime(),
+	}
+
+	_, err = db.DB.Exec(`INSERT INTO webauthn_credentials
+		(id, user_id, name, credential_id, public_key, attestation_type, aaguid, sign_count, transports, flags, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		passkey.ID, passkey.UserID, passkey.Name, passkey.CredentialID, passkey.PublicKey, passkey.AttestationType,
+		passkey.AAGUID, int64(passkey.SignCount), strings.Join(transports, ","), int16(passkey.Flags), passkey.CreatedAt)
+	if err != nil {
+		RespondWithError(w, http.StatusConflict, "This passkey is already registered")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Passkey registered",
+		Data:    passkey.ToResponse(),
+	})
+}
+
+// PasskeysHandler lists the current user's passkeys
+func PasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	passkeys, err := listPasskeys(user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to list passkeys")
+		return
+	}
+
+	response := make([]models.PasskeyResponse, 0, len(passkeys))
+	for _, p := range passkeys {
+		response = append(response, p.ToResponse())
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    response,
+	})
+}
+
+// PasskeyHandler deletes one of the current user's passkeys.
+// The passkey ID comes from the {id} path wildcard.
+func PasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	passkeyID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid passkey ID")
+		return
+	}
+
+	result, err := db.DB.Exec(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, passkeyID, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to delete passkey")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		RespondWithError(w, http.StatusNotFound, "Passkey not found")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Passkey deleted",
+	})
+}
+
+// PasskeyLoginBeginHandler starts a passkey login.
+// With an email the browser is asked for that account's passkeys, otherwise
+// it offers any passkey it holds for this site (discoverable login).
+func PasskeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.BeginPasskeyLoginRequest
+	if r.ContentLength != 0 {
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	var err error
+
+	// Unknown emails fall back to a discoverable login so the response doesn't reveal which accounts exist
+	var wu webAuthnUser
+	if req.Email != "" {
+		if user, lookupErr := getUserByEmail(req.Email); lookupErr == nil {
+			wu, err = loadWebAuthnUser(user)
+			if err != nil {
+				RespondWithError(w, http.StatusInternalServerError, "Failed to start passkey login")
+				return
+			}
+		}
+	}
+
+	if len(wu.passkeys) > 0 {
+		assertion, session, err = webAuthn.BeginLogin(wu)
+	} else {
+		assertion, session, err = webAuthn.BeginDiscoverableLogin()
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start passkey login")
+		return
+	}
+
+	ceremonyID, err := saveCeremony(ceremonyLogin, nil, session)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start passkey login")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: models.PasskeyCeremonyResponse{
+			CeremonyID: ceremonyID,
+			Options:    assertion,
+		},
+	})
+}
+
+// PasskeyLoginFinishHandler verifies a passkey assertion and signs the user in
+// with the same tokens and cookies as a password login
+func PasskeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.FinishPasskeyRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	session, _, err := consumeCeremony(req.CeremonyID, ceremonyLogin)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Passkey login expired, please try again")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	var wu webAuthnUser
+	var credential *webauthn.Credential
+	if len(session.UserID) > 0 {
+		userID, err := uuid.FromBytes(session.UserID)
+		if err != nil {
+			RespondWithError(w, http.StatusUnauthorized, "Passkey verification failed")
+			return
+		}
+		wu, err = lookupWebAuthnUser(userID)
+		if err != nil {
+			RespondWithError(w, http.StatusUnauthorized, "Passkey verification failed")
+			return
+		}
+		credential, err = webAuthn.ValidateLogin(wu, session, parsed)
+		if err != nil {
+			RespondWithError(w, http.StatusUnauthorized, "Passkey verification failed")
+			return
+		}
+	} else {
+		credential, err = webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			userID, err := uuid.FromBytes(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			wu, err = lookupWebAuthnUser(userID)
+			return wu, err
+		}, session, parsed)
+		if err != nil {
+			RespondWithError(w, http.StatusUnauthorized, "Passkey verification failed")
+			return
+		}
+	}
+
+	// A signature counter that didn't increase suggests a cloned authenticator.
+	// The passkey is flagged and can't be used again until it is registered anew.
+	if credential.Authenticator.CloneWarning {
+		if _, err := db.DB.Exec(`UPDATE webauthn_credentials SET clone_warning = TRUE WHERE credential_id = $1`, credential.ID); err != nil {
+			log.Printf("Failed to flag cloned passkey: %v", err)
+		}
+		RespondWithError(w, http.StatusUnauthorized, "Passkey verification failed")
+		return
+	}
+
+	// Record the new signature counter
+	_, err = db.DB.Exec(`UPDATE webauthn_credentials SET sign_count = $1, last_used_at = $2 WHERE credential_id = $3`,
+		int64(credential.Authenticator.SignCount), db.CurrentTime(), credential.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to update passkey")
+		return
+	}
+
+	user := wu.user
+
+	// Enforce the email verification policy
+	if !user.IsEmailVerified && cfg.EmailVerificationPolicy == VerificationPolicyBlock {
+		RespondWithError(w, http.StatusForbidden, "Please verify your email address before logging in")
+		return
+	}
+
+	// A user-verified passkey is already multi-factor, so no TOTP challenge is needed
+	issueSession(w, r, user)
+}
+
+// lookupWebAuthnUser fetches a user by ID together with their passkeys
+func lookupWebAuthnUser(userID uuid.UUID) (webAuthnUser, error) {
+	user, err := getUserByID(userID)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+	return loadWebAuthnUser(user)
+}
@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/testutil"
+)
+
+// testOrigin is the web client origin the software authenticator claims to run on
+const testOrigin = "http://localhost:3000"
+
+// setupTestConfig initializes the package with a development configuration,
+// changed by configure if it isn't nil
+func setupTestConfig(t *testing.T, configure func(*Config)) {
+	t.Helper()
+
+	config, err := DefaultConfig()
+	if err != nil {
+		t.Fatalf("invalid environment: %v", err)
+	}
+	config.Environment = "development"
+	config.JWTAlgorithm = AlgorithmHS256
+	config.JWTSecret = "test-secret"
+	config.LoginAttemptStore = AttemptStoreMemory
+	config.EmailVerificationPolicy = VerificationPolicyNone
+	config.MFARequired = false
+	config.AppBaseURL = testOrigin
+	config.WebAuthnRPID = "localhost"
+	config.WebAuthnRPOrigins = []string{testOrigin}
+	config.OIDCProviders = nil
+	if configure != nil {
+		configure(&config)
+	}
+
+	previous := cfg
+	if err := Init(config); err != nil {
+		t.Fatalf("failed to initialize auth: %v", err)
+	}
+	t.Cleanup(func() { cfg = previous })
+}
+
+// callHandler sends a POST with a JSON body to a handler, as the user if one is given
+func callHandler(t *testing.T, handler http.HandlerFunc, user *models.User, body interface{}) (int, testutil.Response) {
+	t.Helper()
+
+	r := testutil.NewRequest(t, http.MethodPost, "/", body)
+	if user != nil {
+		principal := &Principal{UserID: user.ID, Email: user.Email, Method: AuthMethodSession, User: *user}
+		r = r.WithContext(WithPrincipal(context.Background(), principal))
+	}
+	return testutil.Serve(t, handler, r)
+}
+
+// softAuthenticator is a passkey held in memory. It answers registration and
+// login ceremonies like a platform authenticator that verified the user.
+type softAuthenticator struct {
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{credentialID: credentialID, key: key}
+}
+
+// ceremonyOptions are the parts of the creation and request options the authenticator uses
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge protocol.URLEncodedBase64 `json:"challenge"`
+		RPID      string                    `json:"rpId"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID protocol.URLEncodedBase64 `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+// begin decodes the options from a begin handler's response
+func (a *softAuthenticator) begin(t *testing.T, response testutil.Response) (uuid.UUID, ceremonyOptions) {
+	t.Helper()
+
+	var data struct {
+		CeremonyID uuid.UUID       `json:"ceremony_id"`
+		Options    ceremonyOptions `json:"options"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatalf("failed to decode ceremony: %v", err)
+	}
+	return data.CeremonyID, data.Options
+}
+
+// clientData builds the clientDataJSON the browser would send
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": protocol.URLEncodedBase64(challenge).String(),
+		"origin":    testOrigin,
+	})
+	return data
+}
+
+// authenticatorData builds authenticator data with the user present and verified
+func (a *softAuthenticator) authenticatorData(rpID string, flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, byte(protocol.FlagUserPresent|protocol.FlagUserVerified|flags))
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+// create answers navigator.credentials.create() with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, options ceremonyOptions) json.RawMessage {
+	t.Helper()
+
+	a.userHandle = options.PublicKey.User.ID
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+
+	authData := a.authenticatorData(options.PublicKey.RP.ID, protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode attestation: %v", err)
+	}
+
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    protocol.URLEncodedBase64(a.credentialID).String(),
+		"rawId": protocol.URLEncodedBase64(a.credentialID).String(),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    protocol.URLEncodedBase64(a.clientData("webauthn.create", options.PublicKey.Challenge)).String(),
+			"attestationObject": protocol.URLEncodedBase64(attestation).String(),
+			"transports":        []string{"internal"},
+		},
+	})
+	return credential
+}
+
+// get answers navigator.credentials.get() by signing the challenge
+func (a *softAuthenticator) get(t *testing.T, options ceremonyOptions) json.RawMessage {
+	t.Helper()
+
+	clientData := a.clientData("webauthn.get", options.PublicKey.Challenge)
+	authData := a.authenticatorData(options.PublicKey.RPID, 0)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    protocol.URLEncodedBase64(a.credentialID).String(),
+		"rawId": protocol.URLEncodedBase64(a.credentialID).String(),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    protocol.URLEncodedBase64(clientData).String(),
+			"authenticatorData": protocol.URLEncodedBase64(authData).String(),
+			"signature":         protocol.URLEncodedBase64(signature).String(),
+			"userHandle":        protocol.URLEncodedBase64(a.userHandle).String(),
+		},
+	})
+	return credential
+}
+
+// registerPasskey registers the authenticator for a user through the handlers
+func registerPasskey(t *testing.T, user models.User, a *softAuthenticator) {
+	t.Helper()
+
+	status, response := callHandler(t, PasskeyRegisterBeginHandler, &user, nil)
+	if status != http.StatusOK {
+		t.Fatalf("register begin: got %d %q", status, response.Error)
+	}
+	ceremonyID, options := a.begin(t, response)
+
+	status, response = callHandler(t, PasskeyRegisterFinishHandler, &user, models.FinishPasskeyRequest{
+		CeremonyID: ceremonyID,
+		Name:       "Test key",
+		Credential: a.create(t, options),
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("register finish: got %d %q", status, response.Error)
+	}
+}
+
+// beginPasskeyLogin starts a login for an email, or a discoverable login without one
+func beginPasskeyLogin(t *testing.T, a *softAuthenticator, email string) (uuid.UUID, ceremonyOptions) {
+	t.Helper()
+
+	status, response := callHandler(t, PasskeyLoginBeginHandler, nil, models.BeginPasskeyLoginRequest{Email: email})
+	if status != http.StatusOK {
+		t.Fatalf("login begin: got %d %q", status, response.Error)
+	}
+	return a.begin(t, response)
+}
+
+// finishPasskeyLogin signs a login ceremony with the authenticator
+func finishPasskeyLogin(t *testing.T, a *softAuthenticator, ceremonyID uuid.UUID, options ceremonyOptions) (int, testutil.Response) {
+	t.Helper()
+
+	a.signCount++
+	return callHandler(t, PasskeyLoginFinishHandler, nil, models.FinishPasskeyRequest{
+		CeremonyID: ceremonyID,
+		Credential: a.get(t, options),
+	})
+}
+
+func TestPasskeyRegisterThenLogin(t *testing.T) {
+	testutil.SetupDB(t)
+	setupTestConfig(t, nil)
+
+	user := testutil.CreateUser(t)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, user, a)
+
+	for _, email := range []string{user.Email, ""} {
+		ceremonyID, options := beginPasskeyLogin(t, a, email)
+		status, response := finishPasskeyLogin(t, a, ceremonyID, options)
+		if status != http.StatusOK {
+			t.Fatalf("login with email %q: got %d %q", email, status, response.Error)
+		}
+
+		var login LoginResponse
+		if err := json.Unmarshal(response.Data, &login); err != nil {
+			t.Fatalf("failed to decode login response: %v", err)
+		}
+		if login.Token == "" || login.User.ID != user.ID {
+			t.Errorf("login with email %q: got token %q for user %s, want a token for %s", email, login.Token, login.User.ID, user.ID)
+		}
+	}
+
+	var signCount int64
+	if err := db.DB.QueryRow(`SELECT sign_count FROM webauthn_credentials WHERE credential_id = $1`, a.credentialID).Scan(&signCount); err != nil {
+		t.Fatalf("failed to read sign count: %v", err)
+	}
+	if signCount != int64(a.signCount) {
+		t.Errorf("stored sign count is %d, want %d", signCount, a.signCount)
+	}
+}
+
+func TestPasskeyLoginRejectsSignCountRegression(t *testing.T) {
+	testutil.SetupDB(t)
+	setupTestConfig(t, nil)
+
+	user := testutil.CreateUser(t)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, user, a)
+
+	a.signCount = 10
+	ceremonyID, options := beginPasskeyLogin(t, a, user.Email)
+	if status, response := finishPasskeyLogin(t, a, ceremonyID, options); status != http.StatusOK {
+		t.Fatalf("first login: got %d %q", status, response.Error)
+	}
+
+	// A clone of the authenticator still has an older counter
+	a.signCount = 5
+	ceremonyID, options = beginPasskeyLogin(t, a, user.Email)
+	if status, _ := finishPasskeyLogin(t, a, ceremonyID, options); status != http.StatusUnauthorized {
+		t.Errorf("login with a lower sign count: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	var cloneWarning bool
+	if err := db.DB.QueryRow(`SELECT clone_warning FROM webauthn_credentials WHERE credential_id = $1`, a.credentialID).Scan(&cloneWarning); err != nil {
+		t.Fatalf("failed to read clone warning: %v", err)
+	}
+	if !cloneWarning {
+		t.Error("passkey was not flagged as cloned")
+	}
+
+	// The flagged passkey stays unusable, even with a higher counter
+	a.signCount = 20
+	ceremonyID, options = beginPasskeyLogin(t, a, user.Email)
+	if status, _ := finishPasskeyLogin(t, a, ceremonyID, options); status != http.StatusUnauthorized {
+		t.Errorf("login with a flagged passkey: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestPasskeyCeremonyCannotBeReused(t *testing.T) {
+	testutil.SetupDB(t)
+	setupTestConfig(t, nil)
+
+	user := testutil.CreateUser(t)
+	a := newSoftAuthenticator(t)
+	registerPasskey(t, user, a)
+
+	ceremonyID, options := beginPasskeyLogin(t, a, user.Email)
+	if status, response := finishPasskeyLogin(t, a, ceremonyID, options); status != http.StatusOK {
+		t.Fatalf("first login: got %d %q", status, response.Error)
+	}
+	if status, _ := finishPasskeyLogin(t, a, ceremonyID, options); status != http.StatusBadRequest {
+		t.Errorf("reusing the login ceremony: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// The same goes for registration
+	status, response := callHandler(t, PasskeyRegisterBeginHandler, &user, nil)
+	if status != http.StatusOK {
+		t.Fatalf("register begin: got %d %q", status, response.Error)
+	}
+	second := newSoftAuthenticator(t)
+	ceremonyID, options = second.begin(t, response)
+	request := models.FinishPasskeyRequest{CeremonyID: ceremonyID, Credential: second.create(t, options)}
+	if status, response := callHandler(t, PasskeyRegisterFinishHandler, &user, request); status != http.StatusCreated {
+		t.Fatalf("register finish: got %d %q", status, response.Error)
+	}
+	if status, _ := callHandler(t, PasskeyRegisterFinishHandler, &user, request); status != http.StatusBadRequest {
+		t.Errorf("reusing the registration ceremony: got %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestPasskeyCeremonyIsBoundToItsUser(t *testing.T) {
+	testutil.SetupDB(t)
+	setupTestConfig(t, nil)
+
+	alice := testutil.CreateUser(t)
+	bob := testutil.CreateUser(t)
+	alicesKey := newSoftAuthenticator(t)
+	bobsKey := newSoftAuthenticator(t)
+	registerPasskey(t, alice, alicesKey)
+	registerPasskey(t, bob, bobsKey)
+
+	// Bob can't finish a registration Alice started
+	status, response := callHandler(t, PasskeyRegisterBeginHandler, &alice, nil)
+	if status != http.StatusOK {
+		t.Fatalf("register begin: got %d %q", status, response.Error)
+	}
+	extra := newSoftAuthenticator(t)
+	ceremonyID, options := extra.begin(t, response)
+	status, _ = callHandler(t, PasskeyRegisterFinishHandler, &bob, models.FinishPasskeyRequest{
+		CeremonyID: ceremonyID,
+		Credential: extra.create(t, options),
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("finishing another user's registration: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// A login challenge issued for Alice can't be answered with Bob's passkey
+	ceremonyID, options = beginPasskeyLogin(t, bobsKey, alice.Email)
+	if status, _ := finishPasskeyLogin(t, bobsKey, ceremonyID, options); status != http.StatusUnauthorized {
+		t.Errorf("finishing another user's login: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/mailer"
+	"github.com/gotext/server/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ForgotPasswordHandler emails a password reset link.
+// The response never reveals whether the email is registered.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the request body
+	var req models.ForgotPasswordRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if user, err := getUserByEmail(req.Email); err == nil {
+		if err := sendPasswordResetEmail(user); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "If an account exists for that email, a password reset link has been sent.",
+	})
+}
+
+// ResetPasswordHandler sets a new password using a reset token
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the request body
+	var req models.ResetPasswordRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	// Hash the new password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to process password")
+		return
+	}
+
+	userID, err := resetPassword(HashToken(req.Token), string(hashedPassword))
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid or expired reset token")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	// Proving control of the email address also lifts any lockout
+	if err := UnlockAccount(userID, nil, ClientIP(r), "password_reset"); err != nil {
+		log.Printf("Failed to unlock account after password reset: %v", err)
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Password has been reset. Please log in with your new password.",
+	})
+}
+
+// resetPassword consumes a reset token, updates the password of the user it belongs to
+// and revokes all of their sessions. It returns the user's ID.
+func resetPassword(tokenHash, passwordHash string) (uuid.UUID, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	// Deleting the token makes it single-use even under concurrent requests
+	var userID uuid.UUID
+	err = tx.QueryRow(`DELETE FROM password_reset_tokens
+		WHERE token = $1 AND expires_at > $2
+		RETURNING user_id`, tokenHash, db.CurrentTime()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrInvalidToken
+		}
+		return uuid.Nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET password_hash = $1, password_changed_at = $2 WHERE id = $3`,
+		passwordHash, db.CurrentTime(), userID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// Any other outstanding reset links for this user are no longer needed
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	// Sign the user out everywhere
+	if _, err := tx.Exec(`DELETE FROM session_tokens WHERE user_id = $1`, userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// sendPasswordResetEmail issues a reset token for the user and emails the reset link
+func sendPasswordResetEmail(user models.User) error {
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the most recent reset link stays valid
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = $1`, user.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO password_reset_tokens (id, user_id, token, expires_at) VALUES ($1, $2, $3, $4)`,
+		uuid.New(), user.ID, HashToken(token), db.CurrentTime().Add(cfg.PasswordResetTTL))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := cfg.AppBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your GoText password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your GoText account. "+
+			"Open the link below to choose a new password:\n\n%s\n\n"+
+			"This link expires in %s and can only be used once. If you did not ask for a reset you can ignore this email.\n",
+			user.Username, link, formatDuration(cfg.PasswordResetTTL)),
+	})
+}
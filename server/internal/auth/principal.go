@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/models"
+)
+
+// AuthMethod is the kind of credential a request was authenticated with
+type AuthMethod string
+
+const (
+	// AuthMethodSession is a JWT access token belonging to a login session
+	AuthMethodSession AuthMethod = "session"
+	// AuthMethodPersonalAccessToken is a scoped personal access token
+	AuthMethodPersonalAccessToken AuthMethod = "personal_access_token"
+)
+
+// CredentialSource is where in the request the credential was found
+type CredentialSource string
+
+const (
+	// CredentialSourceCookie means the credential came from a cookie the browser sends automatically
+	CredentialSourceCookie CredentialSource = "cookie"
+	// CredentialSourceHeader means the credential came from the Authorization header
+	CredentialSourceHeader CredentialSource = "header"
+)
+
+// ErrNoCredentials is returned by a CredentialResolver when the request doesn't
+// carry the kind of credential it handles
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// Principal is the authenticated identity behind a request
+type Principal struct {
+	UserID uuid.UUID
+	Email  string
+	// Roles are the user's server-level roles
+	Roles []string
+	// TokenID is the session ID for session tokens or the token ID for personal access tokens
+	TokenID uuid.UUID
+	Method  AuthMethod
+	Source  CredentialSource
+	// Scopes limit what a personal access token may do. Sessions have no scopes and full access.
+	Scopes []string
+	// User is the user as loaded during authentication
+	User models.User
+}
+
+// HasScope reports whether the principal may use a route that requires the scope
+func (p *Principal) HasScope(scope string) bool {
+	if p.Method != AuthMethodPersonalAccessToken {
+		return true
+	}
+	return HasScope(p.Scopes, scope)
+}
+
+// IsSession reports whether the principal authenticated with a login session
+func (p *Principal) IsSession() bool {
+	return p.Method == AuthMethodSession
+}
+
+// principalKey is the context key for the Principal
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by the auth middleware
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// UserFromContext returns the authenticated user stored by the auth middleware
+func UserFromContext(ctx context.Context) (models.User, bool) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return models.User{}, false
+	}
+	return principal.User, true
+}
+
+// CredentialResolver turns one kind of credential in a request into a Principal.
+// It returns ErrNoCredentials if the request doesn't carry that kind of credential.
+type CredentialResolver func(r *http.Request) (*Principal, error)
+
+// credentialResolvers are tried in order by Authenticate. The Authorization header
+// comes first: a browser never adds it on its own, so a request carrying it doesn't
+// need CSRF protection even if it also has the auth cookie.
+var credentialResolvers = []CredentialResolver{
+	resolveBearerToken,
+	resolveSessionCookie,
+}
+
+// RegisterCredentialResolver adds a resolver for a new kind of credential.
+// It is tried after the built-in ones. Call it before the server starts.
+func RegisterCredentialResolver(resolver CredentialResolver) {
+	credentialResolvers = append(credentialResolvers, resolver)
+}
+
+// Authenticate finds the principal behind the request's credentials. Each resolver
+// is tried in turn and the first one that succeeds wins; if none does, the error
+// from the first credential that was present but invalid is returned.
+func Authenticate(r *http.Request) (*Principal, error) {
+	var firstErr error
+	for _, resolve := range credentialResolvers {
+		principal, err := resolve(r)
+		if err == nil {
+			return principal, nil
+		}
+		if firstErr == nil && !errors.Is(err, ErrNoCredentials) {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = ErrNoCredentials
+	}
+	return nil, firstErr
+}
+
+// resolveSessionCookie authenticates the access token in the auth cookie
+func resolveSessionCookie(r *http.Request) (*Principal, error) {
+	cookie, err := r.Cookie(AuthCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoCredentials
+	}
+
+	return authenticateSessionToken(cookie.Value, CredentialSourceCookie)
+}
+
+// resolveBearerToken authenticates a JWT access token or personal access token
+// in the Authorization header
+func resolveBearerToken(r *http.Request) (*Principal, error) {
+	if r.Header.Get("Authorization") == "" {
+		return nil, ErrNoCredentials
+	}
+
+	token, err := ExtractTokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsPersonalAccessToken(token) {
+		return AuthenticatePersonalAccessToken(token)
+	}
+	return authenticateSessionToken(token, CredentialSourceHeader)
+}
+
+// authenticateSessionToken builds the principal for a session access token
+func authenticateSessionToken(token string, source CredentialSource) (*Principal, error) {
+	user, claims, err := AuthenticateToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Roles:   []string{user.Role},
+		TokenID: sessionID,
+		Method:  AuthMethodSession,
+		Source:  source,
+		User:    user,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown or expired
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// tokenPair holds the tokens issued for a session
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	CSRFToken    string
+}
+
+// loginResponse builds the response body returned when tokens are issued
+func (p tokenPair) loginResponse(user models.User) LoginResponse {
+	return LoginResponse{
+		Token:            p.AccessToken,
+		RefreshToken:     p.RefreshToken,
+		CSRFToken:        p.CSRFToken,
+		ExpiresIn:        int(cfg.AccessTokenTTL.Seconds()),
+		User:             user.ToResponse(),
+		MFASetupRequired: cfg.MFARequired && !user.TOTPEnabled,
+	}
+}
+
+// insertRefreshToken creates a new refresh token for a session and returns it.
+// Only its hash is stored.
+func insertRefreshToken(tx *sql.Tx, sessionID uuid.UUID, now time.Time) (string, error) {
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (id, session_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		uuid.New(), sessionID, HashToken(token), now.Add(cfg.RefreshTokenTTL), now)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new token pair.
+// Every refresh token can be used once. Presenting one that has already been
+// rotated means it was copied, so the whole session (token family) is revoked.
+func rotateRefreshToken(refreshToken string) (tokenPair, models.User, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, sessionID, userID uuid.UUID
+	var usedAt *time.Time
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT rt.id, rt.session_id, rt.used_at, rt.expires_at, s.user_id
+		FROM refresh_tokens rt
+		JOIN session_tokens s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt`, HashToken(refreshToken)).
+		Scan(&tokenID, &sessionID, &usedAt, &expiresAt, &userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return tokenPair{}, models.User{}, ErrInvalidRefreshToken
+		}
+		return tokenPair{}, models.User{}, err
+	}
+
+	now := db.CurrentTime()
+
+	if usedAt != nil {
+		// Deleting the session cascades to every refresh token in the family
+		if _, err := tx.Exec(`DELETE FROM session_tokens WHERE id = $1`, sessionID); err != nil {
+			return tokenPair{}, models.User{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return tokenPair{}, models.User{}, err
+		}
+		log.Printf("Refresh token reuse detected for user %s, revoked session %s", userID, sessionID)
+		return tokenPair{}, models.User{}, ErrRefreshTokenReused
+	}
+
+	if now.After(expiresAt) {
+		return tokenPair{}, models.User{}, ErrInvalidRefreshToken
+	}
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID))
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	// Issue the next token pair in the family
+	accessToken, err := GenerateToken(user, sessionID)
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`, now, tokenID); err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	newRefreshToken, err := insertRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE session_tokens SET token = $1, expires_at = $2, last_used_at = $3 WHERE id = $4`,
+		HashToken(accessToken), now.Add(cfg.RefreshTokenTTL), now, sessionID)
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	csrfToken, err := sessionCSRFToken(sessionID)
+	if err != nil {
+		return tokenPair{}, models.User{}, err
+	}
+
+	return tokenPair{AccessToken: accessToken, RefreshToken: newRefreshToken, CSRFToken: csrfToken}, user, nil
+}
+
+// revokeSessionByRefreshToken deletes the session a refresh token belongs to
+func revokeSessionByRefreshToken(refreshToken string) error {
+	_, err := db.DB.Exec(`DELETE FROM session_tokens
+		WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1)`, HashToken(refreshToken))
+	return err
+}
+
+// RefreshHandler exchanges a refresh token for a new access and refresh token.
+// Browser clients send the refresh token cookie and get new cookies back;
+// other clients send {"refresh_token": "..."} and read the tokens from the response.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get the refresh token from the cookie or the request body
+	var refreshToken string
+	fromCookie := false
+	if cookie, err := r.Cookie(RefreshCookieName); err == nil && cookie.Value != "" {
+		// Cookie-based refreshes must come from our own site
+		if err := CheckOrigin(r); err != nil {
+			RespondWithError(w, http.StatusForbidden, "Request origin not allowed")
+			return
+		}
+		refreshToken = cookie.Value
+		fromCookie = true
+	} else {
+		var req models.RefreshTokenRequest
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+		refreshToken = req.RefreshToken
+	}
+
+	if refreshToken == "" {
+		RespondWithError(w, http.StatusUnauthorized, "Refresh token is required")
+		return
+	}
+
+	tokens, user, err := rotateRefreshToken(refreshToken)
+	if err != nil {
+		if fromCookie {
+			clearAuthCookies(w, r)
+		}
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			RespondWithError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+
+	if fromCookie {
+		setAuthCookies(w, r, tokens)
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    tokens.loginResponse(user),
+	})
+}
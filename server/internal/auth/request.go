@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gotext/server/internal/validation"
+)
+
+// ClientIP returns the IP address of the client that made the request.
+// X-Forwarded-For and X-Real-IP are only trusted when TrustProxyHeaders is enabled,
+// since any client can set them.
+func ClientIP(r *http.Request) string {
+	if cfg.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The left-most address is the original client
+			if ip := strings.TrimSpace(strings.Split(forwarded, ",")[0]); ip != "" {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// extractToken returns the token sent with the request, from the auth cookie or the Authorization header
+func extractToken(r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(AuthCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	return ExtractTokenFromRequest(r)
+}
+
+// DecodeJSON reads a JSON request body into dst and checks it against dst's validate tags.
+// Unknown fields, trailing data and bodies over MaxRequestBodySize are rejected.
+// On failure it writes the error response, with per-field errors where possible,
+// and returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxRequestBodySize)
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		respondWithDecodeError(w, err)
+		return false
+	}
+
+	// The body must hold exactly one JSON value
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithDecodeError(w, err)
+			return false
+		}
+		RespondWithError(w, http.StatusBadRequest, "Request body must contain a single JSON object")
+		return false
+	}
+
+	if err := validation.Validate(dst); err != nil {
+		var fieldErrs validation.Errors
+		if errors.As(err, &fieldErrs) {
+			RespondWithValidationErrors(w, fieldErrs)
+			return false
+		}
+		if errors.Is(err, validation.ErrUnknownRule) {
+			log.Printf("Failed to validate request body: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to validate request")
+			return false
+		}
+		RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+
+	return true
+}
+
+// respondWithDecodeError writes the response for a request body that couldn't be decoded
+func respondWithDecodeError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		RespondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", maxBytesErr.Limit))
+	case errors.Is(err, io.EOF):
+		RespondWithError(w, http.StatusBadRequest, "Request body is required")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		RespondWithError(w, http.StatusBadRequest, "Request body is not valid JSON")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		RespondWithValidationErrors(w, validation.Errors{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Message: "must be " + jsonTypeName(typeErr.Type.Kind().String()),
+		}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		RespondWithValidationErrors(w, validation.Errors{{
+			Field:   field,
+			Rule:    "unknown",
+			Message: "is not a recognized field",
+		}})
+	default:
+		RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+	}
+}
+
+// jsonTypeName describes a Go kind in JSON terms for error messages
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "string":
+		return "a string"
+	case "bool":
+		return "a boolean"
+	case "slice", "array":
+		return "an array"
+	case "struct", "map":
+		return "an object"
+	default:
+		if strings.HasPrefix(kind, "int") || strings.HasPrefix(kind, "uint") || strings.HasPrefix(kind, "float") {
+			return "a number"
+		}
+		return "a " + kind
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gotext/server/internal/validation"
+)
+
+// Scopes that can be granted to personal access tokens.
+// Within a resource, admin implies write and write implies read.
+const (
+	ScopeProfileRead   = "profile:read"
+	ScopeSpacesRead    = "spaces:read"
+	ScopeSpacesWrite   = "spaces:write"
+	ScopeSpacesAdmin   = "spaces:admin"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+// validScopes lists every scope a token can be granted
+var validScopes = map[string]bool{
+	ScopeProfileRead:   true,
+	ScopeSpacesRead:    true,
+	ScopeSpacesWrite:   true,
+	ScopeSpacesAdmin:   true,
+	ScopeMessagesRead:  true,
+	ScopeMessagesWrite: true,
+}
+
+// scopeLevels orders the access levels of a resource
+var scopeLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+func init() {
+	// Lets request structs check scope lists with validate:"scopes"
+	validation.RegisterRule("scopes", func(v reflect.Value, _ string) bool {
+		if v.Kind() != reflect.Slice {
+			return false
+		}
+		for i := 0; i < v.Len(); i++ {
+			if v.Index(i).Kind() != reflect.String || !IsValidScope(v.Index(i).String()) {
+				return false
+			}
+		}
+		return true
+	}, "contains an unknown scope")
+}
+
+// IsValidScope reports whether a scope can be granted to a token
+func IsValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// HasScope reports whether the granted scopes allow the required scope
+func HasScope(granted []string, required string) bool {
+	resource, level, ok := strings.Cut(required, ":")
+	if !ok {
+		return false
+	}
+
+	for _, g := range granted {
+		gResource, gLevel, ok := strings.Cut(g, ":")
+		if ok && gResource == resource && scopeLevels[gLevel] >= scopeLevels[level] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+// sessionTouchInterval limits how often last_used_at is written for a session
+const sessionTouchInterval = time.Minute
+
+// ErrSessionRevoked is returned when a token's session no longer exists
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// createSession stores a new session for the user and returns its first access and refresh tokens.
+// The session expires once its refresh token goes unused for RefreshTokenTTL.
+func createSession(r *http.Request, user models.User) (tokenPair, error) {
+	sessionID := uuid.New()
+	accessToken, err := GenerateToken(user, sessionID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	csrfToken, err := GenerateSecureToken(32)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	defer tx.Rollback()
+
+	now := db.CurrentTime()
+	_, err = tx.Exec(`INSERT INTO session_tokens
+		(id, user_id, token, csrf_token, user_agent, ip_address, expires_at, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)`,
+		sessionID, user.ID, HashToken(accessToken), csrfToken, r.UserAgent(), ClientIP(r), now.Add(cfg.RefreshTokenTTL), now)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refreshToken, err := insertRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return tokenPair{}, err
+	}
+
+	// Clean up this user's expired sessions while we're here
+	db.DB.Exec(`DELETE FROM session_tokens WHERE user_id = $1 AND expires_at <= $2`, user.ID, now)
+
+	return tokenPair{AccessToken: accessToken, RefreshToken: refreshToken, CSRFToken: csrfToken}, nil
+}
+
+// AuthenticateToken validates a token, checks that its session is still active and
+// returns the user it belongs to
+func AuthenticateToken(tokenString string) (models.User, *Claims, error) {
+	claims, err := ValidateToken(tokenString)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	if err := checkSession(claims); err != nil {
+		return models.User{}, nil, err
+	}
+
+	user, err := UserFromClaims(claims)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	return user, claims, nil
+}
+
+// checkSession verifies that the session named by the token's jti is still active
+// and records that it was used
+func checkSession(claims *Claims) error {
+	sessionID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var userID uuid.UUID
+	var expiresAt, lastUsedAt time.Time
+	err = db.DB.QueryRow(`SELECT user_id, expires_at, last_used_at FROM session_tokens WHERE id = $1`, sessionID).
+		Scan(&userID, &expiresAt, &lastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+
+	now := db.CurrentTime()
+	if userID != claims.UserID || now.After(expiresAt) {
+		return ErrSessionRevoked
+	}
+
+	if now.Sub(lastUsedAt) > sessionTouchInterval {
+		db.DB.Exec(`UPDATE session_tokens SET last_used_at = $1 WHERE id = $2`, now, sessionID)
+	}
+
+	return nil
+}
+
+// currentSessionID returns the session the request was authenticated with,
+// or uuid.Nil for other credentials such as personal access tokens
+func currentSessionID(r *http.Request) uuid.UUID {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok || !principal.IsSession() {
+		return uuid.Nil
+	}
+	return principal.TokenID
+}
+
+// revokeSession deletes a single session belonging to the user
+func revokeSession(userID, sessionID uuid.UUID) (bool, error) {
+	result, err := db.DB.Exec(`DELETE FROM session_tokens WHERE id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// listSessions returns the user's active sessions, most recently used first
+func listSessions(userID uuid.UUID) ([]models.Session, error) {
+	rows, err := db.DB.Query(`SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+			expires_at, created_at, last_used_at
+		FROM session_tokens
+		WHERE user_id = $1 AND expires_at > $2
+		ORDER BY last_used_at DESC`, userID, db.CurrentTime())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.ExpiresAt, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// SessionsHandler lists the current user's sessions (GET) or revokes every session
+// except the current one (DELETE)
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	currentID := currentSessionID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := listSessions(user.ID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to list sessions")
+			return
+		}
+
+		response := make([]models.SessionResponse, 0, len(sessions))
+		for _, s := range sessions {
+			sr := s.ToResponse()
+			sr.Current = s.ID == currentID
+			response = append(response, sr)
+		}
+
+		RespondWithJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    response,
+		})
+
+	case http.MethodDelete:
+		_, err := db.DB.Exec(`DELETE FROM session_tokens WHERE user_id = $1 AND id <> $2`, user.ID, currentID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, Response{
+			Success: true,
+			Message: "All other sessions have been revoked",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionHandler revokes one of the current user's sessions.
+// The session ID comes from the {id} path wildcard.
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessionID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	revoked, err := revokeSession(user.ID, sessionID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	if !revoked {
+		RespondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	// Revoking the current session is a logout
+	if currentSessionID(r) == sessionID {
+		clearAuthCookies(w, r)
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Session revoked",
+	})
+}
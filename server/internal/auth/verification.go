@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/mailer"
+	"github.com/gotext/server/internal/models"
+)
+
+// VerifyEmailHandler consumes an email verification token.
+// The token can be passed as a "token" query parameter (GET, for links in emails)
+// or in a JSON body (POST, for the web client).
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var token string
+
+	switch r.Method {
+	case http.MethodGet:
+		token = r.URL.Query().Get("token")
+	case http.MethodPost:
+		var req models.VerifyEmailRequest
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+		token = req.Token
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token == "" {
+		RespondWithError(w, http.StatusBadRequest, "Verification token is required")
+		return
+	}
+
+	// Look up the user owning the token
+	user, err := scanUser(db.DB.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE email_verification_token = $1", HashToken(token)))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	// Reject expired tokens
+	if user.EmailVerificationExpiresAt == nil || db.CurrentTime().After(*user.EmailVerificationExpiresAt) {
+		RespondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	// Mark the email as verified and consume the token
+	_, err = db.DB.Exec(`UPDATE users
+		SET is_email_verified = TRUE, email_verification_token = NULL, email_verification_expires_at = NULL
+		WHERE id = $1`, user.ID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+	user.IsEmailVerified = true
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Email verified successfully",
+		Data:    user.ToResponse(),
+	})
+}
+
+// ResendVerificationHandler sends a new verification email.
+// The response is the same whether or not the email is registered so it cannot
+// be used to discover accounts, and repeated requests within the resend
+// interval are silently ignored.
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the request body
+	var req models.ResendVerificationRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := resendVerificationEmail(req.Email); err != nil {
+		log.Printf("Failed to resend verification email: %v", err)
+	}
+
+	RespondWithJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "If the account exists and is not yet verified, a verification email has been sent.",
+	})
+}
+
+// resendVerificationEmail issues a fresh verification token for the user with the given email
+func resendVerificationEmail(email string) error {
+	user, err := getUserByEmail(email)
+	if err != nil || user.IsEmailVerified {
+		return nil
+	}
+
+	// Throttle resends per account
+	now := db.CurrentTime()
+	if user.EmailVerificationSentAt != nil && now.Sub(*user.EmailVerificationSentAt) < cfg.EmailVerificationResendInterval {
+		return nil
+	}
+
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Conditioning the update on the previous sent_at keeps concurrent
+	// requests from sending more than one email
+	result, err := db.DB.Exec(`UPDATE users
+		SET email_verification_token = $1, email_verification_expires_at = $2, email_verification_sent_at = $3
+		WHERE id = $4 AND email_verification_sent_at IS NOT DISTINCT FROM $5`,
+		HashToken(token), now.Add(cfg.EmailVerificationTTL), now, user.ID, user.EmailVerificationSentAt)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil
+	}
+
+	return sendVerificationEmail(user, token)
+}
+
+// sendVerificationEmail emails the verification link to the user
+func sendVerificationEmail(user models.User, token string) error {
+	link := cfg.AppBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your GoText email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\n"+
+			"This link expires in %s. If you did not create a GoText account you can ignore this email.\n",
+			user.Username, link, formatDuration(cfg.EmailVerificationTTL)),
+	})
+}
+
+// formatDuration renders a duration for use in email copy
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		if d == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		if d == time.Minute {
+			return "1 minute"
+		}
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	default:
+		return d.String()
+	}
+}
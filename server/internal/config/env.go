@@ -0,0 +1,72 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnv gets an environment variable or returns a default value
+func GetEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// Env reads typed environment variables for a configuration. Unset variables
+// take their default. A malformed value also takes the default but is
+// reported by Err, so that a typo in a setting doesn't silently fall back.
+type Env struct {
+	errs []error
+}
+
+// Int gets an integer environment variable or returns a default value
+func (e *Env) Int(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be an integer, got %q", key, value))
+		return defaultValue
+	}
+	return n
+}
+
+// Bool gets a boolean environment variable ("true", "false", "1", "0", ...) or returns a default value
+func (e *Env) Bool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be true or false, got %q", key, value))
+		return defaultValue
+	}
+	return b
+}
+
+// Duration gets a duration environment variable (e.g. "15m") or returns a default value
+func (e *Env) Duration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a duration such as 15m, got %q", key, value))
+		return defaultValue
+	}
+	return d
+}
+
+// Err returns an error listing every malformed variable read, or nil if there were none
+func (e *Env) Err() error {
+	return errors.Join(e.errs...)
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvUsesDefaultsWhenUnset(t *testing.T) {
+	t.Setenv("TEST_INT", "")
+	t.Setenv("TEST_BOOL", "")
+	t.Setenv("TEST_DURATION", "")
+
+	env := &Env{}
+	if got := env.Int("TEST_INT", 5); got != 5 {
+		t.Errorf("expected 5, got %d", got)
+	}
+	if got := env.Bool("TEST_BOOL", true); !got {
+		t.Error("expected true")
+	}
+	if got := env.Duration("TEST_DURATION", time.Minute); got != time.Minute {
+		t.Errorf("expected 1m, got %s", got)
+	}
+	if err := env.Err(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestEnvParsesValues(t *testing.T) {
+	t.Setenv("TEST_INT", "12")
+	t.Setenv("TEST_BOOL", "false")
+	t.Setenv("TEST_DURATION", "90s")
+
+	env := &Env{}
+	if got := env.Int("TEST_INT", 5); got != 12 {
+		t.Errorf("expected 12, got %d", got)
+	}
+	if got := env.Bool("TEST_BOOL", true); got {
+		t.Error("expected false")
+	}
+	if got := env.Duration("TEST_DURATION", time.Minute); got != 90*time.Second {
+		t.Errorf("expected 1m30s, got %s", got)
+	}
+	if err := env.Err(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestEnvReportsMalformedValues(t *testing.T) {
+	t.Setenv("TEST_INT", "5x")
+	t.Setenv("TEST_BOOL", "yes")
+	t.Setenv("TEST_DURATION", "1day")
+
+	env := &Env{}
+	env.Int("TEST_INT", 5)
+	env.Bool("TEST_BOOL", false)
+	env.Duration("TEST_DURATION", time.Hour)
+
+	err := env.Err()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, key := range []string{"TEST_INT", "TEST_BOOL", "TEST_DURATION"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected the error to name %s, got %q", key, err)
+		}
+	}
+}
@@ -35,6 +35,14 @@ func DefaultConfig() Config {
 	}
 }
 
+// ConnString returns the connection string for the configured database
+func (c Config) ConnString() string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode,
+	)
+}
+
 // Init initializes the database connection
 func Init(config Config) error {
 	// First connect to postgres to check connectivity
@@ -42,7 +50,7 @@ func Init(config Config) error {
 		"host=%s port=%s user=%s password=%s sslmode=%s",
 		config.Host, config.Port, config.User, config.Password, config.SSLMode,
 	)
-	
+
 	tempDB, tempErr := sql.Open("postgres", tempConnStr)
 	if tempErr == nil {
 		// Test connection and close temporary connection
@@ -51,10 +59,7 @@ func Init(config Config) error {
 	}
 
 	// Now connect to the specific database
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode,
-	)
+	connStr := config.ConnString()
 
 	// Add debug logging
 	fmt.Printf("Connecting with: %s\n", connStr)
@@ -94,4 +99,4 @@ func getEnv(key, defaultValue string) string {
 		return defaultValue
 	}
 	return value
-} 
\ No newline at end of file
+}
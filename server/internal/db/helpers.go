@@ -7,4 +7,4 @@ import (
 // CurrentTime returns the current time in UTC
 func CurrentTime() time.Time {
 	return time.Now().UTC()
-} 
\ No newline at end of file
+}
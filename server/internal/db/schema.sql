@@ -8,9 +8,16 @@ CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     username VARCHAR(50) UNIQUE NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('owner', 'admin', 'moderator', 'user')),
     password_hash VARCHAR(255) NOT NULL,
     is_email_verified BOOLEAN DEFAULT FALSE,
     email_verification_token VARCHAR(255),
+    email_verification_expires_at TIMESTAMP WITH TIME ZONE,
+    email_verification_sent_at TIMESTAMP WITH TIME ZONE,
+    password_changed_at TIMESTAMP WITH TIME ZONE,
+    totp_secret VARCHAR(64),
+    totp_enabled BOOLEAN DEFAULT FALSE,
+    totp_last_used_step BIGINT DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -30,11 +37,52 @@ CREATE TABLE IF NOT EXISTS spaces (
 CREATE TABLE IF NOT EXISTS space_members (
     space_id UUID REFERENCES spaces(id) ON DELETE CASCADE,
     user_id UUID REFERENCES users(id) ON DELETE CASCADE,
-    role VARCHAR(20) DEFAULT 'member',
+    role VARCHAR(20) NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'moderator', 'member', 'guest')),
     joined_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     PRIMARY KEY (space_id, user_id)
 );
 
+-- Pending invitations of specific users to spaces. Rows are deleted once accepted or declined.
+CREATE TABLE IF NOT EXISTS space_invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    space_id UUID NOT NULL REFERENCES spaces(id) ON DELETE CASCADE,
+    inviter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    invitee_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (space_id, invitee_id)
+);
+
+CREATE INDEX idx_space_invites_invitee_id ON space_invites(invitee_id);
+
+-- Shareable invite links, stored as SHA-256 hashes of the link token
+CREATE TABLE IF NOT EXISTS space_invite_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    space_id UUID NOT NULL REFERENCES spaces(id) ON DELETE CASCADE,
+    creator_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_space_invite_links_space_id ON space_invite_links(space_id);
+
+-- Requests to join private spaces, reviewed by the space's moderators
+CREATE TABLE IF NOT EXISTS space_join_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    space_id UUID NOT NULL REFERENCES spaces(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    reviewer_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- A user can only have one pending request per space
+CREATE UNIQUE INDEX idx_space_join_requests_pending ON space_join_requests(space_id, user_id) WHERE status = 'pending';
+
 -- Messages table
 CREATE TABLE IF NOT EXISTS messages (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -54,21 +102,49 @@ CREATE TABLE IF NOT EXISTS messages (
 );
 
 -- Create indexes for faster queries
-CREATE INDEX idx_messages_space_id ON messages(space_id);
+-- Message history is paged by (created_at, id) within a space or direct message conversation
+CREATE INDEX idx_messages_space_created_at ON messages(space_id, created_at, id);
+CREATE INDEX idx_messages_direct_created_at ON messages(
+    LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), created_at, id
+) WHERE is_direct_message = TRUE;
 CREATE INDEX idx_messages_sender_id ON messages(sender_id);
 CREATE INDEX idx_messages_recipient_id ON messages(recipient_id);
 CREATE INDEX idx_space_members_user_id ON space_members(user_id);
+CREATE INDEX idx_users_email_verification_token ON users(email_verification_token);
 
 -- Session tokens table
+-- The id is the access token's jti claim and token holds a SHA-256 hash of the latest access token.
+-- csrf_token is the synchronizer token cookie-authenticated requests must echo back.
 CREATE TABLE IF NOT EXISTS session_tokens (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     token VARCHAR(255) UNIQUE NOT NULL,
+    csrf_token VARCHAR(64),
+    user_agent TEXT,
+    ip_address VARCHAR(45),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_session_tokens_user_id ON session_tokens(user_id);
+
+-- Refresh tokens table
+-- Each refresh token can be used once; all tokens of a session form one family
+-- and are deleted together when the session is revoked
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    session_id UUID NOT NULL REFERENCES session_tokens(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
     expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+
 -- Password reset tokens table
+-- Tokens are stored as SHA-256 hashes and deleted when used
 CREATE TABLE IF NOT EXISTS password_reset_tokens (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -77,13 +153,202 @@ CREATE TABLE IF NOT EXISTS password_reset_tokens (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
--- User online status
+CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+
+-- Two-factor recovery codes, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (user_id, code_hash)
+);
+
+-- WebAuthn credentials (passkeys), a user can register several authenticators
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL,
+    attestation_type VARCHAR(50),
+    aaguid BYTEA,
+    sign_count BIGINT DEFAULT 0,
+    transports TEXT,
+    flags SMALLINT DEFAULT 0,
+    clone_warning BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- In-progress WebAuthn ceremonies, deleted when finished
+CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    session_data JSONB NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- External OpenID Connect identities linked to users
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+
+-- In-progress OpenID Connect logins, keyed by a hash of the state parameter
+CREATE TABLE IF NOT EXISTS oidc_auth_requests (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(255) NOT NULL,
+    code_verifier VARCHAR(255) NOT NULL,
+    redirect_path TEXT,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Personal access tokens for bots and scripts, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    token_prefix VARCHAR(16) NOT NULL,
+    scopes TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+
+-- Failed login attempts per account or IP address, shared by all server instances
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_login_attempts_last_failure_at ON login_attempts(last_failure_at);
+
+-- Rate limit token buckets per client, shared by all server instances
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key VARCHAR(320) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_rate_limits_updated_at ON rate_limits(updated_at);
+
+-- Published events, kept for a while so real-time clients can resume where they
+-- left off. seq orders events across all server instances.
+CREATE TABLE IF NOT EXISTS event_log (
+    seq BIGSERIAL PRIMARY KEY,
+    id UUID UNIQUE NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    space_id UUID,
+    permission VARCHAR(50) NOT NULL DEFAULT '',
+    user_ids UUID[] NOT NULL DEFAULT '{}',
+    actor_id UUID,
+    data JSONB,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_event_log_space_id ON event_log(space_id, seq);
+CREATE INDEX idx_event_log_user_ids ON event_log USING GIN (user_ids);
+CREATE INDEX idx_event_log_created_at ON event_log(created_at);
+
+-- The newest seq removed from the event log by pruning. Clients resuming from
+-- before it have missed events that can no longer be replayed.
+CREATE TABLE IF NOT EXISTS event_log_pruned (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    seq BIGINT NOT NULL
+);
+
+-- Account unlock tokens emailed when an account is locked, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS account_unlock_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_account_unlock_tokens_user_id ON account_unlock_tokens(user_id);
+
+-- Audit log of security-relevant events
+CREATE TABLE IF NOT EXISTS audit_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    event_type VARCHAR(50) NOT NULL,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    ip_address VARCHAR(45),
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_events_user_id ON audit_events(user_id);
+CREATE INDEX idx_audit_events_created_at ON audit_events(created_at);
+
+-- Each user's read position in a space or a direct message conversation with
+-- peer_id: the newest message they have read, by its ID and when it was sent.
+-- The message isn't referenced so the position survives its deletion.
+CREATE TABLE IF NOT EXISTS read_states (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    space_id UUID REFERENCES spaces(id) ON DELETE CASCADE,
+    peer_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    last_read_message_id UUID NOT NULL,
+    last_read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CONSTRAINT read_state_target_check CHECK ((space_id IS NULL) <> (peer_id IS NULL))
+);
+
+CREATE UNIQUE INDEX idx_read_states_user_space ON read_states(user_id, space_id) WHERE space_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_read_states_user_peer ON read_states(user_id, peer_id) WHERE peer_id IS NOT NULL;
+
+-- Members mentioned by @username in space messages
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX idx_message_mentions_user_id ON message_mentions(user_id);
+
+-- User online status. is_online follows live real-time connections and recent
+-- API activity; status is the status the user chose.
 CREATE TABLE IF NOT EXISTS user_status (
     user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
-    is_online BOOLEAN DEFAULT FALSE,
-    last_active TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    is_online BOOLEAN NOT NULL DEFAULT FALSE,
+    last_active TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    status VARCHAR(20) NOT NULL DEFAULT 'online' CHECK (status IN ('online', 'away', 'dnd', 'invisible')),
+    status_text VARCHAR(128),
+    status_text_expires_at TIMESTAMP WITH TIME ZONE
 );
 
+CREATE INDEX idx_user_status_status_text_expires_at ON user_status(status_text_expires_at);
+
+-- Live real-time connections per server instance, refreshed while they stay open
+CREATE TABLE IF NOT EXISTS presence_connections (
+    instance_id UUID NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (instance_id, user_id)
+);
+
+CREATE INDEX idx_presence_connections_user_id ON presence_connections(user_id, seen_at);
+
 -- Trigger to update updated_at timestamp
 CREATE OR REPLACE FUNCTION update_timestamp()
 RETURNS TRIGGER AS $$
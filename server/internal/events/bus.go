@@ -0,0 +1,98 @@
+package events
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Bus carries events from the code that publishes them to the subscribers that
+// deliver them to clients, possibly across server instances
+type Bus interface {
+	// Publish records an event in the event log, which sets its Seq, and sends
+	// it to every subscriber. Subscribers receive events in Seq order, except
+	// that an event whose publish was too slow to wait for arrives late.
+	Publish(event Event) error
+	// Subscribe registers a handler for every event published from now on
+	Subscribe(handler Handler)
+	// Position returns the Seq up to which events have been passed to the
+	// subscribers. Events after it will still reach them.
+	Position() int64
+	// Close stops the bus
+	Close() error
+}
+
+// dispatcher passes events to a list of handlers
+type dispatcher struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+// Subscribe adds a handler
+func (d *dispatcher) Subscribe(handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers = append(d.handlers, handler)
+}
+
+// dispatch calls every handler with the event
+func (d *dispatcher) dispatch(event Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, handler := range d.handlers {
+		handler(event)
+	}
+}
+
+// LocalBus delivers events within this process only. It suits a single server instance.
+type LocalBus struct {
+	dispatcher
+	db *sql.DB
+	// publishMu makes events reach subscribers in the order they were logged
+	publishMu sync.Mutex
+	position  atomic.Int64
+}
+
+// NewLocalBus creates an in-process bus that logs events to database. Without a
+// database events are not logged and have no Seq.
+func NewLocalBus(database *sql.DB) *LocalBus {
+	b := &LocalBus{db: database}
+	if database != nil {
+		// Events logged before a restart can still be replayed
+		var latest int64
+		if err := database.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM event_log`).Scan(&latest); err != nil {
+			log.Printf("Failed to read the event log position: %v", err)
+		}
+		b.position.Store(latest)
+	}
+	return b
+}
+
+// Publish implements Bus
+func (b *LocalBus) Publish(event Event) error {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	if b.db != nil {
+		if err := appendLog(b.db, &event); err != nil {
+			return err
+		}
+	}
+	b.dispatch(event)
+	if event.Seq > 0 {
+		b.position.Store(event.Seq)
+	}
+	return nil
+}
+
+// Position implements Bus
+func (b *LocalBus) Position() int64 {
+	return b.position.Load()
+}
+
+// Close implements Bus
+func (b *LocalBus) Close() error {
+	return nil
+}
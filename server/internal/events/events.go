@@ -0,0 +1,168 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/config"
+	"github.com/gotext/server/internal/db"
+)
+
+// Event types
+const (
+	MemberJoined  = "member.joined"
+	MemberLeft    = "member.left"
+	MemberRemoved = "member.removed"
+	MemberUpdated = "member.updated"
+
+	InviteCreated  = "invite.created"
+	InviteAccepted = "invite.accepted"
+	InviteDeclined = "invite.declined"
+	InviteRevoked  = "invite.revoked"
+
+	JoinRequestCreated  = "join_request.created"
+	JoinRequestApproved = "join_request.approved"
+	JoinRequestRejected = "join_request.rejected"
+
+	MessageCreated = "message.created"
+	MessageUpdated = "message.updated"
+	MessageDeleted = "message.deleted"
+
+	SpaceUpdated = "space.updated"
+	SpaceDeleted = "space.deleted"
+
+	PresenceUpdated = "presence.updated"
+
+	ReadStateUpdated = "read_state.updated"
+)
+
+// Event is something that happened which connected clients should hear about.
+// It is delivered to the members of SpaceID and to every user in UserIDs.
+type Event struct {
+	// Seq orders every published event. It increases with each event, though
+	// not necessarily by one, so clients can resume a stream from the last one they saw.
+	Seq  int64     `json:"seq"`
+	ID   uuid.UUID `json:"id"`
+	Type string    `json:"type"`
+	// SpaceID is the space whose members receive the event, if any
+	SpaceID *uuid.UUID `json:"space_id,omitempty"`
+	// Permission limits a space event to members whose role grants it, e.g.
+	// join requests only go to members who can review them
+	Permission string `json:"-"`
+	// UserIDs are users who receive the event whether or not they are members
+	UserIDs []uuid.UUID `json:"-"`
+	// ActorID is the user whose action caused the event, if any
+	ActorID   *uuid.UUID  `json:"actor_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Handler receives published events. It is called synchronously, so it must not block.
+// Events from other server instances carry their Data as json.RawMessage.
+type Handler func(Event)
+
+// Bus names
+const (
+	BusLocal    = "local"
+	BusPostgres = "postgres"
+)
+
+// Config holds event bus configuration
+type Config struct {
+	Bus string // "postgres" or "local"
+	// ConnString is the database the postgres bus listens on
+	ConnString string
+
+	// LogRetention is how long events are kept for replay
+	LogRetention time.Duration
+	// ReplayLimit is the most events replayed to a resuming client before it
+	// is told to resync instead
+	ReplayLimit int
+}
+
+// DefaultConfig returns the event bus configuration from the environment.
+// The postgres bus listens on the same database as db.DB. It returns an error
+// naming any variable that is set but malformed.
+func DefaultConfig() (Config, error) {
+	env := &config.Env{}
+	c := Config{
+		Bus:        config.GetEnv("EVENT_BUS", BusPostgres),
+		ConnString: db.DefaultConfig().ConnString(),
+
+		LogRetention: env.Duration("EVENT_LOG_RETENTION", 24*time.Hour),
+		ReplayLimit:  env.Int("EVENT_REPLAY_LIMIT", 200),
+	}
+	return c, env.Err()
+}
+
+// cfg is the active event bus configuration
+var cfg = Config{Bus: BusLocal, ReplayLimit: 200}
+
+// bus is the event bus configured by Init
+var bus Bus = NewLocalBus(nil)
+
+// Init creates the configured event bus. Subscribers registered before Init
+// are not carried over, so it must be called first.
+func Init(config Config) error {
+	if config.LogRetention <= 0 {
+		return errors.New("event log retention must be positive")
+	}
+	if config.ReplayLimit < 1 {
+		return errors.New("event replay limit must be at least 1")
+	}
+
+	switch config.Bus {
+	case BusLocal:
+		bus = NewLocalBus(db.DB)
+	case BusPostgres:
+		b, err := NewPostgresBus(db.DB, config.ConnString)
+		if err != nil {
+			return err
+		}
+		bus = b
+	default:
+		return fmt.Errorf("unknown event bus %q", config.Bus)
+	}
+
+	cfg = config
+	return nil
+}
+
+// CurrentConfig returns the active event bus configuration
+func CurrentConfig() Config {
+	return cfg
+}
+
+// Close stops the event bus
+func Close() error {
+	return bus.Close()
+}
+
+// Subscribe registers a handler for every event published from now on
+func Subscribe(handler Handler) {
+	bus.Subscribe(handler)
+}
+
+// Position returns the Seq up to which events have been passed to the
+// subscribers on this server instance. Events after it will still reach them.
+func Position() int64 {
+	return bus.Position()
+}
+
+// Publish fills in the event's ID and time, records it in the event log and sends
+// it to every subscriber. Failures are logged; the caller's change has already happened.
+func Publish(event Event) {
+	if event.ID == uuid.Nil {
+		event.ID = uuid.New()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = db.CurrentTime()
+	}
+
+	if err := bus.Publish(event); err != nil {
+		log.Printf("Failed to publish %s event: %v", event.Type, err)
+	}
+}
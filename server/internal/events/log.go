@@ -0,0 +1,173 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/lib/pq"
+)
+
+// logPruneInterval is how often expired events are removed from the log
+const logPruneInterval = 10 * time.Minute
+
+// ErrResyncRequired is returned when the events after a sequence number can no
+// longer be replayed, because they have been pruned from the log or there are
+// too many of them. The client should reload its state instead.
+var ErrResyncRequired = errors.New("events since this sequence number can't be replayed")
+
+// querier is satisfied by *sql.DB and *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// logColumns are the event_log columns read by scanLogEvent
+const logColumns = `seq, id, type, space_id, permission, user_ids, actor_id, data, created_at`
+
+// appendLog stores an event in the log and sets its sequence number
+func appendLog(q querier, event *Event) error {
+	var data []byte
+	if event.Data != nil {
+		var err error
+		if data, err = json.Marshal(event.Data); err != nil {
+			return err
+		}
+	}
+
+	userIDs := make([]string, 0, len(event.UserIDs))
+	for _, id := range event.UserIDs {
+		userIDs = append(userIDs, id.String())
+	}
+
+	return q.QueryRow(`INSERT INTO event_log (id, type, space_id, permission, user_ids, actor_id, data, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING seq`,
+		event.ID, event.Type, event.SpaceID, event.Permission, pq.Array(userIDs), event.ActorID, data, event.CreatedAt).
+		Scan(&event.Seq)
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLogEvent reads an event selected with logColumns. Its data is left as JSON.
+func scanLogEvent(row rowScanner) (Event, error) {
+	var event Event
+	var userIDs []string
+	var data []byte
+	err := row.Scan(&event.Seq, &event.ID, &event.Type, &event.SpaceID, &event.Permission,
+		pq.Array(&userIDs), &event.ActorID, &data, &event.CreatedAt)
+	if err != nil {
+		return Event{}, err
+	}
+
+	for _, id := range userIDs {
+		if userID, err := uuid.Parse(id); err == nil {
+			event.UserIDs = append(event.UserIDs, userID)
+		}
+	}
+	if data != nil {
+		event.Data = json.RawMessage(data)
+	}
+	return event, nil
+}
+
+// getLogEvent returns the logged event with a sequence number
+func getLogEvent(q querier, seq int64) (Event, error) {
+	return scanLogEvent(q.QueryRow(`SELECT `+logColumns+` FROM event_log WHERE seq = $1`, seq))
+}
+
+// Replay returns the events after since, up to and including until, that were
+// sent to the spaces or addressed to the user, oldest first. until is normally
+// Position(), so that the events after it arrive live instead. Callers still
+// check each space event's Permission. It returns ErrResyncRequired when events
+// after since have been pruned from the log, when since is newer than any logged
+// event, or when more than the configured replay limit of events would be returned.
+func Replay(since, until int64, spaceIDs []uuid.UUID, userID uuid.UUID) ([]Event, error) {
+	// Sequence numbers have gaps, so the log's oldest seq doesn't tell whether
+	// anything after since was pruned; the newest pruned seq does
+	var pruned, latest int64
+	err := db.DB.QueryRow(`SELECT
+		COALESCE((SELECT seq FROM event_log_pruned), 0),
+		COALESCE((SELECT MAX(seq) FROM event_log), 0)`).Scan(&pruned, &latest)
+	if err != nil {
+		return nil, err
+	}
+	// Either events after since were pruned, or since comes from somewhere else
+	if since < pruned || since > max(latest, pruned) {
+		return nil, ErrResyncRequired
+	}
+	// Another instance may have delivered further than this one; the rest
+	// arrives live
+	if since >= until {
+		return []Event{}, nil
+	}
+
+	spaces := make([]string, 0, len(spaceIDs))
+	for _, id := range spaceIDs {
+		spaces = append(spaces, id.String())
+	}
+
+	rows, err := db.DB.Query(`SELECT `+logColumns+` FROM event_log
+		WHERE seq > $1 AND seq <= $2 AND (space_id = ANY($3::uuid[]) OR user_ids @> ARRAY[$4::uuid])
+		ORDER BY seq
+		LIMIT $5`,
+		since, until, pq.Array(spaces), userID, cfg.ReplayLimit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replayed := []Event{}
+	for rows.Next() {
+		event, err := scanLogEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		replayed = append(replayed, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(replayed) > cfg.ReplayLimit {
+		return nil, ErrResyncRequired
+	}
+	return replayed, nil
+}
+
+// StartLogPruning removes events older than the configured retention from the
+// log until ctx ends. The newest removed seq is recorded for Replay.
+func StartLogPruning(ctx context.Context) {
+	ticker := time.NewTicker(logPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pruneLog(db.CurrentTime().Add(-cfg.LogRetention)); err != nil {
+				log.Printf("Failed to prune event log: %v", err)
+			}
+		}
+	}
+}
+
+// pruneLog removes the events created before cutoff and records the newest
+// removed seq in event_log_pruned
+func pruneLog(cutoff time.Time) error {
+	_, err := db.DB.Exec(`WITH removed AS (
+			DELETE FROM event_log WHERE created_at < $1 RETURNING seq
+		)
+		INSERT INTO event_log_pruned (id, seq)
+		SELECT TRUE, MAX(seq) FROM removed HAVING COUNT(*) > 0
+		ON CONFLICT (id) DO UPDATE SET seq = GREATEST(event_log_pruned.seq, EXCLUDED.seq)`, cutoff)
+	return err
+}
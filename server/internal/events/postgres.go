@@ -0,0 +1,389 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	// notifyChannel is the Postgres channel events are sent on
+	notifyChannel = "gotext_events"
+	// maxNotifyPayload is the largest event sent inline. Postgres limits NOTIFY
+	// payloads to just under 8000 bytes; for larger events only the sequence
+	// number is sent and listeners read the event from the log.
+	maxNotifyPayload = 7000
+	// payloadRefPrefix marks a notification that carries only a sequence number
+	payloadRefPrefix = "ref:"
+	// catchUpBatchSize is how many missed events are read from the log at a time
+	catchUpBatchSize = 500
+	// listenerPingInterval is how often the listen connection is checked
+	listenerPingInterval = time.Minute
+	// gapWait is how long an event is held back while an event with a lower
+	// sequence number is missing. Concurrent publishes can commit out of Seq
+	// order, and sequence numbers of rolled-back publishes are never used.
+	gapWait = 2 * time.Second
+	// lateWait is how long an event given up on after gapWait is still delivered
+	// if its publish commits after all
+	lateWait = 5 * time.Minute
+)
+
+// wireEvent is an event as sent between server instances. Unlike the JSON sent
+// to clients it includes the routing fields.
+type wireEvent struct {
+	Seq        int64           `json:"seq"`
+	ID         uuid.UUID       `json:"id"`
+	Type       string          `json:"type"`
+	SpaceID    *uuid.UUID      `json:"space_id,omitempty"`
+	Permission string          `json:"permission,omitempty"`
+	UserIDs    []uuid.UUID     `json:"user_ids,omitempty"`
+	ActorID    *uuid.UUID      `json:"actor_id,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// PostgresBus delivers events to every server instance using Postgres
+// LISTEN/NOTIFY. Each event is logged and notified in one transaction. Every
+// instance, including the publishing one, delivers events as their
+// notifications arrive. Publishes don't wait for each other, so notifications
+// can arrive out of Seq order; an event that arrives ahead of a missing one is
+// held for up to gapWait so that subscribers still see events in Seq order. A
+// missing event that turns up after that is delivered late, out of order.
+type PostgresBus struct {
+	dispatcher
+	db       *sql.DB
+	listener *pq.Listener
+	// position is the Seq up to which every event has been delivered or given up on
+	position atomic.Int64
+	// held are events that arrived ahead of a missing one, and gapTimeout fires
+	// when the oldest missing event has been waited for long enough. Only the
+	// listen goroutine uses them.
+	held       map[int64]Event
+	gapTimeout <-chan time.Time
+	// skipped are the sequence numbers position moved past without an event,
+	// with when, so that their events are still delivered if they arrive late.
+	// Only the listen goroutine uses it.
+	skipped map[int64]time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPostgresBus starts listening for events. connStr is used for the dedicated
+// listen connection, which reconnects by itself and listens again after a
+// connection failure. Events missed while disconnected are read from the log.
+func NewPostgresBus(database *sql.DB, connStr string) (*PostgresBus, error) {
+	b := &PostgresBus{
+		db:      database,
+		held:    map[int64]Event{},
+		skipped: map[int64]time.Time{},
+		done:    make(chan struct{}),
+	}
+
+	b.listener = pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Event bus lost its database connection: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("Event bus reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Event bus failed to reconnect: %v", err)
+		}
+	})
+	if err := b.listener.Listen(notifyChannel); err != nil {
+		b.listener.Close()
+		return nil, fmt.Errorf("failed to listen for events: %w", err)
+	}
+
+	// Events logged before we started listening are not ours to deliver
+	var latest int64
+	if err := database.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM event_log`).Scan(&latest); err != nil {
+		b.listener.Close()
+		return nil, err
+	}
+	b.position.Store(latest)
+
+	b.wg.Add(1)
+	go b.listen()
+	return b, nil
+}
+
+// Publish implements Bus
+func (b *PostgresBus) Publish(event Event) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := logAndNotify(tx, &event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// logAndNotify logs an event and sends its notification, which goes out when
+// the transaction commits
+func logAndNotify(tx *sql.Tx, event *Event) error {
+	if err := appendLog(tx, event); err != nil {
+		return err
+	}
+
+	var data json.RawMessage
+	if event.Data != nil {
+		var err error
+		if data, err = json.Marshal(event.Data); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(wireEvent{
+		Seq:        event.Seq,
+		ID:         event.ID,
+		Type:       event.Type,
+		SpaceID:    event.SpaceID,
+		Permission: event.Permission,
+		UserIDs:    event.UserIDs,
+		ActorID:    event.ActorID,
+		Data:       data,
+		CreatedAt:  event.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	message := string(payload)
+	if len(payload) > maxNotifyPayload {
+		message = payloadRefPrefix + strconv.FormatInt(event.Seq, 10)
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, message)
+	return err
+}
+
+// Position implements Bus
+func (b *PostgresBus) Position() int64 {
+	return b.position.Load()
+}
+
+// Close implements Bus
+func (b *PostgresBus) Close() error {
+	close(b.done)
+	err := b.listener.Close()
+	b.wg.Wait()
+	return err
+}
+
+// listen delivers notifications until the bus is closed
+func (b *PostgresBus) listen() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification means the connection was re-established, and
+			// anything sent in the meantime was lost
+			if n == nil {
+				b.catchUp()
+				continue
+			}
+			event, err := b.decode(n.Extra)
+			if err != nil {
+				log.Printf("Failed to read event notification: %v", err)
+				continue
+			}
+			b.receive(event)
+
+		case <-b.gapTimeout:
+			b.skipGap()
+
+		case <-ticker.C:
+			// Makes the listener notice a dead connection and reconnect
+			go b.listener.Ping()
+			b.forgetSkipped(time.Now().Add(-lateWait))
+		}
+	}
+}
+
+// receive delivers an event, and any held events that follow it, if it is the
+// next one in Seq order. Otherwise it holds the event until the missing ones
+// arrive or gapWait passes.
+func (b *PostgresBus) receive(event Event) {
+	if event.Seq <= b.position.Load() {
+		// An event the bus stopped waiting for is delivered late; anything
+		// else before position has been delivered already
+		if _, ok := b.skipped[event.Seq]; ok {
+			delete(b.skipped, event.Seq)
+			b.dispatch(event)
+		}
+		return
+	}
+	b.held[event.Seq] = event
+	b.flush()
+}
+
+// flush delivers the held events that no longer follow a missing one, and
+// starts waiting for the next missing event if any are still held
+func (b *PostgresBus) flush() {
+	advanced := false
+	for {
+		event, ok := b.held[b.position.Load()+1]
+		if !ok {
+			break
+		}
+		delete(b.held, event.Seq)
+		b.position.Store(event.Seq)
+		b.dispatch(event)
+		advanced = true
+	}
+
+	switch {
+	case len(b.held) == 0:
+		b.gapTimeout = nil
+	case b.gapTimeout == nil || advanced:
+		b.gapTimeout = time.After(gapWait)
+	}
+}
+
+// skipGap stops waiting for the missing events before the oldest held one.
+// Their publishes were rolled back, or are so slow that they will arrive too late.
+func (b *PostgresBus) skipGap() {
+	b.gapTimeout = nil
+
+	next := int64(0)
+	for seq := range b.held {
+		if next == 0 || seq < next {
+			next = seq
+		}
+	}
+	if next == 0 {
+		return
+	}
+
+	now := time.Now()
+	for seq := b.position.Load() + 1; seq < next; seq++ {
+		b.skipped[seq] = now
+	}
+	b.position.Store(next - 1)
+	b.flush()
+}
+
+// forgetSkipped stops waiting for the skipped events given up on before cutoff.
+// Their publishes were rolled back.
+func (b *PostgresBus) forgetSkipped(cutoff time.Time) {
+	for seq, skippedAt := range b.skipped {
+		if skippedAt.Before(cutoff) {
+			delete(b.skipped, seq)
+		}
+	}
+}
+
+// catchUp delivers the logged events that were published while the listen
+// connection was down, including skipped events that committed in the meantime
+func (b *PostgresBus) catchUp() {
+	if len(b.skipped) > 0 {
+		b.catchUpSkipped()
+	}
+
+	after := b.position.Load()
+	for {
+		rows, err := b.db.Query(`SELECT `+logColumns+` FROM event_log WHERE seq > $1 ORDER BY seq LIMIT $2`,
+			after, catchUpBatchSize)
+		if err != nil {
+			log.Printf("Failed to read missed events: %v", err)
+			return
+		}
+
+		count := 0
+		for rows.Next() {
+			event, err := scanLogEvent(rows)
+			if err != nil {
+				log.Printf("Failed to read missed event: %v", err)
+				break
+			}
+			after = event.Seq
+			b.receive(event)
+			count++
+		}
+		rows.Close()
+
+		if count < catchUpBatchSize {
+			return
+		}
+	}
+}
+
+// catchUpSkipped delivers the skipped events that are in the log
+func (b *PostgresBus) catchUpSkipped() {
+	seqs := make([]int64, 0, len(b.skipped))
+	for seq := range b.skipped {
+		seqs = append(seqs, seq)
+	}
+
+	rows, err := b.db.Query(`SELECT `+logColumns+` FROM event_log WHERE seq = ANY($1) ORDER BY seq`, pq.Array(seqs))
+	if err != nil {
+		log.Printf("Failed to read missed events: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanLogEvent(rows)
+		if err != nil {
+			log.Printf("Failed to read missed event: %v", err)
+			return
+		}
+		b.receive(event)
+	}
+}
+
+// decode reads a notification, fetching the event from the log if it was too
+// large to send inline
+func (b *PostgresBus) decode(message string) (Event, error) {
+	if ref, ok := strings.CutPrefix(message, payloadRefPrefix); ok {
+		seq, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return Event{}, err
+		}
+		event, err := getLogEvent(b.db, seq)
+		if err != nil {
+			return Event{}, fmt.Errorf("failed to fetch event %d: %w", seq, err)
+		}
+		return event, nil
+	}
+
+	var w wireEvent
+	if err := json.Unmarshal([]byte(message), &w); err != nil {
+		return Event{}, err
+	}
+	event := Event{
+		Seq:        w.Seq,
+		ID:         w.ID,
+		Type:       w.Type,
+		SpaceID:    w.SpaceID,
+		Permission: w.Permission,
+		UserIDs:    w.UserIDs,
+		ActorID:    w.ActorID,
+		CreatedAt:  w.CreatedAt,
+	}
+	if w.Data != nil {
+		event.Data = w.Data
+	}
+	return event, nil
+}
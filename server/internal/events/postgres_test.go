@@ -0,0 +1,297 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/testutil"
+	"github.com/lib/pq"
+)
+
+// deliveryTimeout is how long a test waits for an event. It allows for an
+// event held behind one published concurrently by another test package.
+const deliveryTimeout = 10 * time.Second
+
+// newTestBus starts a bus as a separate server instance would, closing it
+// when the test ends
+func newTestBus(t *testing.T, database *sql.DB, url string) *PostgresBus {
+	t.Helper()
+
+	b, err := NewPostgresBus(database, url)
+	if err != nil {
+		t.Fatalf("failed to start bus: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// subscribeTest returns a channel receiving every event the bus delivers
+func subscribeTest(b *PostgresBus) <-chan Event {
+	received := make(chan Event, 100)
+	b.Subscribe(func(event Event) {
+		select {
+		case received <- event:
+		default:
+		}
+	})
+	return received
+}
+
+// newTestEvent returns an event that is removed from the log when the test ends
+func newTestEvent(t *testing.T, database *sql.DB, data interface{}) Event {
+	t.Helper()
+
+	actorID := uuid.New()
+	event := Event{
+		ID:         uuid.New(),
+		Type:       MessageCreated,
+		Permission: "messages.read",
+		UserIDs:    []uuid.UUID{uuid.New()},
+		ActorID:    &actorID,
+		Data:       data,
+		CreatedAt:  db.CurrentTime(),
+	}
+	t.Cleanup(func() {
+		database.Exec(`DELETE FROM event_log WHERE id = $1`, event.ID)
+	})
+	return event
+}
+
+// waitForEvent returns the event with id from received, skipping events
+// published by anything else using the database
+func waitForEvent(t *testing.T, received <-chan Event, id uuid.UUID) Event {
+	t.Helper()
+
+	timeout := time.After(deliveryTimeout)
+	for {
+		select {
+		case event := <-received:
+			if event.ID == id {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("event %s was not delivered", id)
+			return Event{}
+		}
+	}
+}
+
+// testData is the data of test events
+type testData struct {
+	Body string `json:"body"`
+}
+
+// decodeTestData reads the data of an event received from another instance
+func decodeTestData(t *testing.T, event Event) testData {
+	t.Helper()
+
+	raw, ok := event.Data.(json.RawMessage)
+	if !ok {
+		t.Fatalf("expected raw JSON data, got %T", event.Data)
+	}
+	var data testData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatalf("failed to decode event data: %v", err)
+	}
+	return data
+}
+
+func TestPostgresBusDeliversAcrossInstances(t *testing.T) {
+	database, url := testutil.OpenDB(t)
+	publisher := newTestBus(t, database, url)
+	listener := newTestBus(t, database, url)
+	published := subscribeTest(publisher)
+	received := subscribeTest(listener)
+
+	event := newTestEvent(t, database, testData{Body: "hello"})
+	if err := publisher.Publish(event); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	got := waitForEvent(t, received, event.ID)
+	if got.Seq == 0 {
+		t.Error("expected the event to have a Seq")
+	}
+	if got.Type != event.Type || got.Permission != event.Permission {
+		t.Errorf("expected %s/%s, got %s/%s", event.Type, event.Permission, got.Type, got.Permission)
+	}
+	if got.ActorID == nil || *got.ActorID != *event.ActorID {
+		t.Errorf("expected actor %s, got %v", event.ActorID, got.ActorID)
+	}
+	if len(got.UserIDs) != 1 || got.UserIDs[0] != event.UserIDs[0] {
+		t.Errorf("expected users %v, got %v", event.UserIDs, got.UserIDs)
+	}
+	if data := decodeTestData(t, got); data.Body != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", data.Body)
+	}
+	if listener.Position() < got.Seq {
+		t.Errorf("expected position at least %d, got %d", got.Seq, listener.Position())
+	}
+
+	// The publishing instance delivers its own events too
+	if own := waitForEvent(t, published, event.ID); own.Seq != got.Seq {
+		t.Errorf("expected seq %d on the publisher, got %d", got.Seq, own.Seq)
+	}
+}
+
+func TestPostgresBusDeliversLargeEventsByReference(t *testing.T) {
+	database, url := testutil.OpenDB(t)
+	publisher := newTestBus(t, database, url)
+	listener := newTestBus(t, database, url)
+	received := subscribeTest(listener)
+
+	body := strings.Repeat("x", 2*maxNotifyPayload)
+	event := newTestEvent(t, database, testData{Body: body})
+	if err := publisher.Publish(event); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	got := waitForEvent(t, received, event.ID)
+	if data := decodeTestData(t, got); data.Body != body {
+		t.Errorf("expected a %d byte body, got %d bytes", len(body), len(data.Body))
+	}
+	if len(got.UserIDs) != 1 || got.UserIDs[0] != event.UserIDs[0] {
+		t.Errorf("expected users %v, got %v", event.UserIDs, got.UserIDs)
+	}
+}
+
+func TestPostgresBusResubscribesAfterDisconnect(t *testing.T) {
+	database, url := testutil.OpenDB(t)
+	publisher := newTestBus(t, database, url)
+	listener := newTestBus(t, database, url)
+	received := subscribeTest(listener)
+
+	// Drop every listen connection; the buses reconnect by themselves
+	rows, err := database.Query(`SELECT pid FROM pg_stat_activity
+		WHERE query LIKE 'LISTEN %' || $1 || '%' AND pg_terminate_backend(pid)`, notifyChannel)
+	if err != nil {
+		t.Fatalf("failed to drop listen connections: %v", err)
+	}
+	var dropped []int64
+	for rows.Next() {
+		var pid int64
+		if err := rows.Scan(&pid); err != nil {
+			t.Fatalf("failed to read dropped connection: %v", err)
+		}
+		dropped = append(dropped, pid)
+	}
+	rows.Close()
+	if len(dropped) < 2 {
+		t.Fatalf("expected to drop both listen connections, dropped %d", len(dropped))
+	}
+
+	// Published while the listener reconnects, so it may only be read from the log
+	missed := newTestEvent(t, database, testData{Body: "missed"})
+	if err := publisher.Publish(missed); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	waitForEvent(t, received, missed.ID)
+
+	// Both buses listen again on new connections
+	deadline := time.Now().Add(deliveryTimeout)
+	for {
+		var listening int
+		err := database.QueryRow(`SELECT COUNT(*) FROM pg_stat_activity
+			WHERE query LIKE 'LISTEN %' || $1 || '%' AND NOT pid = ANY($2)`,
+			notifyChannel, pq.Array(dropped)).Scan(&listening)
+		if err != nil {
+			t.Fatalf("failed to read listen connections: %v", err)
+		}
+		if listening >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the buses to listen again")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Published after reconnecting, so it arrives as a notification again
+	live := newTestEvent(t, database, testData{Body: "live"})
+	if err := publisher.Publish(live); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	got := waitForEvent(t, received, live.ID)
+	if data := decodeTestData(t, got); data.Body != "live" {
+		t.Errorf("expected body %q, got %q", "live", data.Body)
+	}
+}
+
+func TestPostgresBusDeliversSkippedEventsLate(t *testing.T) {
+	b := &PostgresBus{held: map[int64]Event{}, skipped: map[int64]time.Time{}}
+	b.position.Store(10)
+	var delivered []int64
+	b.Subscribe(func(event Event) { delivered = append(delivered, event.Seq) })
+
+	// 12 waits for 11 until the bus gives up on it
+	b.receive(Event{Seq: 12})
+	if len(delivered) != 0 {
+		t.Fatalf("expected 12 to be held, got %v", delivered)
+	}
+	b.skipGap()
+	if b.Position() != 12 {
+		t.Errorf("expected position 12, got %d", b.Position())
+	}
+
+	// 11 committed after all; duplicates are still dropped
+	b.receive(Event{Seq: 11})
+	b.receive(Event{Seq: 11})
+	b.receive(Event{Seq: 12})
+	if want := []int64{12, 11}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("expected %v, got %v", want, delivered)
+	}
+
+	// Events skipped longer ago than lateWait are forgotten
+	b.receive(Event{Seq: 15})
+	b.skipGap()
+	b.forgetSkipped(time.Now().Add(time.Second))
+	b.receive(Event{Seq: 14})
+	if want := []int64{12, 11, 15}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("expected %v, got %v", want, delivered)
+	}
+}
+
+func TestPostgresBusDeliversEventsCommittedAfterGapWait(t *testing.T) {
+	database, url := testutil.OpenDB(t)
+	publisher := newTestBus(t, database, url)
+	listener := newTestBus(t, database, url)
+	received := subscribeTest(listener)
+
+	// A slow publish takes its Seq but doesn't commit yet
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	slow := newTestEvent(t, database, testData{Body: "slow"})
+	if err := logAndNotify(tx, &slow); err != nil {
+		t.Fatalf("failed to log event: %v", err)
+	}
+
+	// The next event is delivered once the bus stops waiting for the slow one
+	fast := newTestEvent(t, database, testData{Body: "fast"})
+	if err := publisher.Publish(fast); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	got := waitForEvent(t, received, fast.ID)
+	if listener.Position() < got.Seq {
+		t.Errorf("expected position at least %d, got %d", got.Seq, listener.Position())
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	late := waitForEvent(t, received, slow.ID)
+	if late.Seq != slow.Seq {
+		t.Errorf("expected seq %d, got %d", slow.Seq, late.Seq)
+	}
+	if data := decodeTestData(t, late); data.Body != "slow" {
+		t.Errorf("expected body %q, got %q", "slow", data.Body)
+	}
+}
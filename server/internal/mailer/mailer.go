@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gotext/server/internal/config"
+)
+
+// Message represents an outgoing email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Config holds mailer configuration
+type Config struct {
+	Driver   string // "smtp" or "log"
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	LogFile  string // Used by the log driver, empty means stdout
+}
+
+// Default is the mailer used by the package-level Send function
+var Default Mailer = NewLogMailer(os.Stdout)
+
+// DefaultConfig returns a default mailer configuration
+func DefaultConfig() Config {
+	return Config{
+		Driver:   config.GetEnv("MAIL_DRIVER", "log"),
+		Host:     config.GetEnv("SMTP_HOST", "localhost"),
+		Port:     config.GetEnv("SMTP_PORT", "1025"),
+		Username: config.GetEnv("SMTP_USERNAME", ""),
+		Password: config.GetEnv("SMTP_PASSWORD", ""),
+		From:     config.GetEnv("MAIL_FROM", "GoText <no-reply@gotext.local>"),
+		LogFile:  config.GetEnv("MAIL_LOG_FILE", ""),
+	}
+}
+
+// New creates a mailer for the configured driver
+func New(config Config) (Mailer, error) {
+	switch config.Driver {
+	case "smtp":
+		return NewSMTPMailer(config), nil
+	case "log", "":
+		if config.LogFile == "" {
+			return NewLogMailer(os.Stdout), nil
+		}
+		file, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mail log file: %w", err)
+		}
+		return NewLogMailer(file), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", config.Driver)
+	}
+}
+
+// Init initializes the default mailer
+func Init(config Config) error {
+	m, err := New(config)
+	if err != nil {
+		return err
+	}
+	Default = m
+	return nil
+}
+
+// Send sends a message using the default mailer
+func Send(msg Message) error {
+	return Default.Send(msg)
+}
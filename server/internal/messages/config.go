@@ -0,0 +1,45 @@
+package messages
+
+import (
+	"fmt"
+
+	"github.com/gotext/server/internal/config"
+)
+
+// Config holds messaging configuration
+type Config struct {
+	// DefaultPageSize is how many messages a page of history has when the client doesn't say
+	DefaultPageSize int
+	// MaxPageSize is the most messages a client can ask for in one page
+	MaxPageSize int
+}
+
+// DefaultConfig returns the messaging configuration from the environment.
+// It returns an error naming any variable that is set but malformed.
+func DefaultConfig() (Config, error) {
+	env := &config.Env{}
+	c := Config{
+		DefaultPageSize: env.Int("MESSAGE_PAGE_SIZE", 50),
+		MaxPageSize:     env.Int("MESSAGE_MAX_PAGE_SIZE", 100),
+	}
+	return c, env.Err()
+}
+
+// cfg is the active messaging configuration
+var cfg = Config{
+	DefaultPageSize: 50,
+	MaxPageSize:     100,
+}
+
+// Init validates and applies the messaging configuration
+func Init(config Config) error {
+	if config.MaxPageSize < 1 {
+		return fmt.Errorf("MESSAGE_MAX_PAGE_SIZE must be at least 1")
+	}
+	if config.DefaultPageSize < 1 || config.DefaultPageSize > config.MaxPageSize {
+		return fmt.Errorf("MESSAGE_PAGE_SIZE must be between 1 and MESSAGE_MAX_PAGE_SIZE")
+	}
+
+	cfg = config
+	return nil
+}
@@ -0,0 +1,308 @@
+package messages
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// SendMessageHandler sends a message to a space (space_id) or directly to
+// another user (recipient_id). Exactly one of them must be set.
+func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req models.CreateMessageRequest
+	if !auth.DecodeJSON(w, r, &req) {
+		return
+	}
+	if (req.SpaceID == nil) == (req.RecipientID == nil) {
+		auth.RespondWithError(w, http.StatusBadRequest, "Set either space_id or recipient_id")
+		return
+	}
+
+	if req.SpaceID != nil {
+		if !authorize(w, principal, rbac.PermSendMessages, *req.SpaceID) {
+			return
+		}
+	} else {
+		if *req.RecipientID == principal.UserID {
+			auth.RespondWithError(w, http.StatusBadRequest, "You can't send a direct message to yourself")
+			return
+		}
+		exists, err := userExists(*req.RecipientID)
+		if err != nil {
+			respondWithMessageError(w, err, "Failed to send message")
+			return
+		}
+		if !exists {
+			respondWithMessageError(w, ErrRecipientNotFound, "")
+			return
+		}
+	}
+
+	message, err := createMessage(principal.UserID, req.SpaceID, req.RecipientID, req.Content)
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to send message")
+		return
+	}
+	publishMessageEvent(events.MessageCreated, message, principal.UserID, message)
+
+	auth.RespondWithJSON(w, http.StatusCreated, auth.Response{
+		Success: true,
+		Message: "Message sent",
+		Data:    message,
+	})
+}
+
+// SpaceMessagesHandler returns a page of a space's message history, oldest first.
+// See parsePageRequest for the query parameters. The space ID comes from the
+// {spaceID} path wildcard.
+func SpaceMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	req, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+	if !authorize(w, principal, rbac.PermReadMessages, spaceID) {
+		return
+	}
+
+	page, err := listSpaceMessages(spaceID, req)
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to list messages")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    page,
+	})
+}
+
+// DirectMessagesHandler returns a page of the direct messages between the current
+// user and another user, oldest first. See parsePageRequest for the query parameters.
+// The other user's ID comes from the {userID} path wildcard.
+func DirectMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	req, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := listDirectMessages(principal.UserID, userID, req)
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to list messages")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    page,
+	})
+}
+
+// MessageHandler edits (PATCH) or deletes (DELETE) a message. Only the sender can
+// edit a message; space moderators can also delete other people's messages.
+// The message ID comes from the {messageID} path wildcard.
+func MessageHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(r.PathValue("messageID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	message, err := getMessage(messageID)
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to get message")
+		return
+	}
+	if !canSee(principal, message) {
+		respondWithMessageError(w, ErrMessageNotFound, "")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if message.SenderID != principal.UserID {
+			auth.RespondWithError(w, http.StatusForbidden, "You can only edit your own messages")
+			return
+		}
+
+		var req models.UpdateMessageRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		// Editing needs the same permission as sending, so removed members can't edit
+		if message.SpaceID != nil && !authorize(w, principal, rbac.PermSendMessages, *message.SpaceID) {
+			return
+		}
+
+		updated, err := updateMessage(messageID, req.Content)
+		if err != nil {
+			respondWithMessageError(w, err, "Failed to update message")
+			return
+		}
+		publishMessageEvent(events.MessageUpdated, updated, principal.UserID, updated)
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Message: "Message updated",
+			Data:    updated,
+		})
+
+	case http.MethodDelete:
+		if message.SenderID != principal.UserID {
+			if message.SpaceID == nil {
+				auth.RespondWithError(w, http.StatusForbidden, "You can only delete your own messages")
+				return
+			}
+			if !authorize(w, principal, rbac.PermDeleteAnyMessage, *message.SpaceID) {
+				return
+			}
+		}
+
+		if err := deleteMessage(messageID); err != nil {
+			respondWithMessageError(w, err, "Failed to delete message")
+			return
+		}
+		publishMessageEvent(events.MessageDeleted, message, principal.UserID, map[string]interface{}{
+			"id":           message.ID,
+			"space_id":     message.SpaceID,
+			"recipient_id": message.RecipientID,
+			"sender_id":    message.SenderID,
+		})
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Message: "Message deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// canSee reports whether a direct message belongs to the principal's conversation.
+// Space messages are checked against the space's permissions instead.
+func canSee(principal *auth.Principal, message models.MessageResponse) bool {
+	if message.SpaceID != nil {
+		return true
+	}
+	return message.SenderID == principal.UserID ||
+		(message.RecipientID != nil && *message.RecipientID == principal.UserID)
+}
+
+// authorize checks a messaging permission in a space. Only members may read or send
+// messages, even in public spaces. Users who can't view the space get 404 rather than
+// 403 so private spaces aren't revealed. It responds and returns false if the
+// permission is missing.
+func authorize(w http.ResponseWriter, principal *auth.Principal, perm rbac.Permission, spaceID uuid.UUID) bool {
+	role, err := rbac.MemberRole(principal, spaceID)
+	if errors.Is(err, rbac.ErrNotMember) {
+		auth.RespondWithError(w, http.StatusForbidden, "Join this space to see and send messages")
+		return false
+	}
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to check permissions")
+		return false
+	}
+
+	if !rbac.SpaceRoleHas(role, rbac.PermViewSpace) {
+		respondWithMessageError(w, rbac.ErrSpaceNotFound, "")
+		return false
+	}
+	if !rbac.SpaceRoleHas(role, perm) {
+		auth.RespondWithError(w, http.StatusForbidden, "You do not have permission to do this")
+		return false
+	}
+	return true
+}
+
+// publishMessageEvent tells the message's space, or both people in its direct
+// message conversation, about a change to it
+func publishMessageEvent(eventType string, message models.MessageResponse, actorID uuid.UUID, data interface{}) {
+	event := events.Event{
+		Type:    eventType,
+		ActorID: &actorID,
+		Data:    data,
+	}
+	if message.SpaceID != nil {
+		event.SpaceID = message.SpaceID
+		event.Permission = string(rbac.PermReadMessages)
+	} else {
+		event.UserIDs = []uuid.UUID{message.SenderID, *message.RecipientID}
+	}
+	events.Publish(event)
+}
+
+// respondWithMessageError maps a messaging error to a response, using message for unexpected errors
+func respondWithMessageError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Message not found")
+	case errors.Is(err, ErrRecipientNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Recipient not found")
+	case errors.Is(err, rbac.ErrSpaceNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Space not found")
+	default:
+		log.Printf("%s: %v", message, err)
+		auth.RespondWithError(w, http.StatusInternalServerError, message)
+	}
+}
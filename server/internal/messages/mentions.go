@@ -0,0 +1,48 @@
+package messages
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// mentionPattern matches @username mentions in message content
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.-]+)`)
+
+// mentionedUsernames returns the usernames mentioned in content, lowercased.
+// A trailing dot is taken to end the sentence rather than the username.
+func mentionedUsernames(content string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], "."))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// saveMentions records which members of the space a message mentions, replacing
+// any mentions recorded for an earlier version of it
+func saveMentions(tx *sql.Tx, messageID, spaceID uuid.UUID, content string) error {
+	if _, err := tx.Exec(`DELETE FROM message_mentions WHERE message_id = $1`, messageID); err != nil {
+		return err
+	}
+
+	names := mentionedUsernames(content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`INSERT INTO message_mentions (message_id, user_id)
+		SELECT $1, u.id FROM users u
+		JOIN space_members sm ON sm.user_id = u.id AND sm.space_id = $2
+		WHERE LOWER(u.username) = ANY($3)`,
+		messageID, spaceID, pq.Array(names))
+	return err
+}
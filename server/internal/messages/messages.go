@@ -0,0 +1,163 @@
+package messages
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+var (
+	// ErrMessageNotFound is returned for an unknown message, or one the user can't see
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrRecipientNotFound is returned when a direct message is sent to an unknown user
+	ErrRecipientNotFound = errors.New("recipient not found")
+)
+
+// messageColumns is the column list scanned by scanMessage. The messages table must be
+// aliased as m and joined to the sender as u, so the sender's username comes with
+// every message instead of taking a query per message.
+const messageColumns = `m.id, m.content, m.sender_id, u.username, m.space_id, m.recipient_id,
+	m.is_direct_message, m.created_at, m.updated_at, m.is_edited`
+
+// messageFrom is the FROM clause that goes with messageColumns
+const messageFrom = `FROM messages m JOIN users u ON u.id = m.sender_id`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a row selected with messageColumns
+func scanMessage(row rowScanner) (models.MessageResponse, error) {
+	var m models.MessageResponse
+	err := row.Scan(&m.ID, &m.Content, &m.SenderID, &m.SenderUsername, &m.SpaceID, &m.RecipientID,
+		&m.IsDirectMessage, &m.CreatedAt, &m.UpdatedAt, &m.IsEdited)
+	return m, err
+}
+
+// getMessage returns a message by ID
+func getMessage(messageID uuid.UUID) (models.MessageResponse, error) {
+	m, err := scanMessage(db.DB.QueryRow(`SELECT `+messageColumns+` `+messageFrom+` WHERE m.id = $1`, messageID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrMessageNotFound
+	}
+	return m, err
+}
+
+// createMessage stores a message in a space or, if recipientID is set, a direct
+// message, and returns it with the sender's username
+func createMessage(senderID uuid.UUID, spaceID, recipientID *uuid.UUID, content string) (models.MessageResponse, error) {
+	now := db.CurrentTime()
+	message := models.Message{
+		ID:              uuid.New(),
+		Content:         strings.TrimSpace(content),
+		SenderID:        senderID,
+		SpaceID:         spaceID,
+		RecipientID:     recipientID,
+		IsDirectMessage: recipientID != nil,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return models.MessageResponse{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO messages (id, content, sender_id, space_id, recipient_id, is_direct_message, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`,
+		message.ID, message.Content, message.SenderID, message.SpaceID, message.RecipientID, message.IsDirectMessage, now)
+	if err != nil {
+		return models.MessageResponse{}, err
+	}
+	if spaceID != nil {
+		if err := saveMentions(tx, message.ID, *spaceID, message.Content); err != nil {
+			return models.MessageResponse{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return models.MessageResponse{}, err
+	}
+
+	return getMessage(message.ID)
+}
+
+// updateMessage replaces a message's content and marks it as edited
+func updateMessage(messageID uuid.UUID, content string) (models.MessageResponse, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return models.MessageResponse{}, err
+	}
+	defer tx.Rollback()
+
+	content = strings.TrimSpace(content)
+	var spaceID *uuid.UUID
+	err = tx.QueryRow(`UPDATE messages SET content = $1, is_edited = TRUE WHERE id = $2 RETURNING space_id`,
+		content, messageID).Scan(&spaceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.MessageResponse{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.MessageResponse{}, err
+	}
+	if spaceID != nil {
+		if err := saveMentions(tx, messageID, *spaceID, content); err != nil {
+			return models.MessageResponse{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return models.MessageResponse{}, err
+	}
+
+	return getMessage(messageID)
+}
+
+// deleteMessage deletes a message
+func deleteMessage(messageID uuid.UUID) error {
+	result, err := db.DB.Exec(`DELETE FROM messages WHERE id = $1`, messageID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// listSpaceMessages returns a page of a space's messages
+func listSpaceMessages(spaceID uuid.UUID, req pageRequest) (models.MessagePage, error) {
+	return listPage(spaceConversation(spaceID), req)
+}
+
+// listDirectMessages returns a page of the direct messages between two users
+func listDirectMessages(userID, otherUserID uuid.UUID, req pageRequest) (models.MessagePage, error) {
+	return listPage(directConversation(userID, otherUserID), req)
+}
+
+// spaceConversation selects a space's messages
+func spaceConversation(spaceID uuid.UUID) conversation {
+	return conversation{where: `m.space_id = $1`, args: []interface{}{spaceID}}
+}
+
+// directConversation selects the direct messages between two users. The
+// condition matches the expression index on direct message conversations.
+func directConversation(userID, otherUserID uuid.UUID) conversation {
+	return conversation{
+		where: `m.is_direct_message = TRUE
+			AND LEAST(m.sender_id, m.recipient_id) = LEAST($1::uuid, $2::uuid)
+			AND GREATEST(m.sender_id, m.recipient_id) = GREATEST($1::uuid, $2::uuid)`,
+		args: []interface{}{userID, otherUserID},
+	}
+}
+
+// userExists reports whether a user exists
+func userExists(userID uuid.UUID) (bool, error) {
+	var exists bool
+	err := db.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,245 @@
+package messages
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+// ErrInvalidCursor is returned for a cursor that wasn't issued by this server
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor is a position in a conversation's history. Messages are ordered by
+// (created_at, id) so messages sent in the same instant still have a fixed order.
+type cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// messageCursor returns the position of a message
+func messageCursor(m models.MessageResponse) cursor {
+	return cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+}
+
+// encode returns the cursor as an opaque token for clients
+func (c cursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID.String()))
+}
+
+// decodeCursor parses a token made by cursor.encode
+func decodeCursor(token string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return cursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	messageID, err := uuid.Parse(id)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return cursor{CreatedAt: time.Unix(0, n).UTC(), ID: messageID}, nil
+}
+
+// pageRequest says which page of a conversation to return. At most one of Before,
+// After and Around is set; with none of them the latest messages are returned.
+type pageRequest struct {
+	Limit  int
+	Before *cursor
+	After  *cursor
+	// Around is a message to jump to, returned in the middle of the page
+	Around *uuid.UUID
+}
+
+// parsePageRequest reads the page query parameters: limit, and at most one of
+// before or after (a cursor from a previous page) or around (a message ID to jump
+// to). It responds with 400 and returns false if they are invalid.
+func parsePageRequest(w http.ResponseWriter, r *http.Request) (pageRequest, bool) {
+	query := r.URL.Query()
+	req := pageRequest{Limit: cfg.DefaultPageSize}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > cfg.MaxPageSize {
+			auth.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", cfg.MaxPageSize))
+			return req, false
+		}
+		req.Limit = limit
+	}
+
+	set := 0
+	for _, name := range []string{"before", "after", "around"} {
+		if query.Get(name) != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		auth.RespondWithError(w, http.StatusBadRequest, "Use only one of before, after and around")
+		return req, false
+	}
+
+	for name, dst := range map[string]**cursor{"before": &req.Before, "after": &req.After} {
+		if value := query.Get(name); value != "" {
+			c, err := decodeCursor(value)
+			if err != nil {
+				auth.RespondWithError(w, http.StatusBadRequest, "Invalid "+name+" cursor")
+				return req, false
+			}
+			*dst = &c
+		}
+	}
+
+	if value := query.Get("around"); value != "" {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			auth.RespondWithError(w, http.StatusBadRequest, "around must be a message ID")
+			return req, false
+		}
+		req.Around = &id
+	}
+
+	return req, true
+}
+
+// conversation is the SQL condition selecting the messages of one space or
+// direct message conversation. It may use the placeholders $1 to $len(args).
+type conversation struct {
+	where string
+	args  []interface{}
+}
+
+// listPage returns a page of a conversation's history, oldest message first
+func listPage(c conversation, req pageRequest) (models.MessagePage, error) {
+	var older, newer []models.MessageResponse
+	var hasOlder, hasNewer bool
+	var err error
+
+	switch {
+	case req.Around != nil:
+		target, err := conversationCursor(c, *req.Around)
+		if err != nil {
+			return models.MessagePage{}, err
+		}
+		// The target message counts towards the older half
+		olderLimit := (req.Limit + 1) / 2
+		newerLimit := req.Limit - olderLimit
+		if older, hasOlder, err = fetchMessages(c, "<=", &target, olderLimit); err != nil {
+			return models.MessagePage{}, err
+		}
+		if newer, hasNewer, err = fetchMessages(c, ">", &target, newerLimit); err != nil {
+			return models.MessagePage{}, err
+		}
+
+	case req.After != nil:
+		newer, hasNewer, err = fetchMessages(c, ">", req.After, req.Limit)
+		hasOlder = true
+
+	default:
+		// Before a cursor, or the latest messages
+		older, hasOlder, err = fetchMessages(c, "<", req.Before, req.Limit)
+		hasNewer = req.Before != nil
+	}
+	if err != nil {
+		return models.MessagePage{}, err
+	}
+
+	// older is newest first, so reverse it onto the front of the page
+	messages := make([]models.MessageResponse, 0, len(older)+len(newer))
+	for i := len(older) - 1; i >= 0; i-- {
+		messages = append(messages, older[i])
+	}
+	messages = append(messages, newer...)
+
+	page := models.MessagePage{Messages: messages}
+	if len(messages) > 0 {
+		if hasOlder {
+			page.Before = messageCursor(messages[0]).encode()
+		}
+		if hasNewer {
+			page.After = messageCursor(messages[len(messages)-1]).encode()
+		}
+	}
+	return page, nil
+}
+
+// fetchMessages returns up to limit messages of a conversation that compare to the
+// cursor as cmp says ("<", "<=" or ">"), nearest to the cursor first, and whether
+// there are more beyond them. Without a cursor it starts from the latest message.
+// The row comparison lets Postgres walk the (conversation, created_at, id) index.
+func fetchMessages(c conversation, cmp string, at *cursor, limit int) ([]models.MessageResponse, bool, error) {
+	where := c.where
+	args := append([]interface{}{}, c.args...)
+	if at != nil {
+		where += fmt.Sprintf(" AND (m.created_at, m.id) %s (%s, %s)", cmp, placeholder(len(args)+1), placeholder(len(args)+2))
+		args = append(args, at.CreatedAt, at.ID)
+	}
+
+	order := "DESC"
+	if cmp == ">" {
+		order = "ASC"
+	}
+
+	// Fetch one extra message to find out whether there are more
+	args = append(args, limit+1)
+	rows, err := db.DB.Query(`SELECT `+messageColumns+` `+messageFrom+`
+		WHERE `+where+`
+		ORDER BY m.created_at `+order+`, m.id `+order+`
+		LIMIT `+placeholder(len(args)), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []models.MessageResponse{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(messages) > limit {
+		return messages[:limit], true, nil
+	}
+	return messages, false, nil
+}
+
+// conversationCursor returns the position of a message in a conversation, or
+// ErrMessageNotFound if the message isn't part of it
+func conversationCursor(c conversation, messageID uuid.UUID) (cursor, error) {
+	args := append(append([]interface{}{}, c.args...), messageID)
+	var at cursor
+	err := db.DB.QueryRow(`SELECT m.created_at, m.id FROM messages m
+		WHERE `+c.where+` AND m.id = `+placeholder(len(args)), args...).Scan(&at.CreatedAt, &at.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cursor{}, ErrMessageNotFound
+	}
+	return at, err
+}
+
+// placeholder returns the nth query placeholder, e.g. "$3"
+func placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
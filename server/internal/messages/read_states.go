@@ -0,0 +1,307 @@
+package messages
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// Unread counts for a space. They expect the user's membership as sm and their
+// read state as r, with the user in $1. Before anything is read, messages from
+// after the user joined count as unread.
+const (
+	spaceUnread = `m.space_id = sm.space_id AND m.sender_id <> $1
+		AND (m.created_at, m.id) > (COALESCE(r.last_read_at, sm.joined_at),
+			COALESCE(r.last_read_message_id, '00000000-0000-0000-0000-000000000000'::uuid))`
+	spaceUnreadCount  = `(SELECT COUNT(*) FROM messages m WHERE ` + spaceUnread + `)`
+	spaceMentionCount = `(SELECT COUNT(*) FROM messages m
+		JOIN message_mentions mm ON mm.message_id = m.id AND mm.user_id = $1
+		WHERE ` + spaceUnread + `)`
+)
+
+// directUnreadCount counts the unread direct messages from the other user p.peer_id
+// to the user in $1, given their read state as r. Every unread direct message also
+// counts as a mention.
+const directUnreadCount = `(SELECT COUNT(*) FROM messages m
+	WHERE m.is_direct_message = TRUE AND m.sender_id = p.peer_id AND m.recipient_id = $1
+	AND (m.created_at, m.id) > (COALESCE(r.last_read_at, '-infinity'::timestamptz),
+		COALESCE(r.last_read_message_id, '00000000-0000-0000-0000-000000000000'::uuid)))`
+
+// SpaceReadStates returns the user's read state in each space they are a member of
+func SpaceReadStates(userID uuid.UUID) (map[uuid.UUID]models.ReadState, error) {
+	rows, err := db.DB.Query(`SELECT sm.space_id, r.last_read_message_id, r.last_read_at,
+			`+spaceUnreadCount+`, `+spaceMentionCount+`
+		FROM space_members sm
+		LEFT JOIN read_states r ON r.user_id = sm.user_id AND r.space_id = sm.space_id
+		WHERE sm.user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := map[uuid.UUID]models.ReadState{}
+	for rows.Next() {
+		var spaceID uuid.UUID
+		var s models.ReadState
+		if err := rows.Scan(&spaceID, &s.LastReadMessageID, &s.LastReadAt, &s.UnreadCount, &s.MentionCount); err != nil {
+			return nil, err
+		}
+		s.SpaceID = &spaceID
+		states[spaceID] = s
+	}
+	return states, rows.Err()
+}
+
+// getSpaceReadState returns a member's read state in a space
+func getSpaceReadState(userID, spaceID uuid.UUID) (models.ReadState, error) {
+	s := models.ReadState{SpaceID: &spaceID}
+	err := db.DB.QueryRow(`SELECT r.last_read_message_id, r.last_read_at,
+			`+spaceUnreadCount+`, `+spaceMentionCount+`
+		FROM space_members sm
+		LEFT JOIN read_states r ON r.user_id = sm.user_id AND r.space_id = sm.space_id
+		WHERE sm.user_id = $1 AND sm.space_id = $2`, userID, spaceID).
+		Scan(&s.LastReadMessageID, &s.LastReadAt, &s.UnreadCount, &s.MentionCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, rbac.ErrNotMember
+	}
+	return s, err
+}
+
+// getDirectReadState returns a user's read state in their conversation with another user
+func getDirectReadState(userID, otherUserID uuid.UUID) (models.ReadState, error) {
+	s := models.ReadState{UserID: &otherUserID}
+	err := db.DB.QueryRow(`SELECT r.last_read_message_id, r.last_read_at, `+directUnreadCount+`
+		FROM (SELECT $2::uuid AS peer_id) p
+		LEFT JOIN read_states r ON r.user_id = $1 AND r.peer_id = p.peer_id`, userID, otherUserID).
+		Scan(&s.LastReadMessageID, &s.LastReadAt, &s.UnreadCount)
+	s.MentionCount = s.UnreadCount
+	return s, err
+}
+
+// listDirectConversations returns the user's direct message conversations, most
+// recently active first
+func listDirectConversations(userID uuid.UUID) ([]models.DirectConversation, error) {
+	rows, err := db.DB.Query(`WITH p AS (
+			SELECT CASE WHEN sender_id = $1 THEN recipient_id ELSE sender_id END AS peer_id,
+				MAX(created_at) AS last_message_at
+			FROM messages
+			WHERE is_direct_message = TRUE AND (sender_id = $1 OR recipient_id = $1)
+			GROUP BY 1
+		)
+		SELECT p.peer_id, u.username, p.last_message_at, r.last_read_message_id, r.last_read_at, `+directUnreadCount+`
+		FROM p
+		JOIN users u ON u.id = p.peer_id
+		LEFT JOIN read_states r ON r.user_id = $1 AND r.peer_id = p.peer_id
+		ORDER BY p.last_message_at DESC, p.peer_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []models.DirectConversation{}
+	for rows.Next() {
+		var c models.DirectConversation
+		s := &c.ReadState
+		if err := rows.Scan(&c.UserID, &c.Username, &c.LastMessageAt, &s.LastReadMessageID, &s.LastReadAt, &s.UnreadCount); err != nil {
+			return nil, err
+		}
+		s.UserID = &c.UserID
+		s.MentionCount = s.UnreadCount
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// markRead moves the user's read position in a space or direct message conversation
+// (whichever of spaceID and peerID is set) up to a message, or the latest message
+// if messageID is nil. The position never moves backwards. It reports whether it moved.
+func markRead(userID uuid.UUID, spaceID, peerID *uuid.UUID, messageID *uuid.UUID) (bool, error) {
+	c := spaceConversationOrDirect(userID, spaceID, peerID)
+
+	var at cursor
+	if messageID != nil {
+		var err error
+		if at, err = conversationCursor(c, *messageID); err != nil {
+			return false, err
+		}
+	} else {
+		latest, _, err := fetchMessages(c, "<", nil, 1)
+		if err != nil || len(latest) == 0 {
+			return false, err
+		}
+		at = messageCursor(latest[0])
+	}
+
+	conflict := `(user_id, space_id) WHERE space_id IS NOT NULL`
+	if peerID != nil {
+		conflict = `(user_id, peer_id) WHERE peer_id IS NOT NULL`
+	}
+
+	result, err := db.DB.Exec(`INSERT INTO read_states (user_id, space_id, peer_id, last_read_message_id, last_read_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT `+conflict+` DO UPDATE
+		SET last_read_message_id = EXCLUDED.last_read_message_id,
+			last_read_at = EXCLUDED.last_read_at,
+			updated_at = EXCLUDED.updated_at
+		WHERE (read_states.last_read_at, read_states.last_read_message_id)
+			< (EXCLUDED.last_read_at, EXCLUDED.last_read_message_id)`,
+		userID, spaceID, peerID, at.ID, at.CreatedAt, db.CurrentTime())
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// spaceConversationOrDirect selects a space's messages, or the direct messages
+// between the user and peerID
+func spaceConversationOrDirect(userID uuid.UUID, spaceID, peerID *uuid.UUID) conversation {
+	if spaceID != nil {
+		return spaceConversation(*spaceID)
+	}
+	return directConversation(userID, *peerID)
+}
+
+// publishReadState tells the user's other devices where they have read up to
+func publishReadState(userID uuid.UUID, state models.ReadState) {
+	events.Publish(events.Event{
+		Type:    events.ReadStateUpdated,
+		UserIDs: []uuid.UUID{userID},
+		ActorID: &userID,
+		Data:    state,
+	})
+}
+
+// SpaceReadStateHandler returns (GET) the current user's read state in a space, or
+// marks it read (POST) up to the message in the body, or its latest message.
+// The space ID comes from the {spaceID} path wildcard.
+func SpaceReadStateHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.MarkReadRequest
+	if r.Method == http.MethodPost && !auth.DecodeJSON(w, r, &req) {
+		return
+	}
+	if !authorize(w, principal, rbac.PermReadMessages, spaceID) {
+		return
+	}
+
+	respondWithReadState(w, r, principal.UserID, &spaceID, nil, req.MessageID)
+}
+
+// DirectReadStateHandler returns (GET) the current user's read state in their direct
+// message conversation with another user, or marks it read (POST) up to the message
+// in the body, or its latest message. The other user's ID comes from the {userID}
+// path wildcard.
+func DirectReadStateHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.MarkReadRequest
+	if r.Method == http.MethodPost && !auth.DecodeJSON(w, r, &req) {
+		return
+	}
+
+	respondWithReadState(w, r, principal.UserID, nil, &userID, req.MessageID)
+}
+
+// respondWithReadState marks the conversation read for POST requests, then
+// responds with the user's read state in it
+func respondWithReadState(w http.ResponseWriter, r *http.Request, userID uuid.UUID, spaceID, peerID, messageID *uuid.UUID) {
+	moved := false
+	if r.Method == http.MethodPost {
+		var err error
+		if moved, err = markRead(userID, spaceID, peerID, messageID); err != nil {
+			respondWithMessageError(w, err, "Failed to mark as read")
+			return
+		}
+	}
+
+	var state models.ReadState
+	var err error
+	if spaceID != nil {
+		state, err = getSpaceReadState(userID, *spaceID)
+	} else {
+		state, err = getDirectReadState(userID, *peerID)
+	}
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to get read state")
+		return
+	}
+
+	if moved {
+		publishReadState(userID, state)
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    state,
+	})
+}
+
+// DirectConversationsHandler lists the current user's direct message conversations
+// with their unread counts, most recently active first
+func DirectConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	conversations, err := listDirectConversations(principal.UserID)
+	if err != nil {
+		respondWithMessageError(w, err, "Failed to list conversations")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    conversations,
+	})
+}
@@ -13,41 +13,58 @@ import (
 type contextKey string
 
 const (
-	// UserIDKey is the key used to store the user ID in the request context
-	UserIDKey contextKey = "user_id"
-	// UserEmailKey is the key used to store the user email in the request context
-	UserEmailKey contextKey = "user_email"
+	// RequiredScopeKey is the key used to store the scope a route requires from personal access tokens
+	RequiredScopeKey contextKey = "required_scope"
+	// MFASetupKey marks routes that users may reach before setting up a required second factor
+	MFASetupKey contextKey = "mfa_setup"
 )
 
-// AuthMiddleware validates the authentication token and adds the user to the request context
+// authenticatedHooks are called for every request AuthMiddleware authenticates
+var authenticatedHooks []func(r *http.Request, principal *auth.Principal)
+
+// OnAuthenticated registers a function that AuthMiddleware calls for every request
+// it authenticates, before the handler runs. Hooks must be registered before the
+// server starts and must not block.
+func OnAuthenticated(hook func(r *http.Request, principal *auth.Principal)) {
+	authenticatedHooks = append(authenticatedHooks, hook)
+}
+
+// AuthMiddleware validates the request's credentials and adds the principal to the request context.
+// Personal access tokens are only accepted on routes wrapped with RequireScope.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// First try to get token from cookie
-		user, err := auth.ExtractUserFromCookie(r)
+		principal, err := resolvePrincipal(r)
 		if err == nil {
-			// Add user to request context
-			ctx := context.WithValue(r.Context(), "user", user)
-			// Call the next handler with the updated context
-			next.ServeHTTP(w, r.WithContext(ctx))
+			for _, hook := range authenticatedHooks {
+				hook(r, principal)
+			}
+			// Call the next handler with the principal in the context
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
 			return
 		}
 
-		// If no valid cookie, try Authorization header
-		tokenString, err := auth.ExtractTokenFromRequest(r)
-		if err == nil {
-			// Validate the token
-			claims, err := auth.ValidateToken(tokenString)
-			if err == nil {
-				// Get user from database
-				user, err := auth.GetUserByEmail(claims.Email)
-				if err == nil {
-					// Add user to request context
-					ctx := context.WithValue(r.Context(), "user", user)
-					// Call the next handler with the updated context
-					next.ServeHTTP(w, r.WithContext(ctx))
-					return
-				}
-			}
+		// A cookie-authenticated request that may have been forged by another site
+		if errors.Is(err, auth.ErrCSRFTokenInvalid) || errors.Is(err, auth.ErrCSRFOriginInvalid) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"CSRF check failed"}`))
+			return
+		}
+
+		// The server requires two-factor authentication and the user hasn't set it up
+		if errors.Is(err, auth.ErrMFASetupRequired) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"Two-factor authentication must be set up"}`))
+			return
+		}
+
+		// The token is valid but not allowed on this route
+		if errors.Is(err, auth.ErrInsufficientScope) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"Token does not have the required scope"}`))
+			return
 		}
 
 		// No valid authentication found
@@ -57,62 +74,130 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// OptionalAuthMiddleware tries to authenticate the user but doesn't require it
+// OptionalAuthMiddleware tries to authenticate the request but doesn't require it
 func OptionalAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Try to get user from cookie
-		user, err := auth.ExtractUserFromCookie(r)
+		principal, err := resolvePrincipal(r)
 		if err == nil {
-			// Add user to request context
-			ctx := context.WithValue(r.Context(), "user", user)
-			// Call the next handler with the updated context
-			next.ServeHTTP(w, r.WithContext(ctx))
+			// Call the next handler with the principal in the context
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
 			return
 		}
 
-		// If no valid cookie, try Authorization header
-		tokenString, err := auth.ExtractTokenFromRequest(r)
-		if err == nil {
-			// Validate the token
-			claims, err := auth.ValidateToken(tokenString)
-			if err == nil {
-				// Get user from database
-				user, err := auth.GetUserByEmail(claims.Email)
-				if err == nil {
-					// Add user to request context
-					ctx := context.WithValue(r.Context(), "user", user)
-					// Call the next handler with the updated context
-					next.ServeHTTP(w, r.WithContext(ctx))
-					return
-				}
-			}
+		// Forged cookie-authenticated requests are rejected rather than treated as anonymous
+		if errors.Is(err, auth.ErrCSRFTokenInvalid) || errors.Is(err, auth.ErrCSRFOriginInvalid) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"CSRF check failed"}`))
+			return
 		}
 
 		// No valid authentication found, but that's ok for this middleware
-		// Continue with no user in context
+		// Continue with no principal in context
 		next.ServeHTTP(w, r)
 	})
 }
 
+// RequireScope is a wrapper for routes that personal access tokens may use.
+// Tokens must have the given scope; login sessions have full access.
+func RequireScope(scope string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), RequiredScopeKey, scope)
+		AuthMiddleware(handler).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AllowMFASetup is a wrapper for the routes a user needs to set up two-factor
+// authentication. When MFA_REQUIRED is on, users without it can only reach these.
+func AllowMFASetup(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), MFASetupKey, true)
+		AuthMiddleware(handler).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolvePrincipal authenticates the request and checks that its credential may be
+// used on this route. Personal access tokens need the scope declared by the route,
+// cookie-authenticated requests must pass the CSRF check, and when two-factor
+// authentication is required, users without it only get the AllowMFASetup routes.
+func resolvePrincipal(r *http.Request) (*auth.Principal, error) {
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := auth.VerifyCSRF(r, principal); err != nil {
+		return nil, err
+	}
+
+	if auth.CurrentConfig().MFARequired && !principal.User.TOTPEnabled {
+		if allowed, _ := r.Context().Value(MFASetupKey).(bool); !allowed {
+			return nil, auth.ErrMFASetupRequired
+		}
+	}
+
+	if principal.Method == auth.AuthMethodPersonalAccessToken {
+		required, ok := r.Context().Value(RequiredScopeKey).(string)
+		if !ok || !principal.HasScope(required) {
+			return nil, auth.ErrInsufficientScope
+		}
+	}
+
+	return principal, nil
+}
+
+// GetPrincipalFromContext retrieves the authenticated principal from the request context
+func GetPrincipalFromContext(ctx context.Context) (*auth.Principal, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errors.New("principal not found in context")
+	}
+	return principal, nil
+}
+
 // GetUserIDFromContext retrieves the user ID from the request context
 func GetUserIDFromContext(ctx context.Context) (uuid.UUID, error) {
-	userID, ok := ctx.Value(UserIDKey).(uuid.UUID)
-	if !ok {
-		return uuid.Nil, errors.New("user ID not found in context")
+	principal, err := GetPrincipalFromContext(ctx)
+	if err != nil {
+		return uuid.Nil, err
 	}
-	return userID, nil
+	return principal.UserID, nil
 }
 
 // GetUserEmailFromContext retrieves the user email from the request context
 func GetUserEmailFromContext(ctx context.Context) (string, error) {
-	email, ok := ctx.Value(UserEmailKey).(string)
-	if !ok {
-		return "", errors.New("user email not found in context")
+	principal, err := GetPrincipalFromContext(ctx)
+	if err != nil {
+		return "", err
 	}
-	return email, nil
+	return principal.Email, nil
 }
 
 // RequireAuth is a convenient wrapper for routes that require authentication
 func RequireAuth(handler http.HandlerFunc) http.Handler {
 	return AuthMiddleware(http.HandlerFunc(handler))
-} 
\ No newline at end of file
+}
+
+// RequireVerifiedEmail rejects users who have not verified their email address
+// when the email verification policy restricts unverified accounts.
+// It must run after AuthMiddleware.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth.UserFromContext(r.Context())
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"success":false,"error":"Unauthorized"}`))
+			return
+		}
+
+		if !user.IsEmailVerified && auth.CurrentConfig().EmailVerificationPolicy != auth.VerificationPolicyNone {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"Email address has not been verified"}`))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
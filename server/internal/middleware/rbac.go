@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// RequirePermission rejects requests whose principal lacks the permission.
+// Space permissions are checked in the space named by the {spaceID} path wildcard.
+// It must run after AuthMiddleware.
+func RequirePermission(perm rbac.Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"success":false,"error":"Unauthorized"}`))
+			return
+		}
+
+		var spaceID uuid.UUID
+		if rbac.IsSpacePermission(perm) {
+			id, err := uuid.Parse(r.PathValue("spaceID"))
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"success":false,"error":"Invalid space ID"}`))
+				return
+			}
+			spaceID = id
+		}
+
+		allowed, err := rbac.Can(principal, perm, spaceID)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if errors.Is(err, rbac.ErrSpaceNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"success":false,"error":"Space not found"}`))
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"success":false,"error":"Failed to check permissions"}`))
+			return
+		}
+
+		if !allowed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"error":"You do not have permission to do this"}`))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
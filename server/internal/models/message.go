@@ -8,54 +8,91 @@ import (
 
 // Message represents a chat message in the system
 type Message struct {
-	ID             uuid.UUID  `json:"id"`
-	Content        string     `json:"content"`
-	SenderID       uuid.UUID  `json:"sender_id"`
-	SpaceID        *uuid.UUID `json:"space_id,omitempty"`
-	RecipientID    *uuid.UUID `json:"recipient_id,omitempty"`
+	ID              uuid.UUID  `json:"id"`
+	Content         string     `json:"content"`
+	SenderID        uuid.UUID  `json:"sender_id"`
+	SpaceID         *uuid.UUID `json:"space_id,omitempty"`
+	RecipientID     *uuid.UUID `json:"recipient_id,omitempty"`
 	IsDirectMessage bool       `json:"is_direct_message"`
-	CreatedAt      time.Time  `json:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at"`
-	IsEdited       bool       `json:"is_edited"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	IsEdited        bool       `json:"is_edited"`
 }
 
 // MessageResponse is the data structure returned to clients
 type MessageResponse struct {
-	ID             uuid.UUID  `json:"id"`
-	Content        string     `json:"content"`
-	SenderID       uuid.UUID  `json:"sender_id"`
-	SenderUsername string     `json:"sender_username,omitempty"`
-	SpaceID        *uuid.UUID `json:"space_id,omitempty"`
-	RecipientID    *uuid.UUID `json:"recipient_id,omitempty"`
+	ID              uuid.UUID  `json:"id"`
+	Content         string     `json:"content"`
+	SenderID        uuid.UUID  `json:"sender_id"`
+	SenderUsername  string     `json:"sender_username,omitempty"`
+	SpaceID         *uuid.UUID `json:"space_id,omitempty"`
+	RecipientID     *uuid.UUID `json:"recipient_id,omitempty"`
 	IsDirectMessage bool       `json:"is_direct_message"`
-	CreatedAt      time.Time  `json:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at"`
-	IsEdited       bool       `json:"is_edited"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	IsEdited        bool       `json:"is_edited"`
 }
 
 // ToResponse converts a Message to a MessageResponse
 func (m *Message) ToResponse() MessageResponse {
 	return MessageResponse{
-		ID:             m.ID,
-		Content:        m.Content,
-		SenderID:       m.SenderID,
-		SpaceID:        m.SpaceID,
-		RecipientID:    m.RecipientID,
+		ID:              m.ID,
+		Content:         m.Content,
+		SenderID:        m.SenderID,
+		SpaceID:         m.SpaceID,
+		RecipientID:     m.RecipientID,
 		IsDirectMessage: m.IsDirectMessage,
-		CreatedAt:      m.CreatedAt,
-		UpdatedAt:      m.UpdatedAt,
-		IsEdited:       m.IsEdited,
+		CreatedAt:       m.CreatedAt,
+		UpdatedAt:       m.UpdatedAt,
+		IsEdited:        m.IsEdited,
 	}
 }
 
+// MessagePage is one page of a conversation's history, oldest message first
+type MessagePage struct {
+	Messages []MessageResponse `json:"messages"`
+	// Before is the cursor for the page of older messages, empty at the start of the history
+	Before string `json:"before,omitempty"`
+	// After is the cursor for the page of newer messages, empty at the latest message
+	After string `json:"after,omitempty"`
+}
+
 // CreateMessageRequest is the data structure for message creation
 type CreateMessageRequest struct {
-	Content     string     `json:"content" validate:"required"`
+	Content     string     `json:"content" validate:"required,max=4000"`
 	SpaceID     *uuid.UUID `json:"space_id"`
 	RecipientID *uuid.UUID `json:"recipient_id"`
 }
 
 // UpdateMessageRequest is the data structure for updating a message
 type UpdateMessageRequest struct {
-	Content string `json:"content" validate:"required"`
-} 
\ No newline at end of file
+	Content string `json:"content" validate:"required,max=4000"`
+}
+
+// ReadState is how far a user has read a space or a direct message conversation.
+// The read position is the newest message they have read; unread counts leave out
+// their own messages.
+type ReadState struct {
+	SpaceID *uuid.UUID `json:"space_id,omitempty"`
+	// UserID is the other user of a direct message conversation
+	UserID            *uuid.UUID `json:"user_id,omitempty"`
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id,omitempty"`
+	// LastReadAt is when the last read message was sent
+	LastReadAt   *time.Time `json:"last_read_at,omitempty"`
+	UnreadCount  int        `json:"unread_count"`
+	MentionCount int        `json:"mention_count"`
+}
+
+// DirectConversation is a direct message conversation in the conversation list
+type DirectConversation struct {
+	UserID        uuid.UUID `json:"user_id"`
+	Username      string    `json:"username"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	ReadState     ReadState `json:"read_state"`
+}
+
+// MarkReadRequest is the data structure for marking a conversation read up to a
+// message. Without a message ID it is marked read up to its latest message.
+type MarkReadRequest struct {
+	MessageID *uuid.UUID `json:"message_id"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Passkey represents a WebAuthn credential registered by a user
+type Passkey struct {
+	ID              uuid.UUID  `json:"id"`
+	UserID          uuid.UUID  `json:"user_id"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `json:"-"`
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `json:"-"`
+	Transports      []string   `json:"transports"`
+	Flags           uint8      `json:"-"` // Raw authenticator flags from registration
+	CloneWarning    bool       `json:"-"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasskeyResponse is the data structure returned to clients
+type PasskeyResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ToResponse converts a Passkey to a PasskeyResponse
+func (p *Passkey) ToResponse() PasskeyResponse {
+	return PasskeyResponse{
+		ID:         p.ID,
+		Name:       p.Name,
+		Transports: p.Transports,
+		CreatedAt:  p.CreatedAt,
+		LastUsedAt: p.LastUsedAt,
+	}
+}
+
+// PasskeyCeremonyResponse is returned when a registration or login ceremony begins.
+// Options is passed to navigator.credentials.create() or .get() in the browser.
+type PasskeyCeremonyResponse struct {
+	CeremonyID uuid.UUID   `json:"ceremony_id"`
+	Options    interface{} `json:"options"`
+}
+
+// BeginPasskeyLoginRequest optionally names the account to log into.
+// Without an email the browser offers every passkey it has for this site.
+type BeginPasskeyLoginRequest struct {
+	Email string `json:"email" validate:"omitempty,email"`
+}
+
+// FinishPasskeyRequest completes a registration or login ceremony
+type FinishPasskeyRequest struct {
+	CeremonyID uuid.UUID       `json:"ceremony_id" validate:"required"`
+	Name       string          `json:"name" validate:"omitempty,max=100"` // Only used for registration
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
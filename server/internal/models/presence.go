@@ -0,0 +1,71 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Presence statuses. Users choose online, away, dnd (do not disturb) or invisible;
+// invisible users and users without a live connection or recent activity appear offline.
+const (
+	PresenceOnline    = "online"
+	PresenceAway      = "away"
+	PresenceDND       = "dnd"
+	PresenceInvisible = "invisible"
+	PresenceOffline   = "offline"
+)
+
+// UserStatus is a user's presence as stored in user_status
+type UserStatus struct {
+	UserID     uuid.UUID
+	IsOnline   bool
+	LastActive *time.Time
+	// Status is the status the user chose
+	Status              string
+	StatusText          *string
+	StatusTextExpiresAt *time.Time
+}
+
+// PresenceResponse is the data structure returned to clients
+type PresenceResponse struct {
+	UserID              uuid.UUID  `json:"user_id"`
+	Status              string     `json:"status"`
+	StatusText          *string    `json:"status_text,omitempty"`
+	StatusTextExpiresAt *time.Time `json:"status_text_expires_at,omitempty"`
+	LastActive          *time.Time `json:"last_active,omitempty"`
+}
+
+// ToResponse converts a UserStatus to the presence shown to other users, or to
+// the user themselves when self is true. Others see invisible users as offline
+// without their status text.
+func (s *UserStatus) ToResponse(self bool) PresenceResponse {
+	response := PresenceResponse{
+		UserID:              s.UserID,
+		Status:              s.Status,
+		StatusText:          s.StatusText,
+		StatusTextExpiresAt: s.StatusTextExpiresAt,
+		LastActive:          s.LastActive,
+	}
+	if self {
+		return response
+	}
+
+	if s.Status == PresenceInvisible {
+		response.StatusText = nil
+		response.StatusTextExpiresAt = nil
+		response.LastActive = nil
+	}
+	if !s.IsOnline || s.Status == PresenceInvisible {
+		response.Status = PresenceOffline
+	}
+	return response
+}
+
+// UpdatePresenceRequest is the data structure for setting a user's status.
+// Leaving out status_text clears it.
+type UpdatePresenceRequest struct {
+	Status              string     `json:"status" validate:"required,oneof=online away dnd invisible"`
+	StatusText          *string    `json:"status_text" validate:"omitempty,max=128"`
+	StatusTextExpiresAt *time.Time `json:"status_text_expires_at"`
+}
@@ -26,6 +26,8 @@ type SpaceResponse struct {
 	IsPublic    bool      `json:"is_public"`
 	CreatedAt   time.Time `json:"created_at"`
 	MemberCount int       `json:"member_count,omitempty"`
+	// ReadState is included when listing the user's own spaces
+	ReadState *ReadState `json:"read_state,omitempty"`
 }
 
 // ToResponse converts a Space to a SpaceResponse
@@ -43,7 +45,7 @@ func (s *Space) ToResponse() SpaceResponse {
 // CreateSpaceRequest is the data structure for space creation
 type CreateSpaceRequest struct {
 	Name        string `json:"name" validate:"required,min=3,max=100"`
-	Description string `json:"description"`
+	Description string `json:"description" validate:"max=1000"`
 	IsPublic    bool   `json:"is_public"`
 }
 
@@ -51,13 +53,79 @@ type CreateSpaceRequest struct {
 type SpaceMember struct {
 	SpaceID  uuid.UUID `json:"space_id"`
 	UserID   uuid.UUID `json:"user_id"`
-	Role     string    `json:"role"` // e.g., "admin", "member"
+	Role     string    `json:"role"` // owner, admin, moderator, member or guest
 	JoinedAt time.Time `json:"joined_at"`
 }
 
-// UpdateSpaceRequest is the data structure for updating space details
+// UpdateSpaceRequest is the data structure for updating space details.
+// Fields that are omitted are left unchanged.
 type UpdateSpaceRequest struct {
-	Name        string `json:"name" validate:"omitempty,min=3,max=100"`
-	Description string `json:"description"`
-	IsPublic    *bool  `json:"is_public"`
-} 
\ No newline at end of file
+	Name        string  `json:"name" validate:"omitempty,min=3,max=100"`
+	Description *string `json:"description" validate:"omitempty,max=1000"`
+	IsPublic    *bool   `json:"is_public"`
+}
+
+// SpaceMemberResponse is a member of a space as returned to clients
+type SpaceMemberResponse struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// SpaceInvite invites a specific user to join a space
+type SpaceInvite struct {
+	ID        uuid.UUID `json:"id"`
+	SpaceID   uuid.UUID `json:"space_id"`
+	SpaceName string    `json:"space_name"`
+	InviterID uuid.UUID `json:"inviter_id"`
+	InviteeID uuid.UUID `json:"invitee_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateSpaceInviteRequest names the user to invite
+type CreateSpaceInviteRequest struct {
+	Username string `json:"username" validate:"required,max=50"`
+}
+
+// SpaceInviteLink is a shareable link that lets anyone who has it join a space
+type SpaceInviteLink struct {
+	ID        uuid.UUID  `json:"id"`
+	SpaceID   uuid.UUID  `json:"space_id"`
+	CreatorID uuid.UUID  `json:"creator_id"`
+	MaxUses   *int       `json:"max_uses,omitempty"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// Token is only set in the response to creating the link
+	Token string `json:"token,omitempty"`
+}
+
+// CreateSpaceInviteLinkRequest is the data structure for creating an invite link
+type CreateSpaceInviteLinkRequest struct {
+	MaxUses   *int       `json:"max_uses" validate:"omitempty,min=1,max=10000"` // Optional, unlimited when omitted
+	ExpiresAt *time.Time `json:"expires_at"`                                    // Optional, defaults to 7 days
+}
+
+// RedeemSpaceInviteLinkRequest joins a space with an invite link token
+type RedeemSpaceInviteLinkRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// SpaceJoinRequest asks to join a private space
+type SpaceJoinRequest struct {
+	ID         uuid.UUID  `json:"id"`
+	SpaceID    uuid.UUID  `json:"space_id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Username   string     `json:"username"`
+	Message    string     `json:"message,omitempty"`
+	Status     string     `json:"status"` // pending, approved or rejected
+	ReviewerID *uuid.UUID `json:"reviewer_id,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateSpaceJoinRequest is the data structure for asking to join a private space
+type CreateSpaceJoinRequest struct {
+	Message string `json:"message" validate:"max=500"`
+}
@@ -8,45 +8,94 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID                  uuid.UUID `json:"id"`
-	Username            string    `json:"username"`
-	Email               string    `json:"email"`
-	PasswordHash        string    `json:"-"` // Never expose password hash
-	IsEmailVerified     bool      `json:"is_email_verified"`
-	EmailVerificationToken string    `json:"-"`
-	CreatedAt           time.Time `json:"created_at"`
-	UpdatedAt           time.Time `json:"updated_at"`
+	ID                         uuid.UUID  `json:"id"`
+	Username                   string     `json:"username"`
+	Email                      string     `json:"email"`
+	Role                       string     `json:"role"` // Server-level role
+	PasswordHash               string     `json:"-"`    // Never expose password hash
+	IsEmailVerified            bool       `json:"is_email_verified"`
+	EmailVerificationToken     string     `json:"-"` // SHA-256 hash of the token sent by email
+	EmailVerificationExpiresAt *time.Time `json:"-"`
+	EmailVerificationSentAt    *time.Time `json:"-"`
+	PasswordChangedAt          *time.Time `json:"-"`
+	TOTPSecret                 string     `json:"-"`
+	TOTPEnabled                bool       `json:"two_factor_enabled"`
+	TOTPLastUsedStep           int64      `json:"-"` // Last accepted TOTP time step, to prevent code replay
+	CreatedAt                  time.Time  `json:"created_at"`
+	UpdatedAt                  time.Time  `json:"updated_at"`
 }
 
 // UserResponse is the data structure returned to clients
 type UserResponse struct {
-	ID              uuid.UUID `json:"id"`
-	Username        string    `json:"username"`
-	Email           string    `json:"email"`
-	IsEmailVerified bool      `json:"is_email_verified"`
-	CreatedAt       time.Time `json:"created_at"`
+	ID               uuid.UUID `json:"id"`
+	Username         string    `json:"username"`
+	Email            string    `json:"email"`
+	Role             string    `json:"role"`
+	IsEmailVerified  bool      `json:"is_email_verified"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 // ToResponse converts a User to a UserResponse
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:              u.ID,
-		Username:        u.Username,
-		Email:           u.Email,
-		IsEmailVerified: u.IsEmailVerified,
-		CreatedAt:       u.CreatedAt,
+		ID:               u.ID,
+		Username:         u.Username,
+		Email:            u.Email,
+		Role:             u.Role,
+		IsEmailVerified:  u.IsEmailVerified,
+		TwoFactorEnabled: u.TOTPEnabled,
+		CreatedAt:        u.CreatedAt,
 	}
 }
 
 // CreateUserRequest is the data structure for user creation
 type CreateUserRequest struct {
-	Username string `json:"username" validate:"required,min=3,max=50"`
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
+	Username string `json:"username" validate:"required,min=3,max=50,username"`
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"` // bcrypt rejects passwords over 72 bytes
 }
 
 // LoginRequest is the data structure for user login
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
-} 
\ No newline at end of file
+}
+
+// VerifyEmailRequest is the data structure for email verification
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// ResendVerificationRequest is the data structure for requesting a new verification email
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ForgotPasswordRequest is the data structure for requesting a password reset email
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ResetPasswordRequest is the data structure for setting a new password with a reset token
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"`
+}
+
+// UnlockAccountRequest is the data structure for unlocking a locked account
+type UnlockAccountRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// UpdateRoleRequest is the data structure for granting a server or space role
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+// RoleResponse describes a user's role after it was changed
+type RoleResponse struct {
+	UserID  uuid.UUID  `json:"user_id"`
+	SpaceID *uuid.UUID `json:"space_id,omitempty"`
+	Role    string     `json:"role"`
+}
@@ -0,0 +1,48 @@
+package presence
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gotext/server/internal/config"
+)
+
+// Config holds presence configuration
+type Config struct {
+	// OfflineDelay is how long a user stays online after their last real-time
+	// connection closes, so reconnecting clients don't flap offline and back
+	OfflineDelay time.Duration
+	// ActivityWindow is how long an API request keeps a user without a
+	// real-time connection online
+	ActivityWindow time.Duration
+}
+
+// DefaultConfig returns the presence configuration from the environment.
+// It returns an error naming any variable that is set but malformed.
+func DefaultConfig() (Config, error) {
+	env := &config.Env{}
+	c := Config{
+		OfflineDelay:   env.Duration("PRESENCE_OFFLINE_DELAY", 10*time.Second),
+		ActivityWindow: env.Duration("PRESENCE_ACTIVITY_WINDOW", 5*time.Minute),
+	}
+	return c, env.Err()
+}
+
+// cfg is the active presence configuration
+var cfg = Config{
+	OfflineDelay:   10 * time.Second,
+	ActivityWindow: 5 * time.Minute,
+}
+
+// Init validates and applies the presence configuration
+func Init(config Config) error {
+	if config.OfflineDelay < 0 {
+		return fmt.Errorf("PRESENCE_OFFLINE_DELAY must not be negative")
+	}
+	if config.ActivityWindow < time.Minute {
+		return fmt.Errorf("PRESENCE_ACTIVITY_WINDOW must be at least a minute")
+	}
+
+	cfg = config
+	return nil
+}
@@ -0,0 +1,131 @@
+package presence
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+// maxPresenceQuery is the most users whose presence can be asked for at once
+const maxPresenceQuery = 100
+
+// PresenceHandler returns the presence of the users listed in ?user_ids=, comma
+// separated. Users who share no space or conversation with the caller are left out.
+func PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var userIDs []uuid.UUID
+	for _, value := range strings.Split(r.URL.Query().Get("user_ids"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		id, err := uuid.Parse(value)
+		if err != nil {
+			auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+	if len(userIDs) == 0 {
+		auth.RespondWithError(w, http.StatusBadRequest, "user_ids is required")
+		return
+	}
+	if len(userIDs) > maxPresenceQuery {
+		auth.RespondWithError(w, http.StatusBadRequest, "Too many user IDs")
+		return
+	}
+
+	presence, err := listPresence(principal.UserID, userIDs)
+	if err != nil {
+		log.Printf("Failed to get presence: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to get presence")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    presence,
+	})
+}
+
+// StatusHandler returns (GET) or sets (PUT) the current user's own status
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := getStatus(principal.UserID)
+		if err != nil {
+			log.Printf("Failed to get status: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to get status")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    status.ToResponse(true),
+		})
+
+	case http.MethodPut:
+		if !principal.HasScope(auth.ScopeMessagesWrite) {
+			auth.RespondWithError(w, http.StatusForbidden, "Token does not have the required scope")
+			return
+		}
+
+		var req models.UpdatePresenceRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+		if req.StatusText != nil {
+			if text := strings.TrimSpace(*req.StatusText); text != "" {
+				req.StatusText = &text
+			} else {
+				req.StatusText = nil
+			}
+		}
+		if req.StatusText == nil {
+			req.StatusTextExpiresAt = nil
+		}
+		if req.StatusTextExpiresAt != nil && !req.StatusTextExpiresAt.After(db.CurrentTime()) {
+			auth.RespondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+			return
+		}
+
+		before, after, err := setStatus(principal.UserID, req)
+		if err != nil {
+			log.Printf("Failed to set status: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to set status")
+			return
+		}
+		publishChange(before, after)
+		publishOwn(after)
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Message: "Status updated",
+			Data:    after.ToResponse(true),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,218 @@
+package presence
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/lib/pq"
+)
+
+// statusColumns are the user_status columns read by scanStatus
+const statusColumns = `s.user_id, s.is_online, s.last_active, s.status, s.status_text, s.status_text_expires_at`
+
+// contactsQuery selects the users who share a space or a direct message
+// conversation with the user in $1, and so may see their presence
+const contactsQuery = `SELECT m2.user_id FROM space_members m1
+		JOIN space_members m2 ON m2.space_id = m1.space_id
+		WHERE m1.user_id = $1
+	UNION
+	SELECT recipient_id FROM messages WHERE is_direct_message AND sender_id = $1
+	UNION
+	SELECT sender_id FROM messages WHERE is_direct_message AND recipient_id = $1`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanStatus reads a user_status row selected with statusColumns. Expired status
+// text is left out.
+func scanStatus(row rowScanner) (models.UserStatus, error) {
+	var s models.UserStatus
+	err := row.Scan(&s.UserID, &s.IsOnline, &s.LastActive, &s.Status, &s.StatusText, &s.StatusTextExpiresAt)
+	if err != nil {
+		return models.UserStatus{}, err
+	}
+	clearExpiredText(&s)
+	return s, nil
+}
+
+// clearExpiredText removes status text whose expiry has passed
+func clearExpiredText(s *models.UserStatus) {
+	if s.StatusTextExpiresAt != nil && !s.StatusTextExpiresAt.After(db.CurrentTime()) {
+		s.StatusText = nil
+		s.StatusTextExpiresAt = nil
+	}
+}
+
+// ensureStatus creates the user's status row if they don't have one yet
+func ensureStatus(userID uuid.UUID) error {
+	_, err := db.DB.Exec(`INSERT INTO user_status (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`, userID)
+	return err
+}
+
+// getStatus returns a user's stored presence
+func getStatus(userID uuid.UUID) (models.UserStatus, error) {
+	if err := ensureStatus(userID); err != nil {
+		return models.UserStatus{}, err
+	}
+	return scanStatus(db.DB.QueryRow(`SELECT `+statusColumns+` FROM user_status s WHERE s.user_id = $1`, userID))
+}
+
+// markOnline records activity by a user and marks them online. It returns the
+// status before and after.
+func markOnline(userID uuid.UUID, now time.Time) (before, after models.UserStatus, err error) {
+	if err := ensureStatus(userID); err != nil {
+		return before, after, err
+	}
+
+	// Joining the table to itself reads the row as it was before the update
+	var wasOnline bool
+	err = db.DB.QueryRow(`UPDATE user_status s SET is_online = TRUE, last_active = $2
+		FROM user_status old
+		WHERE s.user_id = $1 AND old.user_id = s.user_id
+		RETURNING `+statusColumns+`, old.is_online`, userID, now).
+		Scan(&after.UserID, &after.IsOnline, &after.LastActive, &after.Status, &after.StatusText, &after.StatusTextExpiresAt, &wasOnline)
+	if err != nil {
+		return before, after, err
+	}
+	clearExpiredText(&after)
+
+	before = after
+	before.IsOnline = wasOnline
+	return before, after, nil
+}
+
+// markOffline marks a user offline unless another server instance still has a
+// live connection for them. It returns sql.ErrNoRows if they weren't online.
+func markOffline(userID uuid.UUID, now time.Time) (models.UserStatus, error) {
+	return scanStatus(db.DB.QueryRow(`UPDATE user_status s SET is_online = FALSE, last_active = $2
+		WHERE s.user_id = $1 AND s.is_online
+		AND NOT EXISTS (SELECT 1 FROM presence_connections c WHERE c.user_id = $1 AND c.seen_at > $3)
+		RETURNING `+statusColumns, userID, now, now.Add(-connectionTTL)))
+}
+
+// setStatus stores the status a user chose and returns the status before and after
+func setStatus(userID uuid.UUID, req models.UpdatePresenceRequest) (before, after models.UserStatus, err error) {
+	before, err = getStatus(userID)
+	if err != nil {
+		return before, after, err
+	}
+
+	after, err = scanStatus(db.DB.QueryRow(`UPDATE user_status s
+		SET status = $2, status_text = $3, status_text_expires_at = $4
+		WHERE s.user_id = $1
+		RETURNING `+statusColumns, userID, req.Status, req.StatusText, req.StatusTextExpiresAt))
+	return before, after, err
+}
+
+// listPresence returns the presence of the requested users that the viewer may
+// see: themselves and the users they share a space or conversation with
+func listPresence(viewerID uuid.UUID, userIDs []uuid.UUID) ([]models.PresenceResponse, error) {
+	ids := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		ids = append(ids, id.String())
+	}
+
+	rows, err := db.DB.Query(`SELECT u.id, COALESCE(s.is_online, FALSE), s.last_active,
+			COALESCE(s.status, 'online'), s.status_text, s.status_text_expires_at
+		FROM users u
+		LEFT JOIN user_status s ON s.user_id = u.id
+		WHERE u.id = ANY($2::uuid[]) AND (u.id = $1 OR u.id IN (`+contactsQuery+`))`,
+		viewerID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	presence := []models.PresenceResponse{}
+	for rows.Next() {
+		s, err := scanStatus(rows)
+		if err != nil {
+			return nil, err
+		}
+		presence = append(presence, s.ToResponse(s.UserID == viewerID))
+	}
+	return presence, rows.Err()
+}
+
+// contacts returns the users who may see a user's presence, not including the user
+func contacts(userID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := db.DB.Query(contactsQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id != userID {
+			users = append(users, id)
+		}
+	}
+	return users, rows.Err()
+}
+
+// publishChange tells the user's contacts about a change to the presence they
+// see. Changes invisible to them, such as an invisible user connecting, are not sent.
+func publishChange(before, after models.UserStatus) {
+	old, current := before.ToResponse(false), after.ToResponse(false)
+	if samePresence(old, current) {
+		return
+	}
+
+	users, err := contacts(after.UserID)
+	if err != nil {
+		log.Printf("Failed to find who can see %s's presence: %v", after.UserID, err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:    events.PresenceUpdated,
+		UserIDs: users,
+		Data:    current,
+	})
+}
+
+// publishOwn tells the user's other devices about a status they set
+func publishOwn(status models.UserStatus) {
+	events.Publish(events.Event{
+		Type:    events.PresenceUpdated,
+		UserIDs: []uuid.UUID{status.UserID},
+		ActorID: &status.UserID,
+		Data:    status.ToResponse(true),
+	})
+}
+
+// samePresence reports whether two presences look the same, ignoring last activity
+func samePresence(a, b models.PresenceResponse) bool {
+	return a.Status == b.Status && sameText(a.StatusText, b.StatusText) &&
+		sameTime(a.StatusTextExpiresAt, b.StatusTextExpiresAt)
+}
+
+// sameText compares optional strings
+func sameText(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sameTime compares optional times
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
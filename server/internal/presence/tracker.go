@@ -0,0 +1,260 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+)
+
+const (
+	// heartbeatInterval is how often this instance refreshes its connection rows
+	// and sweeps for users who have gone offline
+	heartbeatInterval = 30 * time.Second
+	// connectionTTL is how long connection rows count after their last refresh,
+	// so users connected to an instance that stopped go offline
+	connectionTTL = 3 * heartbeatInterval
+	// touchInterval limits how often API activity is recorded per user
+	touchInterval = time.Minute
+)
+
+// instanceID identifies this server instance's rows in presence_connections
+var instanceID = uuid.New()
+
+// tracker counts this instance's live connections per user. Database updates
+// happen in the background so callers never wait on them.
+type tracker struct {
+	mu          sync.Mutex
+	connections map[uuid.UUID]int
+	// offline holds the pending offline timers of users whose last connection closed
+	offline map[uuid.UUID]*time.Timer
+	touched map[uuid.UUID]time.Time
+}
+
+// defaultTracker is the tracker used by Connected, Disconnected and Touch
+var defaultTracker = &tracker{
+	connections: map[uuid.UUID]int{},
+	offline:     map[uuid.UUID]*time.Timer{},
+	touched:     map[uuid.UUID]time.Time{},
+}
+
+// Connected records a new real-time connection for a user. It doesn't block.
+func Connected(userID uuid.UUID) {
+	defaultTracker.connected(userID)
+}
+
+// Disconnected records that one of a user's real-time connections closed. The
+// user goes offline once OfflineDelay passes without them reconnecting. It doesn't block.
+func Disconnected(userID uuid.UUID) {
+	defaultTracker.disconnected(userID)
+}
+
+// Touch records API activity by a user, which keeps them online for
+// ActivityWindow. It doesn't block.
+func Touch(userID uuid.UUID) {
+	defaultTracker.touch(userID)
+}
+
+// Start refreshes this instance's connections and marks users offline once their
+// connections and activity have lapsed, until ctx ends. It then removes this
+// instance's connections so other instances can mark its users offline.
+func Start(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := db.DB.Exec(`DELETE FROM presence_connections WHERE instance_id = $1`, instanceID); err != nil {
+				log.Printf("Failed to remove presence connections: %v", err)
+			}
+			return
+		case <-ticker.C:
+			defaultTracker.heartbeat()
+			sweep()
+		}
+	}
+}
+
+func (t *tracker) connected(userID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.connections[userID]++
+	if timer, ok := t.offline[userID]; ok {
+		// Reconnected before going offline, so as far as anyone else knows
+		// nothing happened
+		timer.Stop()
+		delete(t.offline, userID)
+		return
+	}
+	if t.connections[userID] == 1 {
+		go goOnline(userID)
+	}
+}
+
+func (t *tracker) disconnected(userID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.connections[userID]--
+	if t.connections[userID] > 0 {
+		return
+	}
+	delete(t.connections, userID)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(cfg.OfflineDelay, func() {
+		t.mu.Lock()
+		current := t.offline[userID] == timer
+		if current {
+			delete(t.offline, userID)
+		}
+		t.mu.Unlock()
+
+		if current {
+			goOffline(userID)
+		}
+	})
+	t.offline[userID] = timer
+}
+
+func (t *tracker) touch(userID uuid.UUID) {
+	now := db.CurrentTime()
+
+	t.mu.Lock()
+	if now.Sub(t.touched[userID]) < touchInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.touched[userID] = now
+	t.mu.Unlock()
+
+	go func() {
+		before, after, err := markOnline(userID, now)
+		if err != nil {
+			log.Printf("Failed to record activity for %s: %v", userID, err)
+			return
+		}
+		publishChange(before, after)
+	}()
+}
+
+// heartbeat refreshes this instance's connection rows and forgets old activity
+func (t *tracker) heartbeat() {
+	now := db.CurrentTime()
+	if _, err := db.DB.Exec(`UPDATE presence_connections SET seen_at = $2 WHERE instance_id = $1`, instanceID, now); err != nil {
+		log.Printf("Failed to refresh presence connections: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for userID, touched := range t.touched {
+		if now.Sub(touched) >= touchInterval {
+			delete(t.touched, userID)
+		}
+	}
+}
+
+// goOnline records a user's first connection to this instance
+func goOnline(userID uuid.UUID) {
+	now := db.CurrentTime()
+	_, err := db.DB.Exec(`INSERT INTO presence_connections (instance_id, user_id, seen_at) VALUES ($1, $2, $3)
+		ON CONFLICT (instance_id, user_id) DO UPDATE SET seen_at = $3`, instanceID, userID, now)
+	if err != nil {
+		log.Printf("Failed to record presence connection for %s: %v", userID, err)
+		return
+	}
+
+	before, after, err := markOnline(userID, now)
+	if err != nil {
+		log.Printf("Failed to mark %s online: %v", userID, err)
+		return
+	}
+	publishChange(before, after)
+}
+
+// goOffline removes a user's connection to this instance and marks them offline
+// if they have no others
+func goOffline(userID uuid.UUID) {
+	_, err := db.DB.Exec(`DELETE FROM presence_connections WHERE instance_id = $1 AND user_id = $2`, instanceID, userID)
+	if err != nil {
+		log.Printf("Failed to remove presence connection for %s: %v", userID, err)
+		return
+	}
+
+	after, err := markOffline(userID, db.CurrentTime())
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to mark %s offline: %v", userID, err)
+		return
+	}
+	before := after
+	before.IsOnline = true
+	publishChange(before, after)
+}
+
+// sweep marks users offline whose connections and recent activity have lapsed,
+// and clears expired status text. Every instance sweeps; each change is only
+// made, and published, once.
+func sweep() {
+	now := db.CurrentTime()
+
+	offline, err := updateStatuses(`UPDATE user_status s SET is_online = FALSE
+		WHERE s.is_online AND s.last_active < $1
+		AND NOT EXISTS (SELECT 1 FROM presence_connections c WHERE c.user_id = s.user_id AND c.seen_at > $2)
+		RETURNING `+statusColumns, now.Add(-cfg.ActivityWindow), now.Add(-connectionTTL))
+	if err != nil {
+		log.Printf("Failed to sweep presence: %v", err)
+	}
+	for _, after := range offline {
+		before := after
+		before.IsOnline = true
+		publishChange(before, after)
+	}
+
+	// Expired text is already hidden when read, but contacts still show it
+	expired, err := updateStatuses(`UPDATE user_status s SET status_text = NULL, status_text_expires_at = NULL
+		WHERE s.status_text_expires_at <= $1
+		RETURNING `+statusColumns, now)
+	if err != nil {
+		log.Printf("Failed to clear expired status text: %v", err)
+	}
+	for _, after := range expired {
+		before := after
+		// The old text doesn't matter, only that there was some
+		before.StatusText = new(string)
+		publishChange(before, after)
+	}
+
+	if _, err := db.DB.Exec(`DELETE FROM presence_connections WHERE seen_at <= $1`, now.Add(-connectionTTL)); err != nil {
+		log.Printf("Failed to remove stale presence connections: %v", err)
+	}
+}
+
+// updateStatuses runs an update returning statusColumns and reads the changed statuses
+func updateStatuses(query string, args ...interface{}) ([]models.UserStatus, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []models.UserStatus{}
+	for rows.Next() {
+		s, err := scanStatus(rows)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gotext/server/internal/auth"
+)
+
+// KeyFunc returns the identity a request is limited by
+type KeyFunc func(r *http.Request) string
+
+// ByIP limits each client IP address
+func ByIP(r *http.Request) string {
+	return "ip:" + auth.ClientIP(r)
+}
+
+// ByUser limits each authenticated user across all their sessions and tokens,
+// and anonymous requests by IP address. It must run after the auth middleware.
+func ByUser(r *http.Request) string {
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		return "user:" + principal.UserID.String()
+	}
+	return ByIP(r)
+}
+
+// Limit wraps a handler with a rate limit. Every response carries the RateLimit-*
+// headers and rejected requests get 429 Too Many Requests with Retry-After.
+// If the store fails the request is let through rather than failing the API.
+func Limit(policy Policy, key KeyFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := store.Take(policy.Name+":"+key(r), policy)
+		if err != nil {
+			log.Printf("Rate limit check failed: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", policy.String())
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			auth.RespondWithError(w, http.StatusTooManyRequests, "Too many requests. Please slow down.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitFunc is Limit for handler functions
+func LimitFunc(policy Policy, key KeyFunc, handler http.HandlerFunc) http.Handler {
+	return Limit(policy, key, handler)
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
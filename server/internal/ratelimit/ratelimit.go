@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotext/server/internal/config"
+	"github.com/gotext/server/internal/db"
+)
+
+// Store names
+const (
+	StoreMemory   = "memory"
+	StorePostgres = "postgres"
+)
+
+// Policy is a token bucket: a client may make Limit requests at once, and the
+// bucket refills at Limit requests per Window.
+type Policy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// rate returns how many requests per second the bucket refills
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Window.Seconds()
+}
+
+// String formats the policy for the RateLimit-Policy header, e.g. "10;w=60"
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(p.Window.Seconds()))
+}
+
+// ParsePolicy parses a policy written as "<limit>/<window>", e.g. "10/1m"
+func ParsePolicy(name, value string) (Policy, error) {
+	limit, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return Policy{}, fmt.Errorf("rate limit %q must look like 10/1m", value)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n <= 0 {
+		return Policy{}, fmt.Errorf("invalid limit in rate limit %q", value)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil || d <= 0 {
+		return Policy{}, fmt.Errorf("invalid window in rate limit %q", value)
+	}
+
+	return Policy{Name: name, Limit: n, Window: d}, nil
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the number of whole requests left in the bucket
+	Remaining int
+	// RetryAfter is how long until the next request is allowed (0 if allowed now)
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Store keeps token buckets
+type Store interface {
+	// Take removes one token from the bucket for key under the policy
+	Take(key string, policy Policy) (Result, error)
+}
+
+// bucket is the state of one token bucket
+type bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// take refills the bucket for the time since it was last used and then tries
+// to remove one token. Both stores share this so they behave the same.
+func (b *bucket) take(now time.Time, policy Policy) Result {
+	capacity := float64(policy.Limit)
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*policy.rate())
+	}
+	b.UpdatedAt = now
+
+	result := Result{Limit: policy.Limit}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.Tokens) / policy.rate())
+	}
+
+	result.Remaining = int(math.Floor(b.Tokens))
+	result.Reset = secondsToDuration((capacity - b.Tokens) / policy.rate())
+	return result
+}
+
+// secondsToDuration converts fractional seconds to a duration
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Config holds rate limiting configuration
+type Config struct {
+	Enabled bool
+	Store   string // "postgres" or "memory"
+
+	// Auth limits credential endpoints such as login and registration, per IP address
+	Auth Policy
+	// Messages limits sending messages, per user
+	Messages Policy
+	// Default applies to every request, per IP address
+	Default Policy
+}
+
+// DefaultConfig returns the rate limiting configuration from the environment.
+// Policies are written as "<limit>/<window>", e.g. RATE_LIMIT_AUTH=10/1m.
+func DefaultConfig() (Config, error) {
+	env := &config.Env{}
+	c := Config{
+		Enabled: env.Bool("RATE_LIMIT_ENABLED", true),
+		Store:   config.GetEnv("RATE_LIMIT_STORE", StorePostgres),
+	}
+
+	var err error
+	if c.Auth, err = ParsePolicy("auth", config.GetEnv("RATE_LIMIT_AUTH", "10/1m")); err != nil {
+		return Config{}, err
+	}
+	if c.Messages, err = ParsePolicy("messages", config.GetEnv("RATE_LIMIT_MESSAGES", "60/1m")); err != nil {
+		return Config{}, err
+	}
+	if c.Default, err = ParsePolicy("default", config.GetEnv("RATE_LIMIT_DEFAULT", "600/1m")); err != nil {
+		return Config{}, err
+	}
+	return c, env.Err()
+}
+
+// cfg is the active rate limiting configuration
+var cfg = Config{Enabled: false}
+
+// store is the bucket store configured by Init
+var store Store = NewMemoryStore()
+
+// Init validates and applies the rate limiting configuration
+func Init(config Config) error {
+	switch config.Store {
+	case StoreMemory:
+		store = NewMemoryStore()
+	case StorePostgres:
+		store = NewPostgresStore(db.DB)
+	default:
+		return fmt.Errorf("unknown rate limit store %q", config.Store)
+	}
+
+	cfg = config
+	return nil
+}
+
+// CurrentConfig returns the active rate limiting configuration
+func CurrentConfig() Config {
+	return cfg
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gotext/server/internal/db"
+)
+
+// idleBucketTTL is how long an unused bucket is kept. Any bucket idle this long
+// has refilled completely under every reasonable policy, so dropping it changes nothing.
+const idleBucketTTL = time.Hour
+
+// cleanupEvery is how many Take calls pass between sweeps for idle buckets
+const cleanupEvery = 1000
+
+// MemoryStore keeps buckets in process memory. Limits only apply per server instance.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(key string, policy Policy) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.calls++
+	if s.calls%cleanupEvery == 0 {
+		for k, b := range s.buckets {
+			if now.Sub(b.UpdatedAt) > idleBucketTTL {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{}
+		s.buckets[key] = b
+	}
+	return b.take(now, policy), nil
+}
+
+// PostgresStore keeps buckets in the rate_limits table so every server instance
+// enforces the same limits
+type PostgresStore struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	calls int
+}
+
+// NewPostgresStore creates a store backed by the given database
+func NewPostgresStore(database *sql.DB) *PostgresStore {
+	return &PostgresStore{db: database}
+}
+
+// Take implements Store
+func (s *PostgresStore) Take(key string, policy Policy) (Result, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	now := db.CurrentTime()
+
+	// Lock the bucket row so concurrent requests take tokens one at a time
+	var b bucket
+	err = tx.QueryRow(`SELECT tokens, updated_at FROM rate_limits WHERE key = $1 FOR UPDATE`, key).
+		Scan(&b.Tokens, &b.UpdatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	result := b.take(now, policy)
+
+	// ON CONFLICT covers a first request racing another one for the same key
+	_, err = tx.Exec(`INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET tokens = $2, updated_at = $3`, key, b.Tokens, b.UpdatedAt)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Result{}, err
+	}
+
+	s.mu.Lock()
+	s.calls++
+	sweep := s.calls%cleanupEvery == 0
+	s.mu.Unlock()
+	if sweep {
+		s.db.Exec(`DELETE FROM rate_limits WHERE updated_at < $1`, now.Add(-idleBucketTTL))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,160 @@
+package rbac
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/models"
+)
+
+// ServerRoleHandler grants a server role to a user (PUT) or revokes it, returning
+// them to the user role (DELETE). The user ID comes from the {userID} path wildcard.
+func ServerRoleHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var role Role
+	switch r.Method {
+	case http.MethodPut:
+		var req models.UpdateRoleRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+		role = Role(req.Role)
+	case http.MethodDelete:
+		role = ServerRoleUser
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := SetServerRole(actor, userID, role, auth.ClientIP(r)); err != nil {
+		respondWithRoleError(w, err)
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Role updated",
+		Data:    models.RoleResponse{UserID: userID, Role: string(role)},
+	})
+}
+
+// SpaceMemberRoleHandler grants a space role to a member (PUT) or revokes it,
+// returning them to the member role (DELETE). The IDs come from the {spaceID}
+// and {userID} path wildcards.
+func SpaceMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var role Role
+	switch r.Method {
+	case http.MethodPut:
+		var req models.UpdateRoleRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+		role = Role(req.Role)
+	case http.MethodDelete:
+		role = SpaceRoleMember
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := SetSpaceRole(actor, spaceID, userID, role, auth.ClientIP(r)); err != nil {
+		respondWithRoleError(w, err)
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Role updated",
+		Data:    models.RoleResponse{UserID: userID, SpaceID: &spaceID, Role: string(role)},
+	})
+}
+
+// UnlockUserHandler lets an administrator unlock an account that was locked after
+// too many failed logins. The user ID comes from the {userID} path wildcard.
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	actor, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := auth.UnlockAccount(userID, &actor.UserID, auth.ClientIP(r), "admin"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			auth.RespondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Failed to unlock account: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to unlock account")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Account unlocked",
+	})
+}
+
+// respondWithRoleError maps a role change error to a response
+func respondWithRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidRole):
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid role")
+	case errors.Is(err, ErrForbidden):
+		auth.RespondWithError(w, http.StatusForbidden, "You are not allowed to assign this role")
+	case errors.Is(err, ErrLastOwner):
+		auth.RespondWithError(w, http.StatusConflict, "Cannot remove the last owner")
+	case errors.Is(err, ErrUserNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrSpaceNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Space not found")
+	case errors.Is(err, ErrNotMember):
+		auth.RespondWithError(w, http.StatusNotFound, "User is not a member of this space")
+	default:
+		log.Printf("Failed to update role: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to update role")
+	}
+}
@@ -0,0 +1,281 @@
+package rbac
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/audit"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+)
+
+var (
+	// ErrForbidden is returned when the principal lacks a permission
+	ErrForbidden = errors.New("permission denied")
+	// ErrInvalidRole is returned for a role name that doesn't exist at that level
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrLastOwner is returned when a change would leave the server or a space without an owner
+	ErrLastOwner = errors.New("cannot remove the last owner")
+	// ErrUserNotFound is returned when the target user doesn't exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrSpaceNotFound is returned when the target space doesn't exist
+	ErrSpaceNotFound = errors.New("space not found")
+	// ErrNotMember is returned when the target user isn't a member of the space
+	ErrNotMember = errors.New("user is not a member of the space")
+)
+
+// ServerRole returns the principal's highest server role
+func ServerRole(p *auth.Principal) Role {
+	best := ServerRoleUser
+	for _, r := range p.Roles {
+		if serverRoleRanks[Role(r)] > serverRoleRanks[best] {
+			best = Role(r)
+		}
+	}
+	return best
+}
+
+// SpaceRole returns the role a user acts with in a space: their membership role,
+// raised to the role their server role gives them in every space. Non-members of a
+// public space act as guests. It returns "" if the user has no role in the space.
+func SpaceRole(p *auth.Principal, spaceID uuid.UUID) (Role, error) {
+	return spaceRole(p, spaceID, true)
+}
+
+// MemberRole is SpaceRole without the guest role that public spaces give everyone,
+// for actions only members may take. It returns ErrNotMember for a public space the
+// user hasn't joined, and "" for a private one.
+func MemberRole(p *auth.Principal, spaceID uuid.UUID) (Role, error) {
+	return spaceRole(p, spaceID, false)
+}
+
+// spaceRole implements SpaceRole and MemberRole
+func spaceRole(p *auth.Principal, spaceID uuid.UUID, publicGuests bool) (Role, error) {
+	var isPublic bool
+	var memberRole sql.NullString
+	err := db.DB.QueryRow(`SELECT s.is_public, m.role
+		FROM spaces s
+		LEFT JOIN space_members m ON m.space_id = s.id AND m.user_id = $2
+		WHERE s.id = $1`, spaceID, p.UserID).Scan(&isPublic, &memberRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrSpaceNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	role := effectiveSpaceRole(ServerRole(p), Role(memberRole.String))
+	if role == "" && isPublic {
+		if !publicGuests {
+			return "", ErrNotMember
+		}
+		role = SpaceRoleGuest
+	}
+	return role, nil
+}
+
+// MemberSpaces returns every space the principal is a member of, with the role
+// they act with in each
+func MemberSpaces(p *auth.Principal) (map[uuid.UUID]Role, error) {
+	rows, err := db.DB.Query(`SELECT space_id, role FROM space_members WHERE user_id = $1`, p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	serverRole := ServerRole(p)
+	spaces := map[uuid.UUID]Role{}
+	for rows.Next() {
+		var spaceID uuid.UUID
+		var role Role
+		if err := rows.Scan(&spaceID, &role); err != nil {
+			return nil, err
+		}
+		spaces[spaceID] = effectiveSpaceRole(serverRole, role)
+	}
+	return spaces, rows.Err()
+}
+
+// Can reports whether the principal has a permission. Space permissions are checked
+// in the given space; server permissions ignore spaceID.
+func Can(p *auth.Principal, perm Permission, spaceID uuid.UUID) (bool, error) {
+	if !IsSpacePermission(perm) {
+		return ServerRoleHas(ServerRole(p), perm), nil
+	}
+
+	role, err := SpaceRole(p, spaceID)
+	if err != nil {
+		return false, err
+	}
+	return SpaceRoleHas(role, perm), nil
+}
+
+// SetServerRole changes a user's server role on behalf of actor
+func SetServerRole(actor *auth.Principal, userID uuid.UUID, role Role, ip string) error {
+	if !IsServerRole(role) {
+		return ErrInvalidRole
+	}
+	actorRole := ServerRole(actor)
+	if !ServerRoleHas(actorRole, PermManageUserRoles) {
+		return ErrForbidden
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current Role
+	err = tx.QueryRow(`SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if current == role {
+		return nil
+	}
+	if !canAssignServerRole(actorRole, current, role) {
+		return ErrForbidden
+	}
+
+	if current == ServerRoleOwner {
+		var owners int
+		// Lock the owner rows so two owners can't demote each other at the same time
+		err := tx.QueryRow(`SELECT COUNT(*) FROM (SELECT id FROM users WHERE role = $1 FOR UPDATE) o`, ServerRoleOwner).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOwner
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET role = $1 WHERE id = $2`, role, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	recordRoleChange(actor, userID, nil, current, role, ServerRoleUser, ip)
+	return nil
+}
+
+// SetSpaceRole changes a member's role in a space on behalf of actor
+func SetSpaceRole(actor *auth.Principal, spaceID, userID uuid.UUID, role Role, ip string) error {
+	if !IsSpaceRole(role) {
+		return ErrInvalidRole
+	}
+	actorRole, err := SpaceRole(actor, spaceID)
+	if err != nil {
+		return err
+	}
+	if !SpaceRoleHas(actorRole, PermManageMemberRoles) {
+		return ErrForbidden
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current Role
+	err = tx.QueryRow(`SELECT role FROM space_members WHERE space_id = $1 AND user_id = $2 FOR UPDATE`,
+		spaceID, userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+
+	if current == role {
+		return nil
+	}
+	if !canAssignSpaceRole(actorRole, current, role) {
+		return ErrForbidden
+	}
+
+	if current == SpaceRoleOwner {
+		var owners int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM (SELECT user_id FROM space_members WHERE space_id = $1 AND role = $2 FOR UPDATE) o`,
+			spaceID, SpaceRoleOwner).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOwner
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE space_members SET role = $1 WHERE space_id = $2 AND user_id = $3`, role, spaceID, userID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	recordRoleChange(actor, userID, &spaceID, current, role, SpaceRoleMember, ip)
+	events.Publish(events.Event{
+		Type:    events.MemberUpdated,
+		SpaceID: &spaceID,
+		UserIDs: []uuid.UUID{userID},
+		ActorID: &actor.UserID,
+		Data:    models.RoleResponse{UserID: userID, SpaceID: &spaceID, Role: string(role)},
+	})
+	return nil
+}
+
+// BootstrapOwner makes the user with the given email a server owner, so a new
+// installation has someone who can grant roles. It does nothing if email is empty.
+func BootstrapOwner(email string) error {
+	if email == "" {
+		return nil
+	}
+
+	var userID uuid.UUID
+	err := db.DB.QueryRow(`UPDATE users SET role = $1 WHERE LOWER(email) = LOWER($2) AND role <> $1 RETURNING id`,
+		ServerRoleOwner, email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Already an owner, or not registered yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	audit.Record(audit.Event{
+		Type:    audit.EventRoleGranted,
+		UserID:  &userID,
+		Details: map[string]interface{}{"role": ServerRoleOwner, "reason": "bootstrap"},
+	})
+	return nil
+}
+
+// recordRoleChange writes a role change to the audit log. Changing a user back to
+// the default role counts as revoking their previous role.
+func recordRoleChange(actor *auth.Principal, userID uuid.UUID, spaceID *uuid.UUID, from, to, defaultRole Role, ip string) {
+	event := audit.Event{
+		Type:      audit.EventRoleGranted,
+		UserID:    &userID,
+		ActorID:   &actor.UserID,
+		IPAddress: ip,
+		Details:   map[string]interface{}{"role": to, "previous_role": from},
+	}
+	if to == defaultRole {
+		event.Type = audit.EventRoleRevoked
+	}
+	if spaceID != nil {
+		event.Details["space_id"] = spaceID.String()
+	}
+	audit.Record(event)
+}
@@ -0,0 +1,172 @@
+package rbac
+
+// Role is a server-level or space-level role
+type Role string
+
+// Server-level roles, from most to least privileged
+const (
+	ServerRoleOwner     Role = "owner"
+	ServerRoleAdmin     Role = "admin"
+	ServerRoleModerator Role = "moderator"
+	ServerRoleUser      Role = "user"
+)
+
+// Space-level roles, from most to least privileged
+const (
+	SpaceRoleOwner     Role = "owner"
+	SpaceRoleAdmin     Role = "admin"
+	SpaceRoleModerator Role = "moderator"
+	SpaceRoleMember    Role = "member"
+	SpaceRoleGuest     Role = "guest"
+)
+
+// Permission is a single action a role may be allowed to perform
+type Permission string
+
+// Server permissions apply to the whole server
+const (
+	PermManageServer    Permission = "server.manage"
+	PermManageUserRoles Permission = "users.manage_roles"
+	PermUnlockUsers     Permission = "users.unlock"
+	PermViewAuditLog    Permission = "audit.view"
+)
+
+// Space permissions apply within one space
+const (
+	PermViewSpace          Permission = "space.view"
+	PermUpdateSpace        Permission = "space.update"
+	PermDeleteSpace        Permission = "space.delete"
+	PermReadMessages       Permission = "messages.read"
+	PermSendMessages       Permission = "messages.send"
+	PermDeleteAnyMessage   Permission = "messages.delete_any"
+	PermInviteMembers      Permission = "members.invite"
+	PermKickMembers        Permission = "members.kick"
+	PermManageMemberRoles  Permission = "members.manage_roles"
+	PermReviewJoinRequests Permission = "members.review_requests"
+)
+
+// serverRoleRanks orders the server roles; a higher rank includes everything below it
+var serverRoleRanks = map[Role]int{
+	ServerRoleUser:      1,
+	ServerRoleModerator: 2,
+	ServerRoleAdmin:     3,
+	ServerRoleOwner:     4,
+}
+
+// spaceRoleRanks orders the space roles; a higher rank includes everything below it
+var spaceRoleRanks = map[Role]int{
+	SpaceRoleGuest:     1,
+	SpaceRoleMember:    2,
+	SpaceRoleModerator: 3,
+	SpaceRoleAdmin:     4,
+	SpaceRoleOwner:     5,
+}
+
+// serverPermissions maps each server permission to the lowest server role that has it
+var serverPermissions = map[Permission]Role{
+	PermManageServer:    ServerRoleOwner,
+	PermManageUserRoles: ServerRoleAdmin,
+	PermUnlockUsers:     ServerRoleAdmin,
+	PermViewAuditLog:    ServerRoleAdmin,
+}
+
+// spacePermissions maps each space permission to the lowest space role that has it
+var spacePermissions = map[Permission]Role{
+	PermViewSpace:          SpaceRoleGuest,
+	PermReadMessages:       SpaceRoleGuest,
+	PermSendMessages:       SpaceRoleMember,
+	PermInviteMembers:      SpaceRoleMember,
+	PermDeleteAnyMessage:   SpaceRoleModerator,
+	PermKickMembers:        SpaceRoleModerator,
+	PermReviewJoinRequests: SpaceRoleModerator,
+	PermUpdateSpace:        SpaceRoleAdmin,
+	PermManageMemberRoles:  SpaceRoleAdmin,
+	PermDeleteSpace:        SpaceRoleOwner,
+}
+
+// serverRoleSpaceRoles is the space role that server staff act with in every space,
+// so moderators can moderate and admins can manage any space without joining it
+var serverRoleSpaceRoles = map[Role]Role{
+	ServerRoleModerator: SpaceRoleModerator,
+	ServerRoleAdmin:     SpaceRoleAdmin,
+	ServerRoleOwner:     SpaceRoleOwner,
+}
+
+// IsServerRole reports whether role is a valid server-level role
+func IsServerRole(role Role) bool {
+	_, ok := serverRoleRanks[role]
+	return ok
+}
+
+// IsSpaceRole reports whether role is a valid space-level role
+func IsSpaceRole(role Role) bool {
+	_, ok := spaceRoleRanks[role]
+	return ok
+}
+
+// IsSpacePermission reports whether a permission is checked against a space
+func IsSpacePermission(perm Permission) bool {
+	_, ok := spacePermissions[perm]
+	return ok
+}
+
+// ServerRoleHas reports whether a server role grants a server permission
+func ServerRoleHas(role Role, perm Permission) bool {
+	required, ok := serverPermissions[perm]
+	return ok && serverRoleRanks[role] >= serverRoleRanks[required]
+}
+
+// SpaceRoleHas reports whether a space role grants a space permission
+func SpaceRoleHas(role Role, perm Permission) bool {
+	required, ok := spacePermissions[perm]
+	return ok && spaceRoleRanks[role] >= spaceRoleRanks[required]
+}
+
+// SpacePermissions returns every space permission a space role grants
+func SpacePermissions(role Role) []Permission {
+	var perms []Permission
+	for perm := range spacePermissions {
+		if SpaceRoleHas(role, perm) {
+			perms = append(perms, perm)
+		}
+	}
+	return perms
+}
+
+// effectiveSpaceRole combines a user's membership role in a space with the role
+// their server role gives them everywhere, returning whichever is higher.
+// It returns "" if the user has neither.
+func effectiveSpaceRole(serverRole, memberRole Role) Role {
+	role := memberRole
+	if staffRole, ok := serverRoleSpaceRoles[serverRole]; ok && spaceRoleRanks[staffRole] > spaceRoleRanks[role] {
+		role = staffRole
+	}
+	return role
+}
+
+// canAssignServerRole reports whether an actor with one server role may change a
+// user from one role to another. Nobody may change a user who ranks as high as
+// themselves or grant a role as high as their own, except that owners may do anything.
+func canAssignServerRole(actor, from, to Role) bool {
+	if actor == ServerRoleOwner {
+		return true
+	}
+	rank := serverRoleRanks[actor]
+	return rank > serverRoleRanks[from] && rank > serverRoleRanks[to]
+}
+
+// canAssignSpaceRole is canAssignServerRole for space roles
+func canAssignSpaceRole(actor, from, to Role) bool {
+	if actor == SpaceRoleOwner {
+		return true
+	}
+	rank := spaceRoleRanks[actor]
+	return rank > spaceRoleRanks[from] && rank > spaceRoleRanks[to]
+}
+
+// CanRemoveSpaceMember reports whether an actor with one space role may remove a
+// member with another from the space. As with role changes, only owners may remove
+// someone ranked as high as themselves.
+func CanRemoveSpaceMember(actor, member Role) bool {
+	return actor == SpaceRoleOwner || spaceRoleRanks[actor] > spaceRoleRanks[member]
+}
@@ -0,0 +1,476 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/presence"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// sendBufferSize is how many messages can wait for a slow client before it is disconnected
+const sendBufferSize = 256
+
+var (
+	// ErrShuttingDown is returned when a client connects while the server is stopping
+	ErrShuttingDown = errors.New("server is shutting down")
+	// ErrNotAllowed is returned when subscribing to a space the user can't read
+	ErrNotAllowed = errors.New("not allowed to subscribe to this space")
+)
+
+// Reasons a client was disconnected by the hub
+const (
+	closeSlowConsumer = "slow consumer"
+	closeShutdown     = "server shutting down"
+)
+
+// client is one real-time connection. Transports read messages from send and
+// deliver them; the hub closes send when the client is dropped.
+type client struct {
+	principal *auth.Principal
+	send      chan message
+
+	// Guarded by hub.mu
+	spaces      map[uuid.UUID]rbac.Role
+	closed      bool
+	closeReason string
+	// Until the client is started, live events are held in pending
+	started bool
+	pending []message
+	// lastSeq is the newest event the client already has when it starts
+	lastSeq int64
+	// membershipChanges counts the membership events seen per space, so that a
+	// role lookup started for one is ignored once a later one has arrived
+	membershipChanges map[uuid.UUID]uint64
+}
+
+// message is an encoded event or control message queued for a client. Seq and
+// type are kept alongside the JSON for transports that send them separately.
+type message struct {
+	seq     int64
+	typ     string
+	payload []byte
+}
+
+// hub tracks connected clients by user and by subscribed space, and routes
+// events to them
+type hub struct {
+	mu       sync.RWMutex
+	clients  map[*client]bool
+	users    map[uuid.UUID]map[*client]bool
+	spaces   map[uuid.UUID]map[*client]bool
+	stopping bool
+	// done is closed once every client has been dropped after shutdown
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newHub creates an empty hub
+func newHub() *hub {
+	return &hub{
+		clients: map[*client]bool{},
+		users:   map[uuid.UUID]map[*client]bool{},
+		spaces:  map[uuid.UUID]map[*client]bool{},
+		done:    make(chan struct{}),
+	}
+}
+
+// defaultHub is the hub used by the transports
+var defaultHub = newHub()
+
+// Init starts delivering published events to connected clients
+func Init() {
+	events.Subscribe(defaultHub.publish)
+}
+
+// Shutdown disconnects every client and waits for the transports to finish
+// writing to them, or for ctx to end
+func Shutdown(ctx context.Context) error {
+	return defaultHub.shutdown(ctx)
+}
+
+// connect registers a client for the principal and subscribes it to every space
+// they are a member of. Events are held for the client until start is called.
+func (h *hub) connect(principal *auth.Principal) (*client, error) {
+	spaces, err := rbac.MemberSpaces(principal)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{
+		principal: principal,
+		// Room for a full replay on top of the usual backlog
+		send:              make(chan message, sendBufferSize+events.CurrentConfig().ReplayLimit+2),
+		spaces:            map[uuid.UUID]rbac.Role{},
+		membershipChanges: map[uuid.UUID]uint64{},
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopping {
+		return nil, ErrShuttingDown
+	}
+
+	h.clients[c] = true
+	addTo(h.users, principal.UserID, c)
+	for spaceID, role := range spaces {
+		if rbac.SpaceRoleHas(role, rbac.PermReadMessages) {
+			h.subscribeLocked(c, spaceID, role)
+		}
+	}
+	presence.Connected(principal.UserID)
+	// Transports call disconnect when they are done with the client
+	h.wg.Add(1)
+	return c, nil
+}
+
+// start sends the ready message, replays the events since the given sequence
+// number if the client is resuming, then delivers the live events held since
+// connect, skipping any that were replayed. If the missed events can't be
+// replayed the client is told to resync instead.
+func (h *hub) start(c *client, since *int64) {
+	ready := ReadyData{UserID: c.principal.UserID, Spaces: h.subscribedSpaces(c)}
+
+	// Everything after this is delivered live
+	ready.Seq = events.Position()
+
+	var replayed []events.Event
+	resync := false
+	if since != nil {
+		var err error
+		replayed, err = events.Replay(*since, ready.Seq, ready.Spaces, c.principal.UserID)
+		if err != nil {
+			if !errors.Is(err, events.ErrResyncRequired) {
+				log.Printf("Failed to replay events: %v", err)
+			}
+			resync = true
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	readyMessage := encodeControl(ControlMessage{Type: TypeReady, Data: ready})
+	readyMessage.seq = ready.Seq
+	h.sendLocked(c, readyMessage)
+	if resync {
+		h.sendLocked(c, encodeControl(ControlMessage{Type: TypeResyncRequired}))
+	} else if since != nil {
+		// The client has seen everything up to since, possibly from another instance
+		c.lastSeq = *since
+	}
+
+	sent := map[int64]bool{}
+	for _, event := range replayed {
+		if !h.receivesLocked(c, event) {
+			continue
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v", event.Type, err)
+			continue
+		}
+		h.sendLocked(c, message{seq: event.Seq, typ: event.Type, payload: payload})
+		sent[event.Seq] = true
+	}
+
+	// Held events can be older than replayed ones when they arrived late
+	for _, held := range c.pending {
+		if held.seq == 0 || (held.seq > c.lastSeq && !sent[held.seq]) {
+			h.sendLocked(c, held)
+		}
+	}
+	c.pending = nil
+	c.started = true
+}
+
+// drop removes a client and closes its send channel, telling its transport to stop
+func (h *hub) drop(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropLocked(c, "")
+}
+
+// disconnect removes a client. Transports call it once when they stop serving it.
+func (h *hub) disconnect(c *client) {
+	h.mu.Lock()
+	h.dropLocked(c, "")
+	h.mu.Unlock()
+	h.wg.Done()
+}
+
+// subscribe adds a client to a space after checking that its user may read it
+func (h *hub) subscribe(c *client, spaceID uuid.UUID) error {
+	role, err := readRole(c, spaceID)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !c.closed {
+		h.subscribeLocked(c, spaceID, role)
+	}
+	return nil
+}
+
+// readRole returns the role a client's user reads a space with, or
+// ErrNotAllowed if they may not read it
+func readRole(c *client, spaceID uuid.UUID) (rbac.Role, error) {
+	role, err := rbac.MemberRole(c.principal, spaceID)
+	if errors.Is(err, rbac.ErrNotMember) || errors.Is(err, rbac.ErrSpaceNotFound) {
+		return "", ErrNotAllowed
+	}
+	if err != nil {
+		return "", err
+	}
+	if !rbac.SpaceRoleHas(role, rbac.PermReadMessages) {
+		return "", ErrNotAllowed
+	}
+	return role, nil
+}
+
+// unsubscribe removes a client from a space
+func (h *hub) unsubscribe(c *client, spaceID uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(c, spaceID)
+}
+
+// subscribedSpaces returns the spaces a client is subscribed to
+func (h *hub) subscribedSpaces(c *client) []uuid.UUID {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	spaces := make([]uuid.UUID, 0, len(c.spaces))
+	for spaceID := range c.spaces {
+		spaces = append(spaces, spaceID)
+	}
+	return spaces
+}
+
+// publish delivers an event to the space's subscribers and the addressed users,
+// then follows any membership change it describes. It never blocks on a client.
+func (h *hub) publish(event events.Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event.Type, err)
+		return
+	}
+
+	h.mu.Lock()
+	for c := range h.recipientsLocked(event) {
+		h.deliverLocked(c, message{seq: event.Seq, typ: event.Type, payload: payload})
+	}
+	h.mu.Unlock()
+
+	if event.SpaceID != nil {
+		h.followMembership(event)
+	}
+}
+
+// recipientsLocked returns the clients an event goes to, each once
+func (h *hub) recipientsLocked(event events.Event) map[*client]bool {
+	recipients := map[*client]bool{}
+	if event.SpaceID != nil {
+		for c := range h.spaces[*event.SpaceID] {
+			role := c.spaces[*event.SpaceID]
+			if event.Permission == "" || rbac.SpaceRoleHas(role, rbac.Permission(event.Permission)) {
+				recipients[c] = true
+			}
+		}
+	}
+	for _, userID := range event.UserIDs {
+		for c := range h.users[userID] {
+			recipients[c] = true
+		}
+	}
+	return recipients
+}
+
+// receivesLocked reports whether an event is addressed to a client, for events
+// that didn't come through the subscription indexes
+func (h *hub) receivesLocked(c *client, event events.Event) bool {
+	if event.SpaceID != nil {
+		role, ok := c.spaces[*event.SpaceID]
+		if ok && (event.Permission == "" || rbac.SpaceRoleHas(role, rbac.Permission(event.Permission))) {
+			return true
+		}
+	}
+	for _, userID := range event.UserIDs {
+		if userID == c.principal.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+// followMembership keeps subscriptions in line with membership events: users who
+// join a space are subscribed to it, users who leave or are removed are
+// unsubscribed, and role changes update what the user's clients may receive.
+// Roles are looked up in the background so the database isn't queried while
+// the event bus waits.
+func (h *hub) followMembership(event events.Event) {
+	spaceID := *event.SpaceID
+
+	switch event.Type {
+	case events.MemberJoined, events.MemberUpdated:
+		h.mu.Lock()
+		for _, userID := range event.UserIDs {
+			for c := range h.users[userID] {
+				c.membershipChanges[spaceID]++
+				go h.resubscribe(c, spaceID, c.membershipChanges[spaceID])
+			}
+		}
+		h.mu.Unlock()
+
+	case events.MemberLeft, events.MemberRemoved:
+		h.mu.Lock()
+		for _, userID := range event.UserIDs {
+			for c := range h.users[userID] {
+				c.membershipChanges[spaceID]++
+				h.unsubscribeLocked(c, spaceID)
+			}
+		}
+		h.mu.Unlock()
+
+	case events.SpaceDeleted:
+		h.mu.Lock()
+		for c := range h.spaces[spaceID] {
+			c.membershipChanges[spaceID]++
+			h.unsubscribeLocked(c, spaceID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// resubscribe subscribes a client to a space with its user's current role, or
+// unsubscribes it if they may no longer read the space. change is the client's
+// membership change count for the space when the lookup started; if another
+// membership event has arrived since, that one decides instead.
+func (h *hub) resubscribe(c *client, spaceID uuid.UUID, change uint64) {
+	role, err := readRole(c, spaceID)
+	if err != nil && !errors.Is(err, ErrNotAllowed) {
+		log.Printf("Failed to check space role: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.closed || c.membershipChanges[spaceID] != change {
+		return
+	}
+	if err != nil {
+		h.unsubscribeLocked(c, spaceID)
+		return
+	}
+	h.subscribeLocked(c, spaceID, role)
+}
+
+// send queues a message for one client
+func (h *hub) send(c *client, msg message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendLocked(c, msg)
+}
+
+// deliverLocked queues an event for a client, or holds it if the client hasn't started
+func (h *hub) deliverLocked(c *client, msg message) {
+	if c.started || c.closed {
+		h.sendLocked(c, msg)
+		return
+	}
+	if len(c.pending) >= sendBufferSize {
+		h.dropLocked(c, closeSlowConsumer)
+		return
+	}
+	c.pending = append(c.pending, msg)
+}
+
+// sendLocked queues a message without blocking. A client whose buffer is full
+// has fallen too far behind and is dropped.
+func (h *hub) sendLocked(c *client, msg message) {
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		h.dropLocked(c, closeSlowConsumer)
+	}
+}
+
+// dropLocked removes a client from the hub and closes its send channel so its
+// transport stops. reason says why the hub dropped it, if it did.
+func (h *hub) dropLocked(c *client, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeReason = reason
+	close(c.send)
+
+	for spaceID := range c.spaces {
+		h.unsubscribeLocked(c, spaceID)
+	}
+	removeFrom(h.users, c.principal.UserID, c)
+	delete(h.clients, c)
+	presence.Disconnected(c.principal.UserID)
+}
+
+// subscribeLocked adds a client to a space, or updates its role there
+func (h *hub) subscribeLocked(c *client, spaceID uuid.UUID, role rbac.Role) {
+	c.spaces[spaceID] = role
+	addTo(h.spaces, spaceID, c)
+}
+
+// unsubscribeLocked removes a client from a space
+func (h *hub) unsubscribeLocked(c *client, spaceID uuid.UUID) {
+	delete(c.spaces, spaceID)
+	removeFrom(h.spaces, spaceID, c)
+}
+
+// shutdown stops accepting clients, drops the connected ones and waits for their
+// transports to finish
+func (h *hub) shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.stopping = true
+	for c := range h.clients {
+		h.dropLocked(c, closeShutdown)
+	}
+	h.mu.Unlock()
+
+	go func() {
+		h.wg.Wait()
+		close(h.done)
+	}()
+
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addTo adds a client to the set stored under key
+func addTo(index map[uuid.UUID]map[*client]bool, key uuid.UUID, c *client) {
+	if index[key] == nil {
+		index[key] = map[*client]bool{}
+	}
+	index[key][c] = true
+}
+
+// removeFrom removes a client from the set stored under key, dropping empty sets
+func removeFrom(index map[uuid.UUID]map[*client]bool, key uuid.UUID, c *client) {
+	delete(index[key], c)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
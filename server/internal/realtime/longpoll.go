@@ -0,0 +1,108 @@
+package realtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gotext/server/internal/auth"
+)
+
+const (
+	// defaultPollTimeout is how long a poll waits for events unless the client says otherwise
+	defaultPollTimeout = 25 * time.Second
+	// maxPollTimeout is the longest a poll may wait
+	maxPollTimeout = 55 * time.Second
+)
+
+// PollResponse is the result of a long poll. Seq is where the next poll resumes from.
+type PollResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+	Seq      int64             `json:"seq"`
+}
+
+// LongPollHandler returns real-time events for clients that can't hold a connection
+// open. The first poll, without ?since=, returns the ready message straight away.
+// Later polls pass the seq from the previous response and return as soon as there
+// are events, or with none after ?timeout= seconds (default 25, at most 55).
+// It must run after AuthMiddleware.
+func LongPollHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			auth.RespondWithError(w, http.StatusBadRequest, "Invalid timeout")
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	c, since, ok := connectRequest(w, r)
+	if !ok {
+		return
+	}
+	defer defaultHub.disconnect(c)
+
+	defaultHub.start(c, since)
+
+	response := PollResponse{Messages: []json.RawMessage{}}
+	add := func(msg message) {
+		if msg.seq > response.Seq {
+			response.Seq = msg.seq
+		}
+		// Resuming clients already have the ready message from their first poll
+		if msg.typ != TypeReady || since == nil {
+			response.Messages = append(response.Messages, msg.payload)
+		}
+	}
+
+	// Take the ready message and anything replayed
+	open := drain(c, add)
+
+	if open && since != nil && len(response.Messages) == 0 {
+		// The server's write timeout would otherwise cut the poll short
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + writeWait))
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case msg, ok := <-c.send:
+			if ok {
+				add(msg)
+				drain(c, add)
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    response,
+	})
+}
+
+// drain passes every message already queued for a client to fn. It reports
+// whether the client is still open.
+func drain(c *client, fn func(message)) bool {
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return false
+			}
+			fn(msg)
+		default:
+			return true
+		}
+	}
+}
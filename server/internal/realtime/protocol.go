@@ -0,0 +1,92 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Messages clients send to the server
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypePing        = "ping"
+)
+
+// Control messages the server sends besides events. Events use the event type,
+// e.g. "message.created", and carry the fields of events.Event.
+const (
+	TypeReady          = "ready"
+	TypeResyncRequired = "resync_required"
+	TypeSubscribed     = "subscribed"
+	TypeUnsubscribed   = "unsubscribed"
+	TypePong           = "pong"
+	TypeError          = "error"
+)
+
+// ClientMessage is a message from a client. RequestID is optional and echoed in the reply.
+type ClientMessage struct {
+	Type      string     `json:"type"`
+	RequestID string     `json:"request_id,omitempty"`
+	SpaceID   *uuid.UUID `json:"space_id,omitempty"`
+}
+
+// ControlMessage is a message from the server that isn't an event
+type ControlMessage struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"`
+	SpaceID   *uuid.UUID  `json:"space_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// ReadyData is sent once a connection is set up. Seq is the newest event at the
+// time; every later event is delivered on the connection.
+type ReadyData struct {
+	UserID uuid.UUID   `json:"user_id"`
+	Spaces []uuid.UUID `json:"spaces"`
+	Seq    int64       `json:"seq"`
+}
+
+// encodeControl encodes a control message. Control messages only hold plain
+// values, so encoding can't fail.
+func encodeControl(msg ControlMessage) message {
+	payload, _ := json.Marshal(msg)
+	return message{typ: msg.Type, payload: payload}
+}
+
+// handleClientMessage acts on a message from a client and returns the reply
+func (h *hub) handleClientMessage(c *client, msg ClientMessage) ControlMessage {
+	reply := ControlMessage{RequestID: msg.RequestID, SpaceID: msg.SpaceID}
+
+	switch msg.Type {
+	case TypePing:
+		reply.Type = TypePong
+
+	case TypeSubscribe, TypeUnsubscribe:
+		if msg.SpaceID == nil {
+			reply.Type = TypeError
+			reply.Error = "space_id is required"
+			return reply
+		}
+		if msg.Type == TypeUnsubscribe {
+			h.unsubscribe(c, *msg.SpaceID)
+			reply.Type = TypeUnsubscribed
+			return reply
+		}
+		if err := h.subscribe(c, *msg.SpaceID); err != nil {
+			reply.Type = TypeError
+			reply.Error = "You can't subscribe to this space"
+			if err != ErrNotAllowed {
+				reply.Error = "Failed to subscribe"
+			}
+			return reply
+		}
+		reply.Type = TypeSubscribed
+
+	default:
+		reply.Type = TypeError
+		reply.Error = "Unknown message type"
+	}
+	return reply
+}
@@ -0,0 +1,82 @@
+package realtime
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// ssePingPeriod is how often a comment is sent to keep idle streams open
+	// through proxies
+	ssePingPeriod = 30 * time.Second
+	// sseRetry is how long browsers wait before reconnecting a dropped stream
+	sseRetry = 3 * time.Second
+)
+
+// EventStreamHandler streams real-time events as Server-Sent Events, for clients
+// that can't use WebSockets. Each event's seq is its SSE id, so a reconnecting
+// EventSource resumes from Last-Event-ID; ?since= works as for WebSockets.
+// It must run after AuthMiddleware.
+func EventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, since, ok := connectRequest(w, r)
+	if !ok {
+		return
+	}
+	defer defaultHub.disconnect(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	defaultHub.start(c, since)
+
+	ticker := time.NewTicker(ssePingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			// The server's write timeout would otherwise end the stream
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			writeServerSentEvent(w, msg)
+
+		case <-ticker.C:
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			fmt.Fprint(w, ": ping\n\n")
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeServerSentEvent writes a message as an SSE event named after its type.
+// Events and the ready message carry their seq as the id.
+func writeServerSentEvent(w http.ResponseWriter, msg message) {
+	if msg.seq > 0 || msg.typ == TypeReady {
+		fmt.Fprintf(w, "id: %d\n", msg.seq)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.typ, msg.payload)
+}
@@ -0,0 +1,56 @@
+package realtime
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gotext/server/internal/auth"
+)
+
+// connectRequest registers a client for an authenticated transport request and
+// reads the sequence number it resumes from, taken from ?since= or the
+// Last-Event-ID header. On failure it responds and returns false.
+func connectRequest(w http.ResponseWriter, r *http.Request) (*client, *int64, bool) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, nil, false
+	}
+
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		value = r.Header.Get("Last-Event-ID")
+	}
+	since, err := parseSince(value)
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid since")
+		return nil, nil, false
+	}
+
+	c, err := defaultHub.connect(principal)
+	if err != nil {
+		if err == ErrShuttingDown {
+			auth.RespondWithError(w, http.StatusServiceUnavailable, "Server is shutting down")
+			return nil, nil, false
+		}
+		log.Printf("Failed to set up real-time connection: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to connect")
+		return nil, nil, false
+	}
+	return c, since, true
+}
+
+// parseSince reads the sequence number a client resumes from. An empty value means
+// the client isn't resuming.
+func parseSince(value string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	since, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || since < 0 {
+		return nil, errors.New("invalid sequence number")
+	}
+	return &since, nil
+}
@@ -0,0 +1,130 @@
+package realtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gotext/server/internal/auth"
+)
+
+const (
+	// writeWait is how long a write to the connection may take
+	writeWait = 10 * time.Second
+	// pongWait is how long the connection may stay silent before it is considered dead
+	pongWait = 60 * time.Second
+	// pingPeriod is how often the server pings; it must be shorter than pongWait
+	pingPeriod = pongWait * 9 / 10
+	// maxClientMessageSize limits the size of messages from clients
+	maxClientMessageSize = 4096
+)
+
+// upgrader upgrades authenticated requests to WebSocket connections. Browsers don't
+// apply the same-origin policy to WebSockets, so the origin is checked the same way
+// as for cookie-authenticated API requests to stop other sites connecting as the user.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return auth.CheckOrigin(r) == nil
+	},
+}
+
+// WebSocketHandler upgrades the request to a WebSocket connection that receives
+// real-time events. A client resuming a dropped connection passes the seq of the
+// last event it saw as ?since= to receive the events it missed.
+// It must run after AuthMiddleware.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	c, since, ok := connectRequest(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded
+		defaultHub.disconnect(c)
+		return
+	}
+
+	defaultHub.start(c, since)
+
+	go readPump(conn, c)
+	writePump(conn, c)
+}
+
+// readPump handles messages from the client until the connection fails, then
+// drops the client so writePump stops
+func readPump(conn *websocket.Conn, c *client) {
+	defer defaultHub.drop(c)
+
+	conn.SetReadLimit(maxClientMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		// Any message shows the client is alive
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		var msg ClientMessage
+		reply := ControlMessage{Type: TypeError, Error: "Invalid message"}
+		if err := json.Unmarshal(data, &msg); err == nil {
+			reply = defaultHub.handleClientMessage(c, msg)
+		}
+		defaultHub.send(c, encodeControl(reply))
+	}
+}
+
+// writePump writes queued messages and pings to the connection. It returns when
+// the hub drops the client or the connection fails, and disconnects the client.
+func writePump(conn *websocket.Conn, c *client) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+		defaultHub.disconnect(c)
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, closeMessage(c))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, msg.payload); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeMessage returns the close frame for a client the hub dropped
+func closeMessage(c *client) []byte {
+	defaultHub.mu.RLock()
+	reason := c.closeReason
+	defaultHub.mu.RUnlock()
+
+	switch reason {
+	case closeSlowConsumer:
+		return websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	case closeShutdown:
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	default:
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	}
+}
@@ -0,0 +1,262 @@
+package spaces
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/messages"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// SpacesHandler lists the spaces the current user is a member of with their read
+// state (GET) or creates a new space owned by them (POST)
+func SpacesHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		spaces, err := listMemberSpaces(principal.UserID)
+		if err != nil {
+			log.Printf("Failed to list spaces: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list spaces")
+			return
+		}
+
+		// Unread counts are message data, so tokens need the messages scope to see them
+		if principal.HasScope(auth.ScopeMessagesRead) {
+			readStates, err := messages.SpaceReadStates(principal.UserID)
+			if err != nil {
+				log.Printf("Failed to get read states: %v", err)
+				auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list spaces")
+				return
+			}
+			for i := range spaces {
+				if state, ok := readStates[spaces[i].ID]; ok {
+					spaces[i].ReadState = &state
+				}
+			}
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    spaces,
+		})
+
+	case http.MethodPost:
+		if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+			return
+		}
+
+		var req models.CreateSpaceRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		space, err := createSpace(principal.UserID, req)
+		if err != nil {
+			log.Printf("Failed to create space: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to create space")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusCreated, auth.Response{
+			Success: true,
+			Message: "Space created",
+			Data:    space,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PublicSpacesHandler lists public spaces anyone can join, optionally filtered
+// by the q query parameter. Use limit and offset to page through the results.
+func PublicSpacesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		auth.RespondWithError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		auth.RespondWithError(w, http.StatusBadRequest, "offset must not be negative")
+		return
+	}
+
+	spaces, err := listPublicSpaces(strings.TrimSpace(query.Get("q")), limit, offset)
+	if err != nil {
+		log.Printf("Failed to list public spaces: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list spaces")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    spaces,
+	})
+}
+
+// SpaceHandler returns (GET), updates (PATCH) or deletes (DELETE) a space.
+// The space ID comes from the {spaceID} path wildcard. Private spaces look
+// like they don't exist to anyone who isn't a member.
+func SpaceHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := authorize(w, principal, rbac.PermViewSpace, spaceID); !ok {
+			return
+		}
+
+		space, err := getSpace(spaceID)
+		if err != nil {
+			respondWithSpaceError(w, err, "Failed to get space")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    space,
+		})
+
+	case http.MethodPatch:
+		if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+			return
+		}
+		if _, ok := authorize(w, principal, rbac.PermUpdateSpace, spaceID); !ok {
+			return
+		}
+
+		var req models.UpdateSpaceRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		space, err := updateSpace(spaceID, req)
+		if err != nil {
+			respondWithSpaceError(w, err, "Failed to update space")
+			return
+		}
+
+		events.Publish(events.Event{
+			Type:    events.SpaceUpdated,
+			SpaceID: &spaceID,
+			ActorID: &principal.UserID,
+			Data:    space,
+		})
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Message: "Space updated",
+			Data:    space,
+		})
+
+	case http.MethodDelete:
+		if !requireScope(w, principal, auth.ScopeSpacesAdmin) {
+			return
+		}
+		if _, ok := authorize(w, principal, rbac.PermDeleteSpace, spaceID); !ok {
+			return
+		}
+
+		memberIDs, err := deleteSpace(spaceID)
+		if err != nil {
+			respondWithSpaceError(w, err, "Failed to delete space")
+			return
+		}
+
+		// The space's members are gone along with it, so address them directly
+		events.Publish(events.Event{
+			Type:    events.SpaceDeleted,
+			SpaceID: &spaceID,
+			UserIDs: memberIDs,
+			ActorID: &principal.UserID,
+		})
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Message: "Space deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireScope checks that a personal access token has the scope an action needs,
+// beyond the one its route requires. It responds with 403 and returns false if not.
+func requireScope(w http.ResponseWriter, principal *auth.Principal, scope string) bool {
+	if principal.HasScope(scope) {
+		return true
+	}
+	auth.RespondWithError(w, http.StatusForbidden, "Token does not have the required scope")
+	return false
+}
+
+// authorize checks a space permission and returns the principal's role in the space.
+// Users who can't view the space get 404 rather than 403 so private spaces aren't
+// revealed. It responds and returns false if the permission is missing.
+func authorize(w http.ResponseWriter, principal *auth.Principal, perm rbac.Permission, spaceID uuid.UUID) (rbac.Role, bool) {
+	role, err := rbac.SpaceRole(principal, spaceID)
+	if err != nil {
+		respondWithSpaceError(w, err, "Failed to check permissions")
+		return "", false
+	}
+
+	if !rbac.SpaceRoleHas(role, rbac.PermViewSpace) {
+		respondWithSpaceError(w, rbac.ErrSpaceNotFound, "")
+		return "", false
+	}
+	if !rbac.SpaceRoleHas(role, perm) {
+		auth.RespondWithError(w, http.StatusForbidden, "You do not have permission to do this")
+		return "", false
+	}
+	return role, true
+}
+
+// respondWithSpaceError maps a space error to a response, using message for unexpected errors
+func respondWithSpaceError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, rbac.ErrSpaceNotFound) {
+		auth.RespondWithError(w, http.StatusNotFound, "Space not found")
+		return
+	}
+	log.Printf("%s: %v", message, err)
+	auth.RespondWithError(w, http.StatusInternalServerError, message)
+}
+
+// queryInt parses an integer query parameter, returning def if it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,170 @@
+package spaces
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+	"github.com/gotext/server/internal/testutil"
+)
+
+// addTestMember adds a user to a space with a role
+func addTestMember(t *testing.T, spaceID, userID uuid.UUID, role rbac.Role) {
+	t.Helper()
+
+	_, err := db.DB.Exec(`INSERT INTO space_members (space_id, user_id, role) VALUES ($1, $2, $3)`,
+		spaceID, userID, role)
+	if err != nil {
+		t.Fatalf("failed to add member: %v", err)
+	}
+}
+
+// callSpaces sends a request with a JSON body to the space routes as the user
+// with a session
+func callSpaces(t *testing.T, user models.User, method, path string, body interface{}) (int, testutil.Response) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/spaces", SpacesHandler)
+	mux.HandleFunc("/api/spaces/{spaceID}", SpaceHandler)
+
+	r := testutil.NewRequest(t, method, path, body)
+	principal := &auth.Principal{
+		UserID: user.ID,
+		Email:  user.Email,
+		Roles:  []string{user.Role},
+		Method: auth.AuthMethodSession,
+		User:   user,
+	}
+	r = r.WithContext(auth.WithPrincipal(context.Background(), principal))
+	return testutil.Serve(t, mux, r)
+}
+
+// createTestSpace creates a space through the API as the user
+func createTestSpace(t *testing.T, user models.User, isPublic bool) models.SpaceResponse {
+	t.Helper()
+
+	status, response := callSpaces(t, user, http.MethodPost, "/api/spaces", models.CreateSpaceRequest{
+		Name:     "Test space",
+		IsPublic: isPublic,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201 creating a space, got %d: %s", status, response.Error)
+	}
+
+	var space models.SpaceResponse
+	if err := json.Unmarshal(response.Data, &space); err != nil {
+		t.Fatalf("failed to decode space: %v", err)
+	}
+	return space
+}
+
+// spacePath returns the path of a space's route
+func spacePath(spaceID uuid.UUID) string {
+	return "/api/spaces/" + spaceID.String()
+}
+
+func TestCreateSpaceMakesCreatorOwner(t *testing.T) {
+	testutil.SetupDB(t)
+	creator := testutil.CreateUser(t)
+
+	space := createTestSpace(t, creator, false)
+	if space.CreatorID != creator.ID {
+		t.Errorf("expected creator %s, got %s", creator.ID, space.CreatorID)
+	}
+	if space.MemberCount != 1 {
+		t.Errorf("expected 1 member, got %d", space.MemberCount)
+	}
+
+	var role string
+	err := db.DB.QueryRow(`SELECT role FROM space_members WHERE space_id = $1 AND user_id = $2`,
+		space.ID, creator.ID).Scan(&role)
+	if err != nil {
+		t.Fatalf("expected the creator to be a member: %v", err)
+	}
+	if role != string(rbac.SpaceRoleOwner) {
+		t.Errorf("expected the creator to be %s, got %s", rbac.SpaceRoleOwner, role)
+	}
+
+	// The member count follows the space's memberships
+	addTestMember(t, space.ID, testutil.CreateUser(t).ID, rbac.SpaceRoleMember)
+	status, response := callSpaces(t, creator, http.MethodGet, spacePath(space.ID), nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, response.Error)
+	}
+	var fetched models.SpaceResponse
+	if err := json.Unmarshal(response.Data, &fetched); err != nil {
+		t.Fatalf("failed to decode space: %v", err)
+	}
+	if fetched.MemberCount != 2 {
+		t.Errorf("expected 2 members, got %d", fetched.MemberCount)
+	}
+}
+
+func TestPrivateSpaceIsHiddenFromNonMembers(t *testing.T) {
+	testutil.SetupDB(t)
+	space := createTestSpace(t, testutil.CreateUser(t), false)
+	outsider := testutil.CreateUser(t)
+
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodDelete} {
+		var body interface{}
+		if method == http.MethodPatch {
+			body = models.UpdateSpaceRequest{Name: "Renamed"}
+		}
+		status, response := callSpaces(t, outsider, method, spacePath(space.ID), body)
+		if status != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d: %s", method, status, response.Error)
+		}
+	}
+
+	// A public space can be seen by anyone
+	public := createTestSpace(t, testutil.CreateUser(t), true)
+	if status, response := callSpaces(t, outsider, http.MethodGet, spacePath(public.ID), nil); status != http.StatusOK {
+		t.Errorf("expected 200 for a public space, got %d: %s", status, response.Error)
+	}
+}
+
+func TestSpaceChangesRequireAdmin(t *testing.T) {
+	testutil.SetupDB(t)
+	space := createTestSpace(t, testutil.CreateUser(t), false)
+	member := testutil.CreateUser(t)
+	addTestMember(t, space.ID, member.ID, rbac.SpaceRoleMember)
+
+	status, response := callSpaces(t, member, http.MethodPatch, spacePath(space.ID), models.UpdateSpaceRequest{Name: "Renamed"})
+	if status != http.StatusForbidden {
+		t.Errorf("expected 403 updating as a member, got %d: %s", status, response.Error)
+	}
+	status, response = callSpaces(t, member, http.MethodDelete, spacePath(space.ID), nil)
+	if status != http.StatusForbidden {
+		t.Errorf("expected 403 deleting as a member, got %d: %s", status, response.Error)
+	}
+
+	current, err := getSpace(space.ID)
+	if err != nil {
+		t.Fatalf("expected the space to still exist: %v", err)
+	}
+	if current.Name != space.Name {
+		t.Errorf("expected name %q to be unchanged, got %q", space.Name, current.Name)
+	}
+
+	// Admins may update the space
+	admin := testutil.CreateUser(t)
+	addTestMember(t, space.ID, admin.ID, rbac.SpaceRoleAdmin)
+	status, response = callSpaces(t, admin, http.MethodPatch, spacePath(space.ID), models.UpdateSpaceRequest{Name: "Renamed"})
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 updating as an admin, got %d: %s", status, response.Error)
+	}
+	var updated models.SpaceResponse
+	if err := json.Unmarshal(response.Data, &updated); err != nil {
+		t.Fatalf("failed to decode space: %v", err)
+	}
+	if updated.Name != "Renamed" {
+		t.Errorf("expected name %q, got %q", "Renamed", updated.Name)
+	}
+}
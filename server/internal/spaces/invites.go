@@ -0,0 +1,605 @@
+package spaces
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// defaultInviteLinkTTL is how long invite links last when no expiry is given
+const defaultInviteLinkTTL = 7 * 24 * time.Hour
+
+var (
+	// ErrAlreadyInvited is returned when the user already has a pending invitation to the space
+	ErrAlreadyInvited = errors.New("user has already been invited")
+	// ErrInviteNotFound is returned for an unknown invitation or invite link
+	ErrInviteNotFound = errors.New("invitation not found")
+	// ErrInviteExpired is returned for an invite link that has expired or run out of uses
+	ErrInviteExpired = errors.New("invite link has expired")
+)
+
+// inviteColumns is the column list scanned by scanInvite
+const inviteColumns = `i.id, i.space_id, s.name, i.inviter_id, i.invitee_id, i.created_at`
+
+// scanInvite reads a row selected with inviteColumns
+func scanInvite(row rowScanner) (models.SpaceInvite, error) {
+	var i models.SpaceInvite
+	err := row.Scan(&i.ID, &i.SpaceID, &i.SpaceName, &i.InviterID, &i.InviteeID, &i.CreatedAt)
+	return i, err
+}
+
+// listInvites returns pending invitations matching the condition, newest first
+func listInvites(where string, args ...interface{}) ([]models.SpaceInvite, error) {
+	rows, err := db.DB.Query(`SELECT `+inviteColumns+`
+		FROM space_invites i
+		JOIN spaces s ON s.id = i.space_id
+		WHERE `+where+`
+		ORDER BY i.created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []models.SpaceInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// createInvite invites the user with the given username to a space
+func createInvite(spaceID, inviterID uuid.UUID, username string) (models.SpaceInvite, error) {
+	var inviteeID uuid.UUID
+	var isMember bool
+	err := db.DB.QueryRow(`SELECT u.id, EXISTS (SELECT 1 FROM space_members WHERE space_id = $2 AND user_id = u.id)
+		FROM users u WHERE LOWER(u.username) = LOWER($1)`, username, spaceID).Scan(&inviteeID, &isMember)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SpaceInvite{}, rbac.ErrUserNotFound
+	}
+	if err != nil {
+		return models.SpaceInvite{}, err
+	}
+	if isMember {
+		return models.SpaceInvite{}, ErrAlreadyMember
+	}
+
+	invite, err := scanInvite(db.DB.QueryRow(`WITH i AS (
+			INSERT INTO space_invites (id, space_id, inviter_id, invitee_id, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (space_id, invitee_id) DO NOTHING
+			RETURNING *
+		)
+		SELECT `+inviteColumns+` FROM i JOIN spaces s ON s.id = i.space_id`,
+		uuid.New(), spaceID, inviterID, inviteeID, db.CurrentTime()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SpaceInvite{}, ErrAlreadyInvited
+	}
+	return invite, err
+}
+
+// SpaceInvitesHandler lists a space's pending invitations (GET) or invites a user
+// by username (POST). The space ID comes from the {spaceID} path wildcard.
+func SpaceInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID); !ok {
+			return
+		}
+
+		invites, err := listInvites(`i.space_id = $1`, spaceID)
+		if err != nil {
+			log.Printf("Failed to list invitations: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list invitations")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    invites,
+		})
+
+	case http.MethodPost:
+		if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+			return
+		}
+		if _, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID); !ok {
+			return
+		}
+
+		var req models.CreateSpaceInviteRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		invite, err := createInvite(spaceID, principal.UserID, req.Username)
+		if err != nil {
+			respondWithInviteError(w, err)
+			return
+		}
+
+		events.Publish(events.Event{
+			Type:    events.InviteCreated,
+			UserIDs: []uuid.UUID{invite.InviteeID},
+			ActorID: &principal.UserID,
+			Data:    invite,
+		})
+
+		auth.RespondWithJSON(w, http.StatusCreated, auth.Response{
+			Success: true,
+			Message: "Invitation sent",
+			Data:    invite,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SpaceInviteHandler revokes a pending invitation. Its inviter or anyone who can
+// review join requests may revoke it. The IDs come from the {spaceID} and
+// {inviteID} path wildcards.
+func SpaceInviteHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+	inviteID, err := uuid.Parse(r.PathValue("inviteID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	role, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID)
+	if !ok {
+		return
+	}
+
+	var inviteeID uuid.UUID
+	err = db.DB.QueryRow(`DELETE FROM space_invites
+		WHERE id = $1 AND space_id = $2 AND (inviter_id = $3 OR $4)
+		RETURNING invitee_id`,
+		inviteID, spaceID, principal.UserID, rbac.SpaceRoleHas(role, rbac.PermReviewJoinRequests)).Scan(&inviteeID)
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:    events.InviteRevoked,
+		UserIDs: []uuid.UUID{inviteeID},
+		ActorID: &principal.UserID,
+		Data:    map[string]uuid.UUID{"id": inviteID, "space_id": spaceID},
+	})
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Invitation revoked",
+	})
+}
+
+// MyInvitesHandler lists the current user's pending invitations
+func MyInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	invites, err := listInvites(`i.invitee_id = $1`, principal.UserID)
+	if err != nil {
+		log.Printf("Failed to list invitations: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list invitations")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    invites,
+	})
+}
+
+// AcceptInviteHandler accepts an invitation and joins its space. The invitation
+// ID comes from the {inviteID} path wildcard.
+func AcceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	answerInvite(w, r, true)
+}
+
+// DeclineInviteHandler declines an invitation. The invitation ID comes from the
+// {inviteID} path wildcard.
+func DeclineInviteHandler(w http.ResponseWriter, r *http.Request) {
+	answerInvite(w, r, false)
+}
+
+// answerInvite accepts or declines one of the current user's invitations
+func answerInvite(w http.ResponseWriter, r *http.Request, accept bool) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	inviteID, err := uuid.Parse(r.PathValue("inviteID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var spaceID, inviterID uuid.UUID
+	err = tx.QueryRow(`DELETE FROM space_invites WHERE id = $1 AND invitee_id = $2 RETURNING space_id, inviter_id`,
+		inviteID, principal.UserID).Scan(&spaceID, &inviterID)
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+
+	if accept {
+		if err := addMember(tx, spaceID, principal.UserID); err != nil {
+			respondWithInviteError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+
+	event := events.Event{
+		Type:    events.InviteDeclined,
+		UserIDs: []uuid.UUID{inviterID, principal.UserID},
+		ActorID: &principal.UserID,
+		Data:    map[string]uuid.UUID{"id": inviteID, "space_id": spaceID},
+	}
+	message := "Invitation declined"
+	if accept {
+		event.Type = events.InviteAccepted
+		message = "Invitation accepted"
+		publishMemberJoined(spaceID, principal.UserID, &inviterID, "invite")
+	}
+	events.Publish(event)
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: message,
+	})
+}
+
+// inviteLinkColumns is the column list scanned by scanInviteLink
+const inviteLinkColumns = `id, space_id, creator_id, max_uses, uses, expires_at, created_at`
+
+// scanInviteLink reads a row selected with inviteLinkColumns
+func scanInviteLink(row rowScanner) (models.SpaceInviteLink, error) {
+	var l models.SpaceInviteLink
+	var maxUses sql.NullInt64
+	err := row.Scan(&l.ID, &l.SpaceID, &l.CreatorID, &maxUses, &l.Uses, &l.ExpiresAt, &l.CreatedAt)
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		l.MaxUses = &n
+	}
+	return l, err
+}
+
+// usable reports whether an invite link can still be used
+func usable(l models.SpaceInviteLink, now time.Time) bool {
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxUses == nil || l.Uses < *l.MaxUses
+}
+
+// listInviteLinks returns a space's invite links that can still be used, newest first
+func listInviteLinks(spaceID uuid.UUID) ([]models.SpaceInviteLink, error) {
+	rows, err := db.DB.Query(`SELECT `+inviteLinkColumns+`
+		FROM space_invite_links
+		WHERE space_id = $1
+		ORDER BY created_at DESC`, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := db.CurrentTime()
+	links := []models.SpaceInviteLink{}
+	for rows.Next() {
+		link, err := scanInviteLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		if usable(link, now) {
+			links = append(links, link)
+		}
+	}
+	return links, rows.Err()
+}
+
+// SpaceInviteLinksHandler lists a space's active invite links (GET) or creates a
+// new one (POST). The link token is only returned by the create call. The space
+// ID comes from the {spaceID} path wildcard.
+func SpaceInviteLinksHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID); !ok {
+			return
+		}
+
+		links, err := listInviteLinks(spaceID)
+		if err != nil {
+			log.Printf("Failed to list invite links: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list invite links")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    links,
+		})
+
+	case http.MethodPost:
+		if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+			return
+		}
+		if _, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID); !ok {
+			return
+		}
+
+		var req models.CreateSpaceInviteLinkRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		now := db.CurrentTime()
+		expiresAt := now.Add(defaultInviteLinkTTL)
+		if req.ExpiresAt != nil {
+			if !req.ExpiresAt.After(now) {
+				auth.RespondWithError(w, http.StatusBadRequest, "Expiry must be in the future")
+				return
+			}
+			expiresAt = *req.ExpiresAt
+		}
+
+		token, err := auth.GenerateSecureToken(24)
+		if err != nil {
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to generate invite link")
+			return
+		}
+
+		link := models.SpaceInviteLink{
+			ID:        uuid.New(),
+			SpaceID:   spaceID,
+			CreatorID: principal.UserID,
+			MaxUses:   req.MaxUses,
+			ExpiresAt: &expiresAt,
+			CreatedAt: now,
+			Token:     token,
+		}
+
+		_, err = db.DB.Exec(`INSERT INTO space_invite_links (id, space_id, creator_id, token_hash, max_uses, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			link.ID, link.SpaceID, link.CreatorID, auth.HashToken(token), link.MaxUses, link.ExpiresAt, link.CreatedAt)
+		if err != nil {
+			log.Printf("Failed to create invite link: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to create invite link")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusCreated, auth.Response{
+			Success: true,
+			Message: "Copy this link now, it won't be shown again",
+			Data:    link,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SpaceInviteLinkHandler revokes an invite link. Its creator or anyone who can
+// review join requests may revoke it. The IDs come from the {spaceID} and
+// {linkID} path wildcards.
+func SpaceInviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+	linkID, err := uuid.Parse(r.PathValue("linkID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid invite link ID")
+		return
+	}
+
+	role, ok := authorize(w, principal, rbac.PermInviteMembers, spaceID)
+	if !ok {
+		return
+	}
+
+	result, err := db.DB.Exec(`DELETE FROM space_invite_links WHERE id = $1 AND space_id = $2 AND (creator_id = $3 OR $4)`,
+		linkID, spaceID, principal.UserID, rbac.SpaceRoleHas(role, rbac.PermReviewJoinRequests))
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		respondWithInviteError(w, ErrInviteNotFound)
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Invite link revoked",
+	})
+}
+
+// RedeemInviteLinkHandler joins the space an invite link belongs to
+func RedeemInviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	var req models.RedeemSpaceInviteLinkRequest
+	if !auth.DecodeJSON(w, r, &req) {
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the link so concurrent redemptions can't exceed max_uses
+	link, err := scanInviteLink(tx.QueryRow(`SELECT `+inviteLinkColumns+`
+		FROM space_invite_links WHERE token_hash = $1 FOR UPDATE`, auth.HashToken(req.Token)))
+	if err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	if !usable(link, db.CurrentTime()) {
+		respondWithInviteError(w, ErrInviteExpired)
+		return
+	}
+
+	if err := addMember(tx, link.SpaceID, principal.UserID); err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE space_invite_links SET uses = uses + 1 WHERE id = $1`, link.ID); err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithInviteError(w, err)
+		return
+	}
+
+	publishMemberJoined(link.SpaceID, principal.UserID, &link.CreatorID, "invite_link")
+
+	space, err := getSpace(link.SpaceID)
+	if err != nil {
+		respondWithSpaceError(w, err, "Failed to get space")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Joined space",
+		Data:    space,
+	})
+}
+
+// respondWithInviteError maps an invitation error to a response
+func respondWithInviteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, ErrInviteNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Invitation not found")
+	case errors.Is(err, ErrInviteExpired):
+		auth.RespondWithError(w, http.StatusGone, "This invite link has expired")
+	case errors.Is(err, ErrAlreadyInvited):
+		auth.RespondWithError(w, http.StatusConflict, "This user has already been invited")
+	case errors.Is(err, rbac.ErrUserNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "User not found")
+	default:
+		respondWithMemberError(w, err)
+	}
+}
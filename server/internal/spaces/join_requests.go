@@ -0,0 +1,314 @@
+package spaces
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// Join request statuses
+const (
+	joinRequestPending  = "pending"
+	joinRequestApproved = "approved"
+	joinRequestRejected = "rejected"
+)
+
+var (
+	// ErrPublicSpace is returned when asking to join a space anyone can join
+	ErrPublicSpace = errors.New("space is public")
+	// ErrAlreadyRequested is returned when the user already has a pending request for the space
+	ErrAlreadyRequested = errors.New("join request already pending")
+	// ErrJoinRequestNotFound is returned for an unknown or already reviewed join request
+	ErrJoinRequestNotFound = errors.New("join request not found")
+)
+
+// joinRequestColumns is the column list scanned by scanJoinRequest
+const joinRequestColumns = `jr.id, jr.space_id, jr.user_id, u.username, COALESCE(jr.message, ''), jr.status,
+	jr.reviewer_id, jr.reviewed_at, jr.created_at`
+
+// scanJoinRequest reads a row selected with joinRequestColumns
+func scanJoinRequest(row rowScanner) (models.SpaceJoinRequest, error) {
+	var jr models.SpaceJoinRequest
+	err := row.Scan(&jr.ID, &jr.SpaceID, &jr.UserID, &jr.Username, &jr.Message, &jr.Status,
+		&jr.ReviewerID, &jr.ReviewedAt, &jr.CreatedAt)
+	return jr, err
+}
+
+// getJoinRequest returns a join request in a space
+func getJoinRequest(q rowQuerier, spaceID, requestID uuid.UUID) (models.SpaceJoinRequest, error) {
+	jr, err := scanJoinRequest(q.QueryRow(`SELECT `+joinRequestColumns+`
+		FROM space_join_requests jr
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.id = $1 AND jr.space_id = $2`, requestID, spaceID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return jr, ErrJoinRequestNotFound
+	}
+	return jr, err
+}
+
+// listPendingJoinRequests returns a space's pending join requests, oldest first
+func listPendingJoinRequests(spaceID uuid.UUID) ([]models.SpaceJoinRequest, error) {
+	rows, err := db.DB.Query(`SELECT `+joinRequestColumns+`
+		FROM space_join_requests jr
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.space_id = $1 AND jr.status = $2
+		ORDER BY jr.created_at`, spaceID, joinRequestPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []models.SpaceJoinRequest{}
+	for rows.Next() {
+		jr, err := scanJoinRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, jr)
+	}
+	return requests, rows.Err()
+}
+
+// createJoinRequest asks to join a private space
+func createJoinRequest(spaceID, userID uuid.UUID, message string) (models.SpaceJoinRequest, error) {
+	var isPublic, isMember bool
+	err := db.DB.QueryRow(`SELECT s.is_public, EXISTS (SELECT 1 FROM space_members WHERE space_id = s.id AND user_id = $2)
+		FROM spaces s WHERE s.id = $1`, spaceID, userID).Scan(&isPublic, &isMember)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SpaceJoinRequest{}, rbac.ErrSpaceNotFound
+	}
+	if err != nil {
+		return models.SpaceJoinRequest{}, err
+	}
+	if isPublic {
+		return models.SpaceJoinRequest{}, ErrPublicSpace
+	}
+	if isMember {
+		return models.SpaceJoinRequest{}, ErrAlreadyMember
+	}
+
+	requestID := uuid.New()
+	var note *string
+	if message != "" {
+		note = &message
+	}
+	result, err := db.DB.Exec(`INSERT INTO space_join_requests (id, space_id, user_id, message, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (space_id, user_id) WHERE status = 'pending' DO NOTHING`,
+		requestID, spaceID, userID, note, joinRequestPending, db.CurrentTime())
+	if err != nil {
+		return models.SpaceJoinRequest{}, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return models.SpaceJoinRequest{}, ErrAlreadyRequested
+	}
+
+	return getJoinRequest(db.DB, spaceID, requestID)
+}
+
+// reviewJoinRequest approves or rejects a pending join request, adding the user
+// to the space if it is approved
+func reviewJoinRequest(spaceID, requestID, reviewerID uuid.UUID, approve bool) (models.SpaceJoinRequest, error) {
+	status := joinRequestRejected
+	if approve {
+		status = joinRequestApproved
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return models.SpaceJoinRequest{}, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRow(`UPDATE space_join_requests
+		SET status = $1, reviewer_id = $2, reviewed_at = $3
+		WHERE id = $4 AND space_id = $5 AND status = $6
+		RETURNING user_id`,
+		status, reviewerID, db.CurrentTime(), requestID, spaceID, joinRequestPending).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SpaceJoinRequest{}, ErrJoinRequestNotFound
+	}
+	if err != nil {
+		return models.SpaceJoinRequest{}, err
+	}
+
+	if approve {
+		if err := addMember(tx, spaceID, userID); err != nil {
+			return models.SpaceJoinRequest{}, err
+		}
+	}
+
+	jr, err := getJoinRequest(tx, spaceID, requestID)
+	if err != nil {
+		return models.SpaceJoinRequest{}, err
+	}
+	return jr, tx.Commit()
+}
+
+// SpaceJoinRequestsHandler lists a space's pending join requests (GET) or asks to
+// join a private space (POST). Anyone who knows a private space's ID can ask to
+// join it. The space ID comes from the {spaceID} path wildcard.
+func SpaceJoinRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := authorize(w, principal, rbac.PermReviewJoinRequests, spaceID); !ok {
+			return
+		}
+
+		requests, err := listPendingJoinRequests(spaceID)
+		if err != nil {
+			log.Printf("Failed to list join requests: %v", err)
+			auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list join requests")
+			return
+		}
+
+		auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+			Success: true,
+			Data:    requests,
+		})
+
+	case http.MethodPost:
+		if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+			return
+		}
+
+		var req models.CreateSpaceJoinRequest
+		if !auth.DecodeJSON(w, r, &req) {
+			return
+		}
+
+		jr, err := createJoinRequest(spaceID, principal.UserID, strings.TrimSpace(req.Message))
+		if err != nil {
+			respondWithJoinRequestError(w, err)
+			return
+		}
+
+		events.Publish(events.Event{
+			Type:       events.JoinRequestCreated,
+			SpaceID:    &spaceID,
+			Permission: string(rbac.PermReviewJoinRequests),
+			ActorID:    &principal.UserID,
+			Data:       jr,
+		})
+
+		auth.RespondWithJSON(w, http.StatusCreated, auth.Response{
+			Success: true,
+			Message: "Join request sent",
+			Data:    jr,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ApproveJoinRequestHandler approves a join request and adds its user to the
+// space. The IDs come from the {spaceID} and {requestID} path wildcards.
+func ApproveJoinRequestHandler(w http.ResponseWriter, r *http.Request) {
+	answerJoinRequest(w, r, true)
+}
+
+// RejectJoinRequestHandler rejects a join request. The IDs come from the
+// {spaceID} and {requestID} path wildcards.
+func RejectJoinRequestHandler(w http.ResponseWriter, r *http.Request) {
+	answerJoinRequest(w, r, false)
+}
+
+// answerJoinRequest approves or rejects a join request
+func answerJoinRequest(w http.ResponseWriter, r *http.Request, approve bool) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesAdmin) {
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+	requestID, err := uuid.Parse(r.PathValue("requestID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid join request ID")
+		return
+	}
+
+	if _, ok := authorize(w, principal, rbac.PermReviewJoinRequests, spaceID); !ok {
+		return
+	}
+
+	jr, err := reviewJoinRequest(spaceID, requestID, principal.UserID, approve)
+	if err != nil {
+		respondWithJoinRequestError(w, err)
+		return
+	}
+
+	event := events.Event{
+		Type:       events.JoinRequestRejected,
+		SpaceID:    &spaceID,
+		Permission: string(rbac.PermReviewJoinRequests),
+		UserIDs:    []uuid.UUID{jr.UserID},
+		ActorID:    &principal.UserID,
+		Data:       jr,
+	}
+	message := "Join request rejected"
+	if approve {
+		event.Type = events.JoinRequestApproved
+		message = "Join request approved"
+	}
+	events.Publish(event)
+	if approve {
+		publishMemberJoined(spaceID, jr.UserID, &principal.UserID, "join_request")
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: message,
+		Data:    jr,
+	})
+}
+
+// respondWithJoinRequestError maps a join request error to a response
+func respondWithJoinRequestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrPublicSpace):
+		auth.RespondWithError(w, http.StatusBadRequest, "This space is public, join it directly")
+	case errors.Is(err, ErrAlreadyRequested):
+		auth.RespondWithError(w, http.StatusConflict, "You have already asked to join this space")
+	case errors.Is(err, ErrJoinRequestNotFound):
+		auth.RespondWithError(w, http.StatusNotFound, "Join request not found")
+	default:
+		respondWithMemberError(w, err)
+	}
+}
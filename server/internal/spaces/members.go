@@ -0,0 +1,367 @@
+package spaces
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/auth"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/events"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+var (
+	// ErrAlreadyMember is returned when a user who is already a member tries to join
+	ErrAlreadyMember = errors.New("user is already a member of the space")
+	// ErrPrivateSpace is returned when joining a private space without an invitation
+	ErrPrivateSpace = errors.New("space is private")
+)
+
+// addMember adds a user to a space as a member and clears their outstanding
+// invitations and join requests for it. It returns ErrAlreadyMember if they
+// were already in the space.
+func addMember(q execer, spaceID, userID uuid.UUID) error {
+	result, err := q.Exec(`INSERT INTO space_members (space_id, user_id, role, joined_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (space_id, user_id) DO NOTHING`, spaceID, userID, rbac.SpaceRoleMember, db.CurrentTime())
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrAlreadyMember
+	}
+
+	if _, err := q.Exec(`DELETE FROM space_invites WHERE space_id = $1 AND invitee_id = $2`, spaceID, userID); err != nil {
+		return err
+	}
+	_, err = q.Exec(`DELETE FROM space_join_requests WHERE space_id = $1 AND user_id = $2 AND status = 'pending'`, spaceID, userID)
+	return err
+}
+
+// removeMember removes a user from a space, refusing to remove its last owner.
+// If allowed is not nil it is called with the member's role inside the
+// transaction and the member is only removed if it returns true.
+func removeMember(spaceID, userID uuid.UUID, allowed func(role rbac.Role) bool) (rbac.Role, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var role rbac.Role
+	err = tx.QueryRow(`SELECT role FROM space_members WHERE space_id = $1 AND user_id = $2 FOR UPDATE`,
+		spaceID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", rbac.ErrNotMember
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if allowed != nil && !allowed(role) {
+		return "", rbac.ErrForbidden
+	}
+
+	if role == rbac.SpaceRoleOwner {
+		var owners int
+		// Lock the owner rows so two owners can't leave at the same time
+		err := tx.QueryRow(`SELECT COUNT(*) FROM (SELECT user_id FROM space_members WHERE space_id = $1 AND role = $2 FOR UPDATE) o`,
+			spaceID, rbac.SpaceRoleOwner).Scan(&owners)
+		if err != nil {
+			return "", err
+		}
+		if owners <= 1 {
+			return "", rbac.ErrLastOwner
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM space_members WHERE space_id = $1 AND user_id = $2`, spaceID, userID); err != nil {
+		return "", err
+	}
+	return role, tx.Commit()
+}
+
+// getMember returns one member of a space
+func getMember(spaceID, userID uuid.UUID) (models.SpaceMemberResponse, error) {
+	var m models.SpaceMemberResponse
+	err := db.DB.QueryRow(`SELECT sm.user_id, u.username, sm.role, sm.joined_at
+		FROM space_members sm
+		JOIN users u ON u.id = sm.user_id
+		WHERE sm.space_id = $1 AND sm.user_id = $2`, spaceID, userID).
+		Scan(&m.UserID, &m.Username, &m.Role, &m.JoinedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, rbac.ErrNotMember
+	}
+	return m, err
+}
+
+// listMembers returns the members of a space, highest role first
+func listMembers(spaceID uuid.UUID) ([]models.SpaceMemberResponse, error) {
+	rows, err := db.DB.Query(`SELECT sm.user_id, u.username, sm.role, sm.joined_at
+		FROM space_members sm
+		JOIN users u ON u.id = sm.user_id
+		WHERE sm.space_id = $1
+		ORDER BY CASE sm.role
+			WHEN 'owner' THEN 1 WHEN 'admin' THEN 2 WHEN 'moderator' THEN 3 WHEN 'member' THEN 4 ELSE 5
+		END, LOWER(u.username)`, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.SpaceMemberResponse{}
+	for rows.Next() {
+		var m models.SpaceMemberResponse
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// publishMemberJoined tells the space that a user joined. via says how they got
+// in: "public", "invite", "invite_link" or "join_request".
+func publishMemberJoined(spaceID, userID uuid.UUID, actorID *uuid.UUID, via string) {
+	member, err := getMember(spaceID, userID)
+	if err != nil {
+		log.Printf("Failed to load new member of space %s: %v", spaceID, err)
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:    events.MemberJoined,
+		SpaceID: &spaceID,
+		// Also address the new member, who may not be following the space yet
+		UserIDs: []uuid.UUID{userID},
+		ActorID: actorID,
+		Data: map[string]interface{}{
+			"member": member,
+			"via":    via,
+		},
+	})
+}
+
+// SpaceMembersHandler lists the members of a space. The space ID comes from
+// the {spaceID} path wildcard.
+func SpaceMembersHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET method
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	if _, ok := authorize(w, principal, rbac.PermViewSpace, spaceID); !ok {
+		return
+	}
+
+	members, err := listMembers(spaceID)
+	if err != nil {
+		log.Printf("Failed to list members: %v", err)
+		auth.RespondWithError(w, http.StatusInternalServerError, "Failed to list members")
+		return
+	}
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Data:    members,
+	})
+}
+
+// SpaceMemberHandler removes a member from a space. Moderators can remove members
+// ranked below them; anyone can remove themselves. The IDs come from the {spaceID}
+// and {userID} path wildcards.
+func SpaceMemberHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow DELETE method
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if userID == principal.UserID {
+		if requireScope(w, principal, auth.ScopeSpacesWrite) {
+			leaveSpace(w, principal, spaceID)
+		}
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesAdmin) {
+		return
+	}
+
+	actorRole, ok := authorize(w, principal, rbac.PermKickMembers, spaceID)
+	if !ok {
+		return
+	}
+
+	role, err := removeMember(spaceID, userID, func(role rbac.Role) bool {
+		return rbac.CanRemoveSpaceMember(actorRole, role)
+	})
+	if err != nil {
+		respondWithMemberError(w, err)
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:    events.MemberRemoved,
+		SpaceID: &spaceID,
+		// The removed user is no longer a member, so tell them directly
+		UserIDs: []uuid.UUID{userID},
+		ActorID: &principal.UserID,
+		Data:    map[string]interface{}{"user_id": userID, "role": role},
+	})
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Member removed",
+	})
+}
+
+// JoinSpaceHandler joins a public space. Private spaces need an invitation or an
+// approved join request. The space ID comes from the {spaceID} path wildcard.
+func JoinSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	space, err := getSpace(spaceID)
+	if err != nil {
+		respondWithSpaceError(w, err, "Failed to join space")
+		return
+	}
+	if !space.IsPublic {
+		respondWithMemberError(w, ErrPrivateSpace)
+		return
+	}
+
+	if err := addMember(db.DB, spaceID, principal.UserID); err != nil {
+		respondWithMemberError(w, err)
+		return
+	}
+	publishMemberJoined(spaceID, principal.UserID, &principal.UserID, "public")
+
+	space.MemberCount++
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Joined space",
+		Data:    space,
+	})
+}
+
+// LeaveSpaceHandler removes the current user from a space. The last owner has to
+// hand ownership to someone else or delete the space instead. The space ID comes
+// from the {spaceID} path wildcard.
+func LeaveSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := auth.PrincipalFromContext(r.Context())
+	if !ok {
+		auth.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !requireScope(w, principal, auth.ScopeSpacesWrite) {
+		return
+	}
+
+	spaceID, err := uuid.Parse(r.PathValue("spaceID"))
+	if err != nil {
+		auth.RespondWithError(w, http.StatusBadRequest, "Invalid space ID")
+		return
+	}
+
+	leaveSpace(w, principal, spaceID)
+}
+
+// leaveSpace removes the principal from a space and responds
+func leaveSpace(w http.ResponseWriter, principal *auth.Principal, spaceID uuid.UUID) {
+	role, err := removeMember(spaceID, principal.UserID, nil)
+	if err != nil {
+		respondWithMemberError(w, err)
+		return
+	}
+
+	events.Publish(events.Event{
+		Type:    events.MemberLeft,
+		SpaceID: &spaceID,
+		// Keep the user's other devices in sync now that they aren't a member
+		UserIDs: []uuid.UUID{principal.UserID},
+		ActorID: &principal.UserID,
+		Data:    map[string]interface{}{"user_id": principal.UserID, "role": role},
+	})
+
+	auth.RespondWithJSON(w, http.StatusOK, auth.Response{
+		Success: true,
+		Message: "Left space",
+	})
+}
+
+// respondWithMemberError maps a membership error to a response
+func respondWithMemberError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrAlreadyMember):
+		auth.RespondWithError(w, http.StatusConflict, "Already a member of this space")
+	case errors.Is(err, ErrPrivateSpace):
+		auth.RespondWithError(w, http.StatusForbidden, "This space is private. Ask for an invitation or request to join.")
+	case errors.Is(err, rbac.ErrNotMember):
+		auth.RespondWithError(w, http.StatusNotFound, "User is not a member of this space")
+	case errors.Is(err, rbac.ErrLastOwner):
+		auth.RespondWithError(w, http.StatusConflict, "The last owner can't leave. Make someone else an owner or delete the space.")
+	case errors.Is(err, rbac.ErrForbidden):
+		auth.RespondWithError(w, http.StatusForbidden, "You can only remove members ranked below you")
+	default:
+		respondWithSpaceError(w, err, "Failed to update membership")
+	}
+}
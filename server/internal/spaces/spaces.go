@@ -0,0 +1,212 @@
+package spaces
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gotext/server/internal/db"
+	"github.com/gotext/server/internal/models"
+	"github.com/gotext/server/internal/rbac"
+)
+
+// Page size limits for listing public spaces
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// spaceColumns is the column list scanned by scanSpace. The table must be aliased as s.
+const spaceColumns = `s.id, s.name, COALESCE(s.description, ''), s.creator_id, s.is_public, s.created_at, s.updated_at,
+	(SELECT COUNT(*) FROM space_members m WHERE m.space_id = s.id)`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanSpace reads a row selected with spaceColumns
+func scanSpace(row rowScanner) (models.Space, int, error) {
+	var s models.Space
+	var memberCount int
+	err := row.Scan(&s.ID, &s.Name, &s.Description, &s.CreatorID, &s.IsPublic, &s.CreatedAt, &s.UpdatedAt, &memberCount)
+	return s, memberCount, err
+}
+
+// toResponse converts a scanned space to a SpaceResponse
+func toResponse(s models.Space, memberCount int) models.SpaceResponse {
+	response := s.ToResponse()
+	response.MemberCount = memberCount
+	return response
+}
+
+// createSpace creates a space and makes the creator its owner
+func createSpace(creatorID uuid.UUID, req models.CreateSpaceRequest) (models.SpaceResponse, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return models.SpaceResponse{}, err
+	}
+	defer tx.Rollback()
+
+	now := db.CurrentTime()
+	space := models.Space{
+		ID:          uuid.New(),
+		Name:        strings.TrimSpace(req.Name),
+		Description: strings.TrimSpace(req.Description),
+		CreatorID:   creatorID,
+		IsPublic:    req.IsPublic,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	_, err = tx.Exec(`INSERT INTO spaces (id, name, description, creator_id, is_public, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		space.ID, space.Name, space.Description, space.CreatorID, space.IsPublic, now)
+	if err != nil {
+		return models.SpaceResponse{}, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO space_members (space_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)`,
+		space.ID, creatorID, rbac.SpaceRoleOwner, now)
+	if err != nil {
+		return models.SpaceResponse{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.SpaceResponse{}, err
+	}
+
+	return toResponse(space, 1), nil
+}
+
+// getSpace returns a space by ID
+func getSpace(spaceID uuid.UUID) (models.SpaceResponse, error) {
+	space, memberCount, err := scanSpace(db.DB.QueryRow(`SELECT `+spaceColumns+` FROM spaces s WHERE s.id = $1`, spaceID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SpaceResponse{}, rbac.ErrSpaceNotFound
+	}
+	if err != nil {
+		return models.SpaceResponse{}, err
+	}
+	return toResponse(space, memberCount), nil
+}
+
+// updateSpace changes the fields set in the request and leaves the rest alone
+func updateSpace(spaceID uuid.UUID, req models.UpdateSpaceRequest) (models.SpaceResponse, error) {
+	var name, description *string
+	if trimmed := strings.TrimSpace(req.Name); trimmed != "" {
+		name = &trimmed
+	}
+	if req.Description != nil {
+		trimmed := strings.TrimSpace(*req.Description)
+		description = &trimmed
+	}
+
+	_, err := db.DB.Exec(`UPDATE spaces SET
+		name = COALESCE($2, name),
+		description = COALESCE($3, description),
+		is_public = COALESCE($4, is_public)
+		WHERE id = $1`, spaceID, name, description, req.IsPublic)
+	if err != nil {
+		return models.SpaceResponse{}, err
+	}
+
+	return getSpace(spaceID)
+}
+
+// deleteSpace deletes a space along with its memberships and messages and
+// returns the IDs of the users who were members
+func deleteSpace(spaceID uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM space_members WHERE space_id = $1 RETURNING user_id`, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	memberIDs := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		memberIDs = append(memberIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM spaces WHERE id = $1`, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, rbac.ErrSpaceNotFound
+	}
+
+	return memberIDs, tx.Commit()
+}
+
+// listMemberSpaces returns the spaces a user is a member of, by name
+func listMemberSpaces(userID uuid.UUID) ([]models.SpaceResponse, error) {
+	rows, err := db.DB.Query(`SELECT `+spaceColumns+`
+		FROM spaces s
+		JOIN space_members sm ON sm.space_id = s.id
+		WHERE sm.user_id = $1
+		ORDER BY LOWER(s.name), s.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanSpaces(rows)
+}
+
+// listPublicSpaces returns public spaces whose name or description contains
+// query, most popular first
+func listPublicSpaces(query string, limit, offset int) ([]models.SpaceResponse, error) {
+	rows, err := db.DB.Query(`SELECT `+spaceColumns+`
+		FROM spaces s
+		WHERE s.is_public = TRUE
+		AND ($1 = '' OR s.name ILIKE '%' || $1 || '%' OR s.description ILIKE '%' || $1 || '%')
+		ORDER BY 8 DESC, LOWER(s.name), s.id
+		LIMIT $2 OFFSET $3`, escapeLike(query), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanSpaces(rows)
+}
+
+// scanSpaces reads every row selected with spaceColumns and closes rows
+func scanSpaces(rows *sql.Rows) ([]models.SpaceResponse, error) {
+	defer rows.Close()
+
+	spaces := []models.SpaceResponse{}
+	for rows.Next() {
+		space, memberCount, err := scanSpace(rows)
+		if err != nil {
+			return nil, err
+		}
+		spaces = append(spaces, toResponse(space, memberCount))
+	}
+	return spaces, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in a search string so they match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
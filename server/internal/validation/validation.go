@@ -0,0 +1,330 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError describes one field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Errors is the list of fields that failed validation
+type Errors []FieldError
+
+// Error implements the error interface
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// RuleFunc reports whether a field value satisfies a rule. param is the text after
+// "=" in the tag (e.g. "3" for "min=3"), or empty if there is none.
+type RuleFunc func(value reflect.Value, param string) bool
+
+// rule is a registered validation rule
+type rule struct {
+	check   RuleFunc
+	message func(value reflect.Value, param string) string
+}
+
+var (
+	rulesMu sync.RWMutex
+	rules   = map[string]rule{}
+)
+
+// RegisterRule adds a rule that can be used in validate tags. message is the
+// error message shown when the rule fails; a %s in it is replaced by the parameter.
+func RegisterRule(name string, check RuleFunc, message string) {
+	register(name, check, func(_ reflect.Value, param string) string {
+		if strings.Contains(message, "%s") {
+			return fmt.Sprintf(message, param)
+		}
+		return message
+	})
+}
+
+// register adds a rule whose message depends on the value
+func register(name string, check RuleFunc, message func(value reflect.Value, param string) string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules[name] = rule{check: check, message: message}
+}
+
+// sizeMessage builds the message for a failed min or max rule, e.g. "must be at least 3 characters"
+func sizeMessage(comparison string) func(reflect.Value, string) string {
+	return func(v reflect.Value, param string) string {
+		switch v.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be %s %s characters", comparison, param)
+		case reflect.Slice, reflect.Map, reflect.Array:
+			return fmt.Sprintf("must have %s %s items", comparison, param)
+		default:
+			return fmt.Sprintf("must be %s %s", comparison, param)
+		}
+	}
+}
+
+// usernamePattern is the character set allowed in usernames
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func init() {
+	RegisterRule("required", func(v reflect.Value, _ string) bool {
+		return !isEmpty(v)
+	}, "is required")
+	register("min", func(v reflect.Value, param string) bool {
+		n, ok := size(v)
+		limit, err := strconv.ParseFloat(param, 64)
+		return !ok || err != nil || n >= limit
+	}, sizeMessage("at least"))
+	register("max", func(v reflect.Value, param string) bool {
+		n, ok := size(v)
+		limit, err := strconv.ParseFloat(param, 64)
+		return !ok || err != nil || n <= limit
+	}, sizeMessage("at most"))
+	RegisterRule("maxbytes", func(v reflect.Value, param string) bool {
+		limit, err := strconv.Atoi(param)
+		return v.Kind() != reflect.String || err != nil || len(v.String()) <= limit
+	}, "must be at most %s bytes")
+	RegisterRule("email", func(v reflect.Value, _ string) bool {
+		if v.Kind() != reflect.String {
+			return false
+		}
+		// Only accept a bare address, not "Name <address>"
+		addr, err := mail.ParseAddress(v.String())
+		return err == nil && addr.Address == v.String()
+	}, "must be a valid email address")
+	RegisterRule("username", func(v reflect.Value, _ string) bool {
+		return v.Kind() == reflect.String && usernamePattern.MatchString(v.String())
+	}, "may only contain letters, numbers, dots, dashes and underscores")
+	RegisterRule("oneof", func(v reflect.Value, param string) bool {
+		if v.Kind() != reflect.String {
+			return false
+		}
+		for _, option := range strings.Fields(param) {
+			if v.String() == option {
+				return true
+			}
+		}
+		return false
+	}, "must be one of: %s")
+}
+
+// Validate checks a struct (or pointer to a struct) against its validate tags and
+// returns Errors listing every field that failed, or nil if it is valid. Fields are
+// named after their JSON names. Supported rules are required, omitempty, min, max,
+// maxbytes, email, username, oneof and anything added with RegisterRule. For strings
+// min and max count characters, for slices and maps elements, and for numbers the
+// value; maxbytes limits a string's length in bytes. A tag naming a rule that isn't
+// registered is a programming error and is returned as an ErrUnknownRule error
+// rather than Errors.
+func Validate(v interface{}) error {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs Errors
+	if err := validateStruct(value, "", &errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// fieldRules is the parsed validate tag of one struct field
+type fieldRules struct {
+	index     int
+	name      string
+	omitEmpty bool
+	rules     []boundRule
+	nested    bool // the field is a struct to validate recursively
+}
+
+// boundRule is a rule from a validate tag, resolved against the registered rules
+type boundRule struct {
+	name  string
+	param string
+	rule  rule
+}
+
+// parsedType is the cached result of parsing a struct type's validate tags
+type parsedType struct {
+	fields []fieldRules
+	err    error
+}
+
+// ErrUnknownRule is returned by Validate when a validate tag names a rule that isn't registered
+var ErrUnknownRule = errors.New("validation: unknown rule")
+
+// typeCache holds the parsed rules of every struct type validated so far
+var typeCache sync.Map // reflect.Type -> parsedType
+
+// validateStruct validates every field of a struct value
+func validateStruct(value reflect.Value, prefix string, errs *Errors) error {
+	fields, err := parseType(value.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, fr := range fields {
+		field := value.Field(fr.index)
+		name := prefix + fr.name
+
+		if fr.omitEmpty && isEmpty(field) {
+			continue
+		}
+
+		for _, r := range fr.rules {
+			check := field
+			for check.Kind() == reflect.Ptr && !check.IsNil() && r.name != "required" {
+				check = check.Elem()
+			}
+
+			if !r.rule.check(check, r.param) {
+				*errs = append(*errs, FieldError{Field: name, Rule: r.name, Message: r.rule.message(check, r.param)})
+				// Report only the first failing rule per field
+				break
+			}
+		}
+
+		if fr.nested {
+			nested := field
+			for nested.Kind() == reflect.Ptr && !nested.IsNil() {
+				nested = nested.Elem()
+			}
+			if nested.Kind() == reflect.Struct {
+				if err := validateStruct(nested, name+".", errs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseType returns the validation rules for a struct type. Rule names are
+// resolved here, once per type, so an unknown rule is reported without
+// looking at any values; the error is cached along with the rules.
+func parseType(t reflect.Type) ([]fieldRules, error) {
+	if cached, ok := typeCache.Load(t); ok {
+		parsed := cached.(parsedType)
+		return parsed.fields, parsed.err
+	}
+
+	var parsed []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		fr := fieldRules{index: i, name: name}
+
+		fieldType := f.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		// Structs without tags of their own (such as time.Time) are not descended into
+		if fieldType.Kind() == reflect.Struct && hasValidateTags(fieldType) {
+			fr.nested = true
+		}
+
+		for _, part := range strings.Split(f.Tag.Get("validate"), ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+			case part == "omitempty":
+				fr.omitEmpty = true
+			default:
+				ruleName, param, _ := strings.Cut(part, "=")
+				rulesMu.RLock()
+				registered, ok := rules[ruleName]
+				rulesMu.RUnlock()
+				if !ok {
+					err := fmt.Errorf("%w %q on %s.%s", ErrUnknownRule, ruleName, t.Name(), f.Name)
+					typeCache.Store(t, parsedType{err: err})
+					return nil, err
+				}
+				fr.rules = append(fr.rules, boundRule{name: ruleName, param: param, rule: registered})
+			}
+		}
+
+		if len(fr.rules) > 0 || fr.nested {
+			parsed = append(parsed, fr)
+		}
+	}
+
+	typeCache.Store(t, parsedType{fields: parsed})
+	return parsed, nil
+}
+
+// hasValidateTags reports whether any field of a struct type has a validate tag
+func hasValidateTags(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("validate") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmpty reports whether a value is missing. Strings are empty if they only hold whitespace.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// size returns the length or numeric value compared by min and max
+func size(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,238 @@
+package validation
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// failedRules returns the rule each field failed, keyed by field name
+func failedRules(t *testing.T, err error) map[string]string {
+	t.Helper()
+
+	failed := map[string]string{}
+	if err == nil {
+		return failed
+	}
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+	for _, fe := range errs {
+		if _, ok := failed[fe.Field]; ok {
+			t.Errorf("field %s was reported more than once", fe.Field)
+		}
+		failed[fe.Field] = fe.Rule
+	}
+	return failed
+}
+
+// checkRules validates v and compares the failed rules with want
+func checkRules(t *testing.T, v interface{}, want map[string]string) {
+	t.Helper()
+
+	got := failedRules(t, Validate(v))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected failures %v, got %v", want, got)
+	}
+}
+
+func TestRequired(t *testing.T) {
+	type request struct {
+		Name  string   `json:"name" validate:"required"`
+		Tags  []string `json:"tags" validate:"required"`
+		Count int      `json:"count" validate:"required"`
+	}
+
+	checkRules(t, request{Name: "a", Tags: []string{"x"}, Count: 1}, map[string]string{})
+	checkRules(t, request{}, map[string]string{"name": "required", "tags": "required", "count": "required"})
+	// Whitespace doesn't count as a value
+	checkRules(t, request{Name: " \t\n", Tags: []string{"x"}, Count: 1}, map[string]string{"name": "required"})
+}
+
+func TestMinMax(t *testing.T) {
+	type request struct {
+		Name  string   `json:"name" validate:"min=3,max=5"`
+		Tags  []string `json:"tags" validate:"min=1,max=2"`
+		Count int      `json:"count" validate:"min=1,max=10"`
+		Score float64  `json:"score" validate:"min=0.5,max=1"`
+	}
+
+	tests := []struct {
+		name string
+		req  request
+		want map[string]string
+	}{
+		{"within limits", request{Name: "abc", Tags: []string{"x"}, Count: 1, Score: 0.5}, map[string]string{}},
+		{"at the upper limits", request{Name: "abcde", Tags: []string{"x", "y"}, Count: 10, Score: 1}, map[string]string{}},
+		{"below", request{Name: "ab", Tags: []string{}, Count: 0, Score: 0.4},
+			map[string]string{"name": "min", "tags": "min", "count": "min", "score": "min"}},
+		{"above", request{Name: "abcdef", Tags: []string{"x", "y", "z"}, Count: 11, Score: 1.5},
+			map[string]string{"name": "max", "tags": "max", "count": "max", "score": "max"}},
+		// Strings are measured in characters, not bytes
+		{"multi-byte characters", request{Name: "ééééé", Tags: []string{"x"}, Count: 1, Score: 1}, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkRules(t, tt.req, tt.want)
+		})
+	}
+}
+
+func TestMinMaxMessages(t *testing.T) {
+	type request struct {
+		Name  string   `json:"name" validate:"min=3"`
+		Tags  []string `json:"tags" validate:"max=1"`
+		Count int      `json:"count" validate:"min=2"`
+	}
+
+	err := Validate(request{Name: "a", Tags: []string{"x", "y"}, Count: 1})
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+
+	want := map[string]string{
+		"name":  "must be at least 3 characters",
+		"tags":  "must have at most 1 items",
+		"count": "must be at least 2",
+	}
+	for _, fe := range errs {
+		if fe.Message != want[fe.Field] {
+			t.Errorf("%s: expected %q, got %q", fe.Field, want[fe.Field], fe.Message)
+		}
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	type request struct {
+		Password string `json:"password" validate:"maxbytes=8"`
+	}
+
+	checkRules(t, request{Password: "abcdefgh"}, map[string]string{})
+	checkRules(t, request{Password: "abcdefghi"}, map[string]string{"password": "maxbytes"})
+	// Five characters, but ten bytes
+	checkRules(t, request{Password: "ééééé"}, map[string]string{"password": "maxbytes"})
+}
+
+func TestOmitEmpty(t *testing.T) {
+	type request struct {
+		Email string `json:"email" validate:"omitempty,email"`
+		Name  string `json:"name" validate:"omitempty,min=3"`
+	}
+
+	checkRules(t, request{}, map[string]string{})
+	checkRules(t, request{Name: "  "}, map[string]string{})
+	checkRules(t, request{Email: "not an email", Name: "ab"}, map[string]string{"email": "email", "name": "min"})
+	checkRules(t, request{Email: "a@example.com", Name: "abc"}, map[string]string{})
+}
+
+func TestPointerFields(t *testing.T) {
+	type request struct {
+		Description *string `json:"description" validate:"omitempty,max=3"`
+		Public      *bool   `json:"public" validate:"required"`
+	}
+
+	yes := true
+	short, long := "abc", "abcd"
+
+	checkRules(t, request{Public: &yes}, map[string]string{})
+	checkRules(t, request{Description: &short, Public: &yes}, map[string]string{})
+	// Rules other than required apply to the value pointed to
+	checkRules(t, request{Description: &long, Public: &yes}, map[string]string{"description": "max"})
+	checkRules(t, request{}, map[string]string{"public": "required"})
+
+	// A pointer to the struct is validated like the struct
+	checkRules(t, &request{}, map[string]string{"public": "required"})
+	if err := Validate((*request)(nil)); err != nil {
+		t.Errorf("expected a nil pointer to be valid, got %v", err)
+	}
+}
+
+func TestNestedStructs(t *testing.T) {
+	type address struct {
+		City string `json:"city" validate:"required"`
+	}
+	type request struct {
+		Name    string   `json:"name" validate:"required"`
+		Home    address  `json:"home"`
+		Work    *address `json:"work"`
+		Ignored address  `json:"-"`
+	}
+
+	checkRules(t, request{Name: "a", Home: address{City: "x"}}, map[string]string{})
+	checkRules(t, request{}, map[string]string{"name": "required", "home.city": "required"})
+	checkRules(t, request{Name: "a", Home: address{City: "x"}, Work: &address{}}, map[string]string{"work.city": "required"})
+}
+
+func TestFieldNames(t *testing.T) {
+	type request struct {
+		Named   string `json:"display_name,omitempty" validate:"required"`
+		Unnamed string `validate:"required"`
+		Skipped string `json:"-" validate:"required"`
+	}
+
+	checkRules(t, request{}, map[string]string{"display_name": "required", "Unnamed": "required"})
+}
+
+func TestFirstFailurePerField(t *testing.T) {
+	type request struct {
+		Email string `json:"email" validate:"required,min=5,email"`
+	}
+
+	checkRules(t, request{}, map[string]string{"email": "required"})
+	checkRules(t, request{Email: "ab"}, map[string]string{"email": "min"})
+	checkRules(t, request{Email: "abcdef"}, map[string]string{"email": "email"})
+}
+
+func TestUnknownRule(t *testing.T) {
+	type request struct {
+		Name string `json:"name" validate:"required,nosuchrule"`
+	}
+
+	// The error is the same once the type's parsed rules are cached
+	for i := 0; i < 2; i++ {
+		err := Validate(request{Name: "a"})
+		if !errors.Is(err, ErrUnknownRule) {
+			t.Fatalf("expected ErrUnknownRule, got %v", err)
+		}
+		var errs Errors
+		if errors.As(err, &errs) {
+			t.Fatal("expected an unknown rule not to be reported as a field error")
+		}
+		if !strings.Contains(err.Error(), "nosuchrule") {
+			t.Errorf("expected the error to name the rule, got %q", err)
+		}
+	}
+}
+
+func TestRegisterRule(t *testing.T) {
+	RegisterRule("test_prefix", func(v reflect.Value, param string) bool {
+		return v.Kind() == reflect.String && strings.HasPrefix(v.String(), param)
+	}, "must start with %s")
+
+	type request struct {
+		Code string `json:"code" validate:"test_prefix=GT-"`
+	}
+
+	checkRules(t, request{Code: "GT-1"}, map[string]string{})
+
+	err := Validate(request{Code: "1"})
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("expected one field error, got %v", err)
+	}
+	if errs[0].Message != "must start with GT-" {
+		t.Errorf("expected the parameter in the message, got %q", errs[0].Message)
+	}
+}
+
+func TestValidateIgnoresNonStructs(t *testing.T) {
+	for _, v := range []interface{}{nil, "text", 3, []string{"a"}} {
+		if err := Validate(v); err != nil {
+			t.Errorf("expected %v to be valid, got %v", v, err)
+		}
+	}
+}